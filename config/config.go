@@ -1,7 +1,11 @@
 package config
 
 import (
+	"fmt"
+	"net/netip"
 	"os"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -10,53 +14,238 @@ type Config struct {
 	Network NetworkConfig `yaml:"network"`
 }
 
+// Firewall backends that can render the link model
+const (
+	BackendAuto     = "auto"
+	BackendIptables = "iptables"
+	BackendNftables = "nftables"
+)
+
+// Senders of router advertisements: the radvd daemon configured through
+// radvd.conf, or natman's own sender running in the daemon
+const (
+	RASenderRadvd   = "radvd"
+	RASenderBuiltin = "builtin"
+)
+
 type NetworkConfig struct {
-	Links map[string]LinkConfig `yaml:"links"`
+	Backend  string                    `yaml:"backend,omitempty"`   // auto (default), iptables or nftables
+	RASender string                    `yaml:"ra-sender,omitempty"` // radvd (default) or builtin
+	Links    map[string]LinkConfig     `yaml:"links"`
+	Failover map[string]FailoverConfig `yaml:"failover,omitempty"`
+}
+
+// FailoverConfig is a group of uplinks, the first healthy member in the
+// list carries the default route and the routed origins of the group
+type FailoverConfig struct {
+	Members  []FailoverMemberConfig `yaml:"members"`
+	Checks   []HealthCheckConfig    `yaml:"checks"`
+	Interval int                    `yaml:"interval,omitempty"`  // seconds between probe rounds
+	Timeout  int                    `yaml:"timeout,omitempty"`   // seconds to wait for a probe answer
+	Failures int                    `yaml:"failures,omitempty"`  // failed rounds before a member is down
+	HoldDown int                    `yaml:"hold-down,omitempty"` // seconds a recovered member must stay healthy before failing back
+}
+
+type FailoverMemberConfig struct {
+	Link     string `yaml:"link"`
+	Gateway  string `yaml:"gateway,omitempty"`  // IPv4 default gateway
+	Gateway6 string `yaml:"gateway6,omitempty"` // IPv6 default gateway
+	Table    int    `yaml:"table,omitempty"`    // routing table the health checks of the member use
+}
+
+// HealthCheckConfig is a probe target, set exactly one of icmp and tcp
+type HealthCheckConfig struct {
+	ICMP string `yaml:"icmp,omitempty"` // address to ping
+	TCP  string `yaml:"tcp,omitempty"`  // address:port to connect to
 }
 
+// Failover defaults
+const (
+	DefaultFailoverInterval = 5
+	DefaultFailoverTimeout  = 2
+	DefaultFailoverFailures = 3
+	DefaultFailoverHoldDown = 60
+)
+
 type LinkConfig struct {
-	Netmap6 map[string]Netmap6Config `yaml:"netmap6"`
-	Nat66   *Nat66Config             `yaml:"nat66,omitempty"`
-	Nat44   *Nat44Config             `yaml:"nat44,omitempty"`
-	Radv    *RadvConfig              `yaml:"radv,omitempty"`
+	Netmap6      map[string]Netmap6Config `yaml:"netmap6"`
+	Nat66        *Nat66Config             `yaml:"nat66,omitempty"`
+	Nat44        *Nat44Config             `yaml:"nat44,omitempty"`
+	PortForwards []PortForwardConfig      `yaml:"port-forwards,omitempty"`
+	Nat64        *Nat64Config             `yaml:"nat64,omitempty"`
+	Radv         *RadvConfig              `yaml:"radv,omitempty"`
 }
 
 type Netmap6Config struct {
 	Enabled bool      `yaml:"enabled"`
+	Mode    string    `yaml:"mode,omitempty"` // netmap (default) or nptv6
 	PfxPub  string    `yaml:"pfx-pub,omitempty"`
 	PfxPriv string    `yaml:"pfx-priv,omitempty"`
 	Maps    []MapPair `yaml:"maps"`
 }
 
+// Translation modes of a netmap6 set: stateful NETMAP in the nat table,
+// or stateless checksum-neutral prefix translation (RFC 6296)
+const (
+	Netmap6ModeNetmap = "netmap"
+	Netmap6ModeNPTv6  = "nptv6"
+)
+
+// MaxNPTv6PrefixLen is the longest prefix the kernel SNPT/DNPT targets take
+const MaxNPTv6PrefixLen = 64
+
 type MapPair struct {
 	Pair []interface{} `yaml:"pair"` // [public, private] or [public, private, preference, lifetime]
 }
 
 type Nat66Config struct {
-	Enabled     bool     `yaml:"enabled"`
-	MssClamping bool     `yaml:"mss-clamping"`
-	Mss         int      `yaml:"mss"`
-	Origins     []string `yaml:"origins"`
+	Enabled     bool           `yaml:"enabled"`
+	MssClamping bool           `yaml:"mss-clamping"`
+	Mss         int            `yaml:"mss"`
+	SnatTo      AddressList    `yaml:"snat-to,omitempty"`    // SNAT instead of MASQUERADE
+	Persistent  bool           `yaml:"persistent,omitempty"` // keep a client on the same snat-to address
+	Origins     []OriginConfig `yaml:"origins"`              // only these sources are translated, all when empty
+	Exclude     []string       `yaml:"exclude,omitempty"`    // destinations that are never translated
 }
 
 type Nat44Config struct {
-	Enabled     bool     `yaml:"enabled"`
-	MssClamping bool     `yaml:"mss-clamping"`
-	Mss         int      `yaml:"mss"`
-	Origins     []string `yaml:"origins"`
+	Enabled     bool           `yaml:"enabled"`
+	MssClamping bool           `yaml:"mss-clamping"`
+	Mss         int            `yaml:"mss"`
+	SnatTo      AddressList    `yaml:"snat-to,omitempty"`    // SNAT instead of MASQUERADE
+	Persistent  bool           `yaml:"persistent,omitempty"` // keep a client on the same snat-to address
+	Origins     []OriginConfig `yaml:"origins"`              // only these sources are translated, all when empty
+	Exclude     []string       `yaml:"exclude,omitempty"`    // destinations that are never translated
 }
 
+// OriginConfig is a source network of the link's NAT. It is written either
+// as a plain prefix or as a mapping with its own snat-to and routing.
+type OriginConfig struct {
+	Source     string      `yaml:"source"`
+	SnatTo     AddressList `yaml:"snat-to,omitempty"`
+	Persistent bool        `yaml:"persistent,omitempty"`
+	Table      int         `yaml:"table,omitempty"`   // routing table the origin egresses through
+	Gateway    string      `yaml:"gateway,omitempty"` // default route of the table, on-link when empty
+	Fwmark     uint32      `yaml:"fwmark,omitempty"`  // select the table by a mark set on the origin's packets
+}
+
+func (o *OriginConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*o = OriginConfig{}
+		return node.Decode(&o.Source)
+	}
+
+	type plain OriginConfig
+	return node.Decode((*plain)(o))
+}
+
+func (o OriginConfig) MarshalYAML() (interface{}, error) {
+	if len(o.SnatTo) == 0 && !o.Persistent && o.Table == 0 && o.Gateway == "" && o.Fwmark == 0 {
+		return o.Source, nil
+	}
+
+	type plain OriginConfig
+	return plain(o), nil
+}
+
+// AddressList holds snat-to addresses. A single address or range
+// ("203.0.113.5-203.0.113.9") can be written without the list brackets.
+type AddressList []string
+
+func (a *AddressList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var address string
+		if err := node.Decode(&address); err != nil {
+			return err
+		}
+		*a = AddressList{address}
+		return nil
+	}
+
+	var addresses []string
+	if err := node.Decode(&addresses); err != nil {
+		return err
+	}
+	*a = addresses
+	return nil
+}
+
+// Nat64Config lets the IPv6-only clients of the link reach IPv4 through a
+// userspace translator. The prefix is advertised with the RA PREF64 option
+// when radv is enabled on the link.
+type Nat64Config struct {
+	Enabled        bool   `yaml:"enabled"`
+	Prefix         string `yaml:"prefix,omitempty"`          // /96 NAT64 prefix, 64:ff9b::/96 when empty
+	Translator     string `yaml:"translator,omitempty"`      // jool (default) or tayga
+	Pool4          string `yaml:"pool4,omitempty"`           // IPv4 addresses to translate to
+	Pref64Lifetime int    `yaml:"pref64-lifetime,omitempty"` // seconds, 3 * max adv-interval when 0
+	Dns64          string `yaml:"dns64,omitempty"`           // bind or unbound, writes a DNS64 snippet
+}
+
+// NAT64 defaults and choices
+const (
+	Nat64WellKnownPrefix = "64:ff9b::/96"
+	Nat64PrefixLen       = 96
+	MaxPref64Lifetime    = 65528 // 13 bit scaled lifetime in units of 8 seconds (RFC 8781)
+
+	TranslatorJool  = "jool"
+	TranslatorTayga = "tayga"
+
+	// Tayga needs its own IPv4 pool, jool uses the host addresses without pool4
+	DefaultTaygaPool4 = "192.168.255.0/24"
+
+	Dns64Bind    = "bind"
+	Dns64Unbound = "unbound"
+)
+
+// PortForwardConfig exposes an internal service on the link (DNAT).
+// The address family follows the internal address in To.
+type PortForwardConfig struct {
+	Proto  string `yaml:"proto"`            // tcp or udp
+	Port   string `yaml:"port"`             // external port or range, e.g. 443 or 8000-8010
+	To     string `yaml:"to"`               // 10.0.0.5:8443, [fd00::5]:8443 or just the address to keep the port
+	Source string `yaml:"source,omitempty"` // optional prefix allowed to connect
+}
+
+// Protocols accepted by port forwards
+var ForwardProtocols = []string{"tcp", "udp"}
+
 type RadvConfig struct {
-	Enabled     bool                  `yaml:"enabled"`
-	AdvInterval []int                 `yaml:"adv-interval"` // [min, max]
-	Lifetime    int                   `yaml:"lifetime"`
-	Dhcp        bool                  `yaml:"dhcp"`
-	Prefixes    []PrefixConfigCompact `yaml:"prefixes"`
-	Routes      []RouteArray          `yaml:"routes"`
-	RDNSS       []RDNSSConfigCompact  `yaml:"rdnss"`
-	Include     []string              `yaml:"include"`
+	Enabled        bool                  `yaml:"enabled"`
+	AdvInterval    []int                 `yaml:"adv-interval"` // [min, max]
+	Lifetime       int                   `yaml:"lifetime"`
+	Preference     string                `yaml:"preference,omitempty"`     // default router preference: high, medium or low
+	DHCPv6         string                `yaml:"dhcpv6,omitempty"`         // stateful, stateless or off (default)
+	Dhcp           bool                  `yaml:"dhcp,omitempty"`           // deprecated, same as dhcpv6: stateful
+	MTU            int                   `yaml:"mtu,omitempty"`            // advertised link MTU, not sent when 0
+	ReachableTime  int                   `yaml:"reachable-time,omitempty"` // milliseconds, unspecified when 0
+	RetransTimer   int                   `yaml:"retrans-timer,omitempty"`  // milliseconds, unspecified when 0
+	HopLimit       *int                  `yaml:"hop-limit,omitempty"`      // radvd default 64, 0 is unspecified
+	HomeAgent      bool                  `yaml:"home-agent,omitempty"`     // Mobile IPv6 home agent flag
+	SrcLLAddr      *bool                 `yaml:"src-ll-addr,omitempty"`    // include the source link-layer address, on by default
+	SrcAddr        []string              `yaml:"src-addr,omitempty"`       // link-local addresses to send advertisements from
+	Clients        []string              `yaml:"clients,omitempty"`        // only advertise unicast to these link-local addresses
+	Prefixes       []PrefixConfigCompact `yaml:"prefixes"`
+	Routes         []RouteArray          `yaml:"routes"`
+	RDNSS          []RDNSSConfigCompact  `yaml:"rdnss"`
+	DNSSL          []DNSSLConfigCompact  `yaml:"dnssl,omitempty"`
+	Pref64         *Pref64ConfigCompact  `yaml:"pref64,omitempty"` // NAT64 prefix, overrides the one of the nat64 section
+	Include        []string              `yaml:"include"`
+	WithdrawPeriod *int                  `yaml:"withdraw-period,omitempty"` // seconds to advertise removed prefixes and routes with zero lifetimes
 }
 
+// DefaultWithdrawPeriod outlasts the default prefix and route lifetimes: by
+// then a client either heard the withdrawal or what it learned expired
+const DefaultWithdrawPeriod = 3600
+
+// DHCPv6 modes announced in router advertisements: stateful sets the
+// managed (M) and other config (O) flags, stateless only the O flag
+const (
+	DHCPv6Stateful  = "stateful"
+	DHCPv6Stateless = "stateless"
+	DHCPv6Off       = "off"
+)
+
 type PrefixConfigCompact struct {
 	Prefix   string `yaml:"prefix"`
 	OnLink   bool   `yaml:"on-link"`
@@ -74,6 +263,93 @@ type RDNSSConfigCompact struct {
 	Lifetime int      `yaml:"lifetime"`
 }
 
+type DNSSLConfigCompact struct {
+	Domain   []string `yaml:"domain"`
+	Lifetime int      `yaml:"lifetime"`
+}
+
+type Pref64ConfigCompact struct {
+	Prefix   string `yaml:"prefix"`
+	Lifetime int    `yaml:"lifetime,omitempty"` // seconds, 3 * max adv-interval when 0
+}
+
+// ParsePortRange parses a port ("443") or port range ("8000-8010")
+func ParsePortRange(value string) (int, int, error) {
+	firstPart, lastPart, isRange := strings.Cut(value, "-")
+
+	first, err := strconv.Atoi(firstPart)
+	if err != nil || first < 1 || first > 65535 {
+		return 0, 0, fmt.Errorf("'%s' is not a valid port or port range", value)
+	}
+	if !isRange {
+		return first, first, nil
+	}
+
+	last, err := strconv.Atoi(lastPart)
+	if err != nil || last < first || last > 65535 {
+		return 0, 0, fmt.Errorf("'%s' is not a valid port or port range", value)
+	}
+	return first, last, nil
+}
+
+// ParseAddressRange parses an address or an address range
+// ("203.0.113.5-203.0.113.9"), both ends are equal for a single address
+func ParseAddressRange(value string) (netip.Addr, netip.Addr, error) {
+	firstPart, lastPart, isRange := strings.Cut(value, "-")
+
+	first, err := netip.ParseAddr(firstPart)
+	if err != nil || first.Zone() != "" {
+		return netip.Addr{}, netip.Addr{}, fmt.Errorf("'%s' is not a valid address or address range", value)
+	}
+	if !isRange {
+		return first, first, nil
+	}
+
+	last, err := netip.ParseAddr(lastPart)
+	if err != nil || last.Zone() != "" || last.Is6() != first.Is6() || last.Less(first) {
+		return netip.Addr{}, netip.Addr{}, fmt.Errorf("'%s' is not a valid address or address range", value)
+	}
+	return first, last, nil
+}
+
+// ParseForwardTarget splits the to value of a port forward into the internal
+// address and the optional internal port
+func ParseForwardTarget(value string) (netip.Addr, string, error) {
+	addrPart, ports := value, ""
+
+	if strings.HasPrefix(value, "[") {
+		end := strings.Index(value, "]")
+		if end < 0 {
+			return netip.Addr{}, "", fmt.Errorf("'%s' is missing the closing ']'", value)
+		}
+		addrPart, ports = value[1:end], value[end+1:]
+		if ports != "" {
+			var ok bool
+			if ports, ok = strings.CutPrefix(ports, ":"); !ok || ports == "" {
+				return netip.Addr{}, "", fmt.Errorf("'%s' is not a valid address:port", value)
+			}
+		}
+	} else if strings.Count(value, ":") == 1 {
+		addrPart, ports, _ = strings.Cut(value, ":")
+		if ports == "" {
+			return netip.Addr{}, "", fmt.Errorf("'%s' is not a valid address:port", value)
+		}
+	}
+
+	addr, err := netip.ParseAddr(addrPart)
+	if err != nil || addr.Zone() != "" {
+		return netip.Addr{}, "", fmt.Errorf("'%s' is not a valid internal address", value)
+	}
+
+	if ports != "" {
+		if port, err := strconv.Atoi(ports); err != nil || port < 1 || port > 65535 {
+			return netip.Addr{}, "", fmt.Errorf("'%s' is not a valid internal port", ports)
+		}
+	}
+
+	return addr.Unmap(), ports, nil
+}
+
 func ParseConfig(configPath string) (*Config, error) {
 	data, err := os.ReadFile(configPath)
 	if err != nil {
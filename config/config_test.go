@@ -0,0 +1,79 @@
+package config
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		value       string
+		first, last int // 0 when an error is expected
+	}{
+		{"443", 443, 443},
+		{"8000-8010", 8000, 8010},
+		{"80-80", 80, 80},
+		{"1-65535", 1, 65535},
+		{"0", 0, 0},
+		{"65536", 0, 0},
+		{"8010-8000", 0, 0},
+		{"0-80", 0, 0},
+		{"1-65536", 0, 0},
+		{"-80", 0, 0},
+		{"80-", 0, 0},
+		{"http", 0, 0},
+		{"", 0, 0},
+	}
+
+	for _, tt := range tests {
+		first, last, err := ParsePortRange(tt.value)
+		if tt.first == 0 {
+			if err == nil {
+				t.Errorf("ParsePortRange(%q) = %d, %d, want an error", tt.value, first, last)
+			}
+			continue
+		}
+		if err != nil || first != tt.first || last != tt.last {
+			t.Errorf("ParsePortRange(%q) = %d, %d, %v, want %d, %d", tt.value, first, last, err, tt.first, tt.last)
+		}
+	}
+}
+
+func TestParseForwardTarget(t *testing.T) {
+	tests := []struct {
+		value string
+		addr  string // empty when an error is expected
+		port  string
+	}{
+		{"10.0.0.5:8443", "10.0.0.5", "8443"},
+		{"10.0.0.5", "10.0.0.5", ""},
+		{"[fd00::5]:8443", "fd00::5", "8443"},
+		{"[fd00::5]", "fd00::5", ""},
+		{"fd00::5", "fd00::5", ""},
+		{"::ffff:10.0.0.5", "10.0.0.5", ""},
+		{"[fd00::5", "", ""},
+		{"[fd00::5]:", "", ""},
+		{"[fd00::5]8443", "", ""},
+		{"[10.0.0.5]:80x", "", ""},
+		{"10.0.0.5:", "", ""},
+		{"10.0.0.5:0", "", ""},
+		{"10.0.0.5:65536", "", ""},
+		{"10.0.0.5:https", "", ""},
+		{"host:80", "", ""},
+		{"fe80::1%eth0", "", ""},
+		{"[fe80::1%eth0]:80", "", ""},
+	}
+
+	for _, tt := range tests {
+		addr, port, err := ParseForwardTarget(tt.value)
+		if tt.addr == "" {
+			if err == nil {
+				t.Errorf("ParseForwardTarget(%q) = %s, %q, want an error", tt.value, addr, port)
+			}
+			continue
+		}
+		if err != nil || addr != netip.MustParseAddr(tt.addr) || port != tt.port {
+			t.Errorf("ParseForwardTarget(%q) = %s, %q, %v, want %s, %q", tt.value, addr, port, err, tt.addr, tt.port)
+		}
+	}
+}
@@ -0,0 +1,890 @@
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"natman/link/prefix6"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Accepted MSS values, IPv6 links must carry at least 1280 byte packets
+const (
+	MinMss44 = 536
+	MinMss66 = 1220
+	MaxMss   = 65535
+)
+
+// Router advertisement timing limits from RFC 4861 section 6.2.1
+const (
+	MinAdvIntervalMin = 3
+	MaxAdvIntervalMin = 4
+	MaxAdvIntervalMax = 1800
+	MaxRouterLifetime = 9000
+	MaxReachableTime  = 3600000
+)
+
+// Other router advertisement value limits, IPv6 links carry at least 1280 bytes
+const (
+	MinLinkMTU  = 1280
+	MaxLinkMTU  = 65535
+	MaxHopLimit = 255
+)
+
+// NAT64 prefix lengths the PREF64 option can carry (RFC 8781)
+var Pref64Lengths = []int{32, 40, 48, 56, 64, 96}
+
+// Routing tables reserved by the kernel (local, main, default)
+const (
+	MinReservedTable = 253
+	MaxReservedTable = 255
+)
+
+// Route preferences understood by radvd (RFC 4191)
+var Preferences = []string{"high", "medium", "low"}
+
+// ValidationError is a problem found in the config file, positioned at
+// the YAML node it concerns
+type ValidationError struct {
+	Line    int
+	Column  int
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.Path, e.Message)
+	}
+	return fmt.Sprintf("line %d, column %d: %s: %s", e.Line, e.Column, e.Path, e.Message)
+}
+
+// ValidationErrors collects every problem found in a config file
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// LoadConfig parses the config file and validates it strictly, unknown keys
+// and invalid values are reported as ValidationErrors
+func LoadConfig(configPath string) (*Config, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return Validate(data)
+}
+
+// Validate decodes and validates a config document
+func Validate(data []byte) (*Config, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+
+	v := &validator{nodes: make(map[string]*yaml.Node), tables: make(map[string]string)}
+
+	var config Config
+	if len(root.Content) > 0 {
+		v.checkKeys(root.Content[0], reflect.TypeOf(config), "")
+
+		// Values of the wrong shape were already reported with their position
+		if err := root.Content[0].Decode(&config); err != nil {
+			if len(v.errors) > 0 {
+				return nil, v.sortedErrors()
+			}
+			return nil, err
+		}
+	}
+
+	v.checkConfig(&config)
+
+	if len(v.errors) > 0 {
+		return nil, v.sortedErrors()
+	}
+
+	return &config, nil
+}
+
+// sortedErrors returns the errors in the order of the file
+func (v *validator) sortedErrors() ValidationErrors {
+	sort.SliceStable(v.errors, func(i, j int) bool {
+		if v.errors[i].Line != v.errors[j].Line {
+			return v.errors[i].Line < v.errors[j].Line
+		}
+		return v.errors[i].Column < v.errors[j].Column
+	})
+	return v.errors
+}
+
+type validator struct {
+	nodes  map[string]*yaml.Node // node of every path seen while checking keys
+	errors ValidationErrors
+	tables map[string]string // default route of every policy routing table, by family and table
+
+	backend  string
+	raSender string
+}
+
+// errorf records an error at the node of path, or of its closest parent
+func (v *validator) errorf(path string, format string, args ...interface{}) {
+	err := ValidationError{Path: path, Message: fmt.Sprintf(format, args...)}
+
+	for p := path; ; p = parentPath(p) {
+		if node, ok := v.nodes[p]; ok {
+			err.Line, err.Column = node.Line, node.Column
+			break
+		}
+		if p == "" {
+			break
+		}
+	}
+
+	if err.Path == "" {
+		err.Path = "config"
+	}
+	v.errors = append(v.errors, err)
+}
+
+func parentPath(path string) string {
+	if i := strings.LastIndexAny(path, ".["); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+var unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// checkKeys walks the node tree along the Go type it decodes into and
+// reports keys that do not exist in the schema
+func (v *validator) checkKeys(node *yaml.Node, t reflect.Type, path string) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	v.nodes[path] = node
+
+	// An empty value leaves the field at its default
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return
+	}
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	// Types decoding themselves validate their own shape, structs written
+	// in their long form are still checked key by key
+	if reflect.PointerTo(t).Implements(unmarshalerType) &&
+		(t.Kind() != reflect.Struct || node.Kind != yaml.MappingNode) {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			v.errorf(path, "expected a mapping")
+			return
+		}
+
+		fields := make(map[string]reflect.Type)
+		var names []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			fields[name] = field.Type
+			names = append(names, name)
+		}
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			keyPath := joinPath(path, key.Value)
+
+			fieldType, ok := fields[key.Value]
+			if !ok {
+				v.nodes[keyPath] = key
+				v.errorf(keyPath, "unknown key '%s' (expected one of: %s)", key.Value, strings.Join(names, ", "))
+				continue
+			}
+			v.checkKeys(value, fieldType, keyPath)
+		}
+
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			v.errorf(path, "expected a mapping")
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			v.checkKeys(node.Content[i+1], t.Elem(), joinPath(path, node.Content[i].Value))
+		}
+
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			v.errorf(path, "expected a list")
+			return
+		}
+		for i, item := range node.Content {
+			v.checkKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+
+	case reflect.Interface:
+		// Mixed lists such as pair and route, checked by value below
+		for i, item := range node.Content {
+			v.checkKeys(item, t, fmt.Sprintf("%s[%d]", path, i))
+		}
+
+	default:
+		if node.Kind != yaml.ScalarNode {
+			v.errorf(path, "expected a single value")
+		}
+	}
+}
+
+func (v *validator) checkConfig(config *Config) {
+	v.backend = config.Network.Backend
+	switch config.Network.Backend {
+	case "", BackendAuto, BackendIptables, BackendNftables:
+	default:
+		v.errorf("network.backend", "unknown backend '%s' (expected %s, %s or %s)",
+			config.Network.Backend, BackendAuto, BackendIptables, BackendNftables)
+	}
+
+	v.raSender = config.Network.RASender
+	switch config.Network.RASender {
+	case "", RASenderRadvd, RASenderBuiltin:
+	default:
+		v.errorf("network.ra-sender", "unknown router advertisement sender '%s' (expected %s or %s)",
+			config.Network.RASender, RASenderRadvd, RASenderBuiltin)
+	}
+
+	if len(config.Network.Links) == 0 {
+		v.errorf("network.links", "no links configured")
+	}
+
+	for _, name := range sortedKeys(config.Network.Links) {
+		v.checkLink(name, config.Network.Links[name])
+	}
+
+	v.checkNat64Translator(config)
+
+	grouped := make(map[string]string)
+	for _, name := range sortedKeys(config.Network.Failover) {
+		v.checkFailover(config, name, config.Network.Failover[name], grouped)
+	}
+}
+
+// checkFailover validates a failover group, a link can be a member of a
+// single group only
+func (v *validator) checkFailover(config *Config, name string, group FailoverConfig, grouped map[string]string) {
+	path := "network.failover." + name
+
+	if len(group.Members) < 2 {
+		v.errorf(path+".members", "a failover group needs at least two members")
+	}
+
+	for i, member := range group.Members {
+		memberPath := fmt.Sprintf("%s.members[%d]", path, i)
+
+		if _, ok := config.Network.Links[member.Link]; !ok {
+			v.errorf(memberPath+".link", "link '%s' is not configured", member.Link)
+		} else if other, ok := grouped[member.Link]; ok {
+			v.errorf(memberPath+".link", "link '%s' is already a member of failover group %s", member.Link, other)
+		} else {
+			grouped[member.Link] = name
+		}
+
+		for _, gateway := range []struct {
+			key    string
+			value  string
+			family string
+		}{{"gateway", member.Gateway, "IPv4"}, {"gateway6", member.Gateway6, "IPv6"}} {
+			if gateway.value == "" {
+				continue
+			}
+			addr, err := netip.ParseAddr(gateway.value)
+			if err != nil || addr.Is6() != (gateway.family == "IPv6") || addr.Is4In6() {
+				v.errorf(memberPath+"."+gateway.key, "'%s' is not a valid %s address", gateway.value, gateway.family)
+			}
+		}
+
+		if member.Table < 0 || int64(member.Table) > 0xffffffff ||
+			(member.Table >= MinReservedTable && member.Table <= MaxReservedTable) {
+			v.errorf(memberPath+".table", "table %d is reserved or out of range 1-%d", member.Table, uint32(0xffffffff))
+		} else if member.Table != 0 && member.Gateway == "" && member.Gateway6 == "" {
+			v.errorf(memberPath+".table", "table requires gateway or gateway6")
+		}
+	}
+
+	if len(group.Checks) == 0 {
+		v.errorf(path+".checks", "a failover group needs at least one health check")
+	}
+	for i, check := range group.Checks {
+		checkPath := fmt.Sprintf("%s.checks[%d]", path, i)
+		switch {
+		case (check.ICMP == "") == (check.TCP == ""):
+			v.errorf(checkPath, "set exactly one of icmp and tcp")
+		case check.ICMP != "":
+			if addr, err := netip.ParseAddr(check.ICMP); err != nil || addr.Zone() != "" {
+				v.errorf(checkPath+".icmp", "'%s' is not a valid address", check.ICMP)
+			}
+		default:
+			if _, err := netip.ParseAddrPort(check.TCP); err != nil {
+				v.errorf(checkPath+".tcp", "'%s' is not a valid address:port", check.TCP)
+			}
+		}
+	}
+
+	for _, setting := range []struct {
+		key   string
+		value int
+	}{{"interval", group.Interval}, {"timeout", group.Timeout}, {"failures", group.Failures}, {"hold-down", group.HoldDown}} {
+		if setting.value < 0 {
+			v.errorf(path+"."+setting.key, "%s must not be negative", setting.key)
+		}
+	}
+}
+
+func (v *validator) checkLink(name string, link LinkConfig) {
+	path := "network.links." + name
+
+	if len(name) > 15 || strings.ContainsAny(name, "/ \t") {
+		v.errorf(path, "'%s' is not a valid interface name", name)
+	}
+
+	for _, setName := range sortedKeys(link.Netmap6) {
+		v.checkNetmap6(path+".netmap6."+setName, link.Netmap6[setName])
+	}
+
+	if link.Nat44 != nil {
+		v.checkNat(name, path+".nat44", link.Nat44.MssClamping, link.Nat44.Mss, MinMss44,
+			link.Nat44.SnatTo, link.Nat44.Persistent, link.Nat44.Origins, link.Nat44.Exclude, false)
+	}
+	if link.Nat66 != nil {
+		v.checkNat(name, path+".nat66", link.Nat66.MssClamping, link.Nat66.Mss, MinMss66,
+			link.Nat66.SnatTo, link.Nat66.Persistent, link.Nat66.Origins, link.Nat66.Exclude, true)
+	}
+
+	for i, forward := range link.PortForwards {
+		v.checkPortForward(fmt.Sprintf("%s.port-forwards[%d]", path, i), forward)
+	}
+
+	if link.Nat64 != nil {
+		v.checkNat64(path+".nat64", link.Nat64)
+	}
+
+	if link.Radv != nil {
+		v.checkRadv(path+".radv", link.Radv)
+	}
+}
+
+func (v *validator) checkNat64(path string, nat64 *Nat64Config) {
+	if nat64.Prefix != "" {
+		prefix, err := netip.ParsePrefix(nat64.Prefix)
+		if err != nil || !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+			v.errorf(path+".prefix", "'%s' is not a valid IPv6 prefix", nat64.Prefix)
+		} else if prefix.Bits() != Nat64PrefixLen {
+			v.errorf(path+".prefix", "NAT64 prefix %s must be a /%d", nat64.Prefix, Nat64PrefixLen)
+		} else if prefix.Masked() != prefix {
+			v.errorf(path+".prefix", "NAT64 prefix %s has bits set beyond /%d", nat64.Prefix, Nat64PrefixLen)
+		}
+	}
+
+	switch nat64.Translator {
+	case "", TranslatorJool, TranslatorTayga:
+	default:
+		v.errorf(path+".translator", "unknown translator '%s' (expected %s or %s)",
+			nat64.Translator, TranslatorJool, TranslatorTayga)
+	}
+
+	if nat64.Pool4 != "" {
+		v.checkPrefix(path+".pool4", nat64.Pool4, false, true)
+	}
+
+	if nat64.Pref64Lifetime < 0 || nat64.Pref64Lifetime > MaxPref64Lifetime {
+		v.errorf(path+".pref64-lifetime", "lifetime %d out of range 0-%d", nat64.Pref64Lifetime, MaxPref64Lifetime)
+	}
+
+	switch nat64.Dns64 {
+	case "", Dns64Bind, Dns64Unbound:
+	default:
+		v.errorf(path+".dns64", "unknown resolver '%s' (expected %s or %s)", nat64.Dns64, Dns64Bind, Dns64Unbound)
+	}
+}
+
+// checkNat64Translator reports enabled nat64 sections that disagree on
+// the translator setup, every link shares the single translator instance
+func (v *validator) checkNat64Translator(config *Config) {
+	first := ""
+	var want Nat64Config
+	for _, name := range sortedKeys(config.Network.Links) {
+		nat64 := config.Network.Links[name].Nat64
+		if nat64 == nil || !nat64.Enabled {
+			continue
+		}
+
+		shared := Nat64Config{Prefix: nat64.Prefix, Translator: nat64.Translator, Pool4: nat64.Pool4}
+		if shared.Prefix == "" {
+			shared.Prefix = Nat64WellKnownPrefix
+		}
+		if shared.Translator == "" {
+			shared.Translator = TranslatorJool
+		}
+
+		if first == "" {
+			first, want = name, shared
+			continue
+		}
+
+		path := "network.links." + name + ".nat64"
+		for _, field := range []struct{ key, got, want string }{
+			{"prefix", shared.Prefix, want.Prefix},
+			{"translator", shared.Translator, want.Translator},
+			{"pool4", shared.Pool4, want.Pool4},
+		} {
+			if field.got != field.want {
+				v.errorf(path+"."+field.key, "%s '%s' differs from '%s' of link %s, all links share one translator",
+					field.key, field.got, field.want, first)
+			}
+		}
+	}
+}
+
+func (v *validator) checkNetmap6(path string, set Netmap6Config) {
+	nptv6 := set.Mode == Netmap6ModeNPTv6
+	switch set.Mode {
+	case "", Netmap6ModeNetmap:
+	case Netmap6ModeNPTv6:
+		if v.backend == BackendNftables {
+			v.errorf(path+".mode", "nptv6 needs the iptables backend, nftables has no checksum-neutral prefix translation")
+		}
+	default:
+		v.errorf(path+".mode", "unknown mode '%s' (expected %s or %s)", set.Mode, Netmap6ModeNetmap, Netmap6ModeNPTv6)
+	}
+
+	pubOk := v.checkBase(path+".pfx-pub", set.PfxPub)
+	privOk := v.checkBase(path+".pfx-priv", set.PfxPriv)
+
+	for i, m := range set.Maps {
+		pairPath := fmt.Sprintf("%s.maps[%d].pair", path, i)
+
+		if len(m.Pair) != 2 && len(m.Pair) != 4 {
+			v.errorf(pairPath, "expected [public, private] or [public, private, preference, lifetime], got %d values", len(m.Pair))
+			continue
+		}
+
+		var composed [2]netip.Prefix
+		valid := true
+		for j, side := range []struct {
+			name   string
+			base   string
+			baseOk bool
+		}{{"public", set.PfxPub, pubOk}, {"private", set.PfxPriv, privOk}} {
+			sidePath := fmt.Sprintf("%s[%d]", pairPath, j)
+
+			fragment, ok := m.Pair[j].(string)
+			if !ok {
+				v.errorf(sidePath, "%s side must be an IPv6 address fragment", side.name)
+				valid = false
+				continue
+			}
+			if _, err := prefix6.ParseFragment(fragment); err != nil {
+				v.errorf(sidePath, "%v", err)
+				valid = false
+				continue
+			}
+			if !side.baseOk {
+				valid = false
+				continue
+			}
+
+			prefix, err := prefix6.Compose(side.base, fragment)
+			if err != nil {
+				v.errorf(sidePath, "%v", err)
+				valid = false
+				continue
+			}
+			composed[j] = prefix
+		}
+
+		// NETMAP needs equally sized ranges on both sides, RFC 6296 equal prefix lengths
+		if valid && composed[0].Bits() != composed[1].Bits() {
+			if nptv6 {
+				v.errorf(pairPath, "NPTv6 requires prefixes of equal length, public %s and private %s differ", composed[0], composed[1])
+			} else {
+				v.errorf(pairPath, "public %s and private %s differ in prefix length", composed[0], composed[1])
+			}
+		} else if valid && nptv6 && composed[0].Bits() > MaxNPTv6PrefixLen {
+			v.errorf(pairPath, "NPTv6 translates prefixes of at most /%d, got %s", MaxNPTv6PrefixLen, composed[0])
+		}
+
+		if len(m.Pair) == 4 {
+			v.checkPreference(pairPath+"[2]", m.Pair[2])
+			v.checkLifetime(pairPath+"[3]", m.Pair[3])
+		}
+	}
+}
+
+// checkBase validates the pfx-pub and pfx-priv prefixes of a netmap set
+func (v *validator) checkBase(path, value string) bool {
+	if _, err := prefix6.ParseBase(value); err != nil {
+		v.errorf(path, "%v", err)
+		return false
+	}
+	return true
+}
+
+func (v *validator) checkNat(linkName, path string, mssClamping bool, mss, minMss int, snatTo AddressList, persistent bool, origins []OriginConfig, exclude []string, ipv6 bool) {
+	if mss != 0 && (mss < minMss || mss > MaxMss) {
+		v.errorf(path+".mss", "mss %d out of range %d-%d", mss, minMss, MaxMss)
+	}
+	if mssClamping && mss == 0 {
+		v.errorf(path+".mss-clamping", "mss-clamping requires mss")
+	}
+
+	v.checkSnatTo(path, snatTo, persistent, ipv6)
+
+	for i, origin := range origins {
+		originPath := fmt.Sprintf("%s.origins[%d]", path, i)
+		if len(origin.SnatTo) > 0 || origin.Persistent {
+			v.checkPrefix(originPath+".source", origin.Source, ipv6, true)
+		} else {
+			v.checkPrefix(originPath, origin.Source, ipv6, true)
+		}
+		v.checkSnatTo(originPath, origin.SnatTo, origin.Persistent, ipv6)
+		v.checkRouting(linkName, originPath, origin, ipv6)
+	}
+
+	for i, destination := range exclude {
+		v.checkPrefix(fmt.Sprintf("%s.exclude[%d]", path, i), destination, ipv6, true)
+	}
+}
+
+// checkRouting validates the policy routing of an origin. A table holds a
+// single default route, so origins sharing it must agree on link and gateway.
+func (v *validator) checkRouting(linkName, path string, origin OriginConfig, ipv6 bool) {
+	if origin.Table == 0 {
+		if origin.Gateway != "" {
+			v.errorf(path+".gateway", "gateway requires table")
+		}
+		if origin.Fwmark != 0 {
+			v.errorf(path+".fwmark", "fwmark requires table")
+		}
+		return
+	}
+
+	if origin.Table < 0 || int64(origin.Table) > 0xffffffff ||
+		(origin.Table >= MinReservedTable && origin.Table <= MaxReservedTable) {
+		v.errorf(path+".table", "table %d is reserved or out of range 1-%d", origin.Table, uint32(0xffffffff))
+		return
+	}
+
+	if origin.Gateway != "" {
+		gateway, err := netip.ParseAddr(origin.Gateway)
+		if err != nil || gateway.Zone() != "" || gateway.Is6() != ipv6 || gateway.Is4In6() {
+			v.errorf(path+".gateway", "'%s' is not an address of the family of the NAT section", origin.Gateway)
+			return
+		}
+	}
+
+	family := "ipv4"
+	if ipv6 {
+		family = "ipv6"
+	}
+	key := fmt.Sprintf("%s table %d", family, origin.Table)
+	route := fmt.Sprintf("dev %s via %s", linkName, origin.Gateway)
+	if origin.Gateway == "" {
+		route = fmt.Sprintf("dev %s", linkName)
+	}
+
+	if existing, ok := v.tables[key]; ok && existing != route {
+		v.errorf(path+".table", "%s already routes %s, not %s", key, existing, route)
+		return
+	}
+	v.tables[key] = route
+}
+
+// checkSnatTo validates the snat-to addresses and ranges of a NAT section
+func (v *validator) checkSnatTo(path string, snatTo AddressList, persistent, ipv6 bool) {
+	if persistent && len(snatTo) == 0 {
+		v.errorf(path+".persistent", "persistent requires snat-to")
+	}
+
+	for i, value := range snatTo {
+		entryPath := path + ".snat-to"
+		if len(snatTo) > 1 {
+			entryPath = fmt.Sprintf("%s[%d]", entryPath, i)
+		}
+
+		first, _, err := ParseAddressRange(value)
+		if err != nil {
+			v.errorf(entryPath, "%v", err)
+			continue
+		}
+		if first.Is6() != ipv6 || first.Is4In6() {
+			v.errorf(entryPath, "'%s' is not of the address family of the NAT section", value)
+		}
+	}
+}
+
+func (v *validator) checkPortForward(path string, forward PortForwardConfig) {
+	if !slices.Contains(ForwardProtocols, forward.Proto) {
+		v.errorf(path+".proto", "unknown protocol '%s' (expected %s)", forward.Proto, strings.Join(ForwardProtocols, " or "))
+	}
+
+	if _, _, err := ParsePortRange(forward.Port); err != nil {
+		v.errorf(path+".port", "%v", err)
+	}
+
+	addr, _, err := ParseForwardTarget(forward.To)
+	if err != nil {
+		v.errorf(path+".to", "%v", err)
+		return
+	}
+
+	if forward.Source != "" {
+		v.checkPrefix(path+".source", forward.Source, addr.Is6(), true)
+	}
+}
+
+// checkPrefix validates a CIDR of the given family, plain addresses are
+// accepted as host prefixes when allowAddr is set
+func (v *validator) checkPrefix(path, value string, ipv6, allowAddr bool) {
+	family := "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		addr, addrErr := netip.ParseAddr(value)
+		if !allowAddr || addrErr != nil {
+			v.errorf(path, "'%s' is not a valid %s prefix", value, family)
+			return
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+
+	if prefix.Addr().Is6() != ipv6 || prefix.Addr().Is4In6() {
+		v.errorf(path, "'%s' is not an %s prefix", value, family)
+	}
+}
+
+func (v *validator) checkRadv(path string, radv *RadvConfig) {
+	if len(radv.AdvInterval) > 0 {
+		if len(radv.AdvInterval) != 2 {
+			v.errorf(path+".adv-interval", "expected [min, max], got %d values", len(radv.AdvInterval))
+		} else {
+			min, max := radv.AdvInterval[0], radv.AdvInterval[1]
+			if max < MaxAdvIntervalMin || max > MaxAdvIntervalMax {
+				v.errorf(path+".adv-interval[1]", "max interval %d out of range %d-%d",
+					max, MaxAdvIntervalMin, MaxAdvIntervalMax)
+			}
+			if min < MinAdvIntervalMin || 4*min > 3*max {
+				v.errorf(path+".adv-interval[0]", "min interval %d out of range %d-%d (0.75 * max)",
+					min, MinAdvIntervalMin, 3*max/4)
+			}
+		}
+	}
+
+	if radv.Lifetime < 0 || radv.Lifetime > MaxRouterLifetime {
+		v.errorf(path+".lifetime", "lifetime %d out of range 0-%d", radv.Lifetime, MaxRouterLifetime)
+	}
+
+	for i, prefix := range radv.Prefixes {
+		prefixPath := fmt.Sprintf("%s.prefixes[%d]", path, i)
+		v.checkPrefix(prefixPath+".prefix", prefix.Prefix, true, false)
+
+		if len(prefix.Lifetime) > 0 {
+			if len(prefix.Lifetime) != 2 {
+				v.errorf(prefixPath+".lifetime", "expected [valid, preferred], got %d values", len(prefix.Lifetime))
+			} else if prefix.Lifetime[0] < 0 || prefix.Lifetime[1] < 0 {
+				v.errorf(prefixPath+".lifetime", "lifetimes must not be negative")
+			} else if prefix.Lifetime[1] > prefix.Lifetime[0] {
+				v.errorf(prefixPath+".lifetime", "preferred lifetime %d exceeds valid lifetime %d",
+					prefix.Lifetime[1], prefix.Lifetime[0])
+			}
+		}
+	}
+
+	for i, route := range radv.Routes {
+		routePath := fmt.Sprintf("%s.routes[%d].route", path, i)
+
+		if len(route.Route) < 2 || len(route.Route) > 3 {
+			v.errorf(routePath, "expected [prefix, preference] or [prefix, preference, lifetime], got %d values", len(route.Route))
+			continue
+		}
+
+		if s, ok := route.Route[0].(string); ok {
+			v.checkPrefix(routePath+"[0]", s, true, false)
+		} else {
+			v.errorf(routePath+"[0]", "route prefix must be an IPv6 prefix")
+		}
+		v.checkPreference(routePath+"[1]", route.Route[1])
+		if len(route.Route) == 3 {
+			v.checkLifetime(routePath+"[2]", route.Route[2])
+		}
+	}
+
+	for i, rdnss := range radv.RDNSS {
+		rdnssPath := fmt.Sprintf("%s.rdnss[%d]", path, i)
+
+		if len(rdnss.Server) == 0 {
+			v.errorf(rdnssPath+".server", "at least one server is required")
+		}
+		for j, server := range rdnss.Server {
+			if addr, err := netip.ParseAddr(server); err != nil || !addr.Is6() || addr.Is4In6() {
+				v.errorf(fmt.Sprintf("%s.server[%d]", rdnssPath, j), "'%s' is not an IPv6 address", server)
+			}
+		}
+		if rdnss.Lifetime < 0 {
+			v.errorf(rdnssPath+".lifetime", "lifetime must not be negative")
+		}
+	}
+
+	if radv.Preference != "" {
+		v.checkPreference(path+".preference", radv.Preference)
+	}
+
+	// Included files are radvd configuration, the built-in sender cannot use them
+	if len(radv.Include) > 0 && v.raSender == RASenderBuiltin {
+		v.errorf(path+".include", "include is only supported with ra-sender %s", RASenderRadvd)
+	}
+
+	switch radv.DHCPv6 {
+	case "", DHCPv6Stateful, DHCPv6Stateless, DHCPv6Off:
+		if radv.Dhcp && radv.DHCPv6 != "" {
+			v.errorf(path+".dhcp", "dhcp is deprecated and cannot be combined with dhcpv6, use dhcpv6: %s", DHCPv6Stateful)
+		}
+	default:
+		v.errorf(path+".dhcpv6", "unknown mode '%s' (expected %s, %s or %s)",
+			radv.DHCPv6, DHCPv6Stateful, DHCPv6Stateless, DHCPv6Off)
+	}
+
+	if radv.MTU != 0 && (radv.MTU < MinLinkMTU || radv.MTU > MaxLinkMTU) {
+		v.errorf(path+".mtu", "mtu %d out of range %d-%d", radv.MTU, MinLinkMTU, MaxLinkMTU)
+	}
+	if radv.ReachableTime < 0 || radv.ReachableTime > MaxReachableTime {
+		v.errorf(path+".reachable-time", "reachable time %d out of range 0-%d", radv.ReachableTime, MaxReachableTime)
+	}
+	if radv.RetransTimer < 0 {
+		v.errorf(path+".retrans-timer", "retrans timer must not be negative")
+	}
+	if radv.HopLimit != nil && (*radv.HopLimit < 0 || *radv.HopLimit > MaxHopLimit) {
+		v.errorf(path+".hop-limit", "hop limit %d out of range 0-%d", *radv.HopLimit, MaxHopLimit)
+	}
+	if radv.WithdrawPeriod != nil && *radv.WithdrawPeriod < 0 {
+		v.errorf(path+".withdraw-period", "withdraw period must not be negative")
+	}
+
+	for _, list := range []struct {
+		key       string
+		addresses []string
+	}{{"src-addr", radv.SrcAddr}, {"clients", radv.Clients}} {
+		for i, address := range list.addresses {
+			if addr, err := netip.ParseAddr(address); err != nil || !addr.Is6() || addr.Is4In6() {
+				v.errorf(fmt.Sprintf("%s.%s[%d]", path, list.key, i), "'%s' is not an IPv6 address", address)
+			}
+		}
+	}
+
+	for i, dnssl := range radv.DNSSL {
+		dnsslPath := fmt.Sprintf("%s.dnssl[%d]", path, i)
+
+		if len(dnssl.Domain) == 0 {
+			v.errorf(dnsslPath+".domain", "at least one domain is required")
+		}
+		for j, domain := range dnssl.Domain {
+			if !validDomain(domain) {
+				v.errorf(fmt.Sprintf("%s.domain[%d]", dnsslPath, j), "'%s' is not a valid domain name", domain)
+			}
+		}
+		if dnssl.Lifetime < 0 {
+			v.errorf(dnsslPath+".lifetime", "lifetime must not be negative")
+		}
+	}
+
+	if radv.Pref64 != nil {
+		prefix, err := netip.ParsePrefix(radv.Pref64.Prefix)
+		if err != nil || !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+			v.errorf(path+".pref64.prefix", "'%s' is not a valid IPv6 prefix", radv.Pref64.Prefix)
+		} else if !slices.Contains(Pref64Lengths, prefix.Bits()) {
+			v.errorf(path+".pref64.prefix", "PREF64 prefix length must be one of /32, /40, /48, /56, /64 or /96, got /%d", prefix.Bits())
+		}
+		if radv.Pref64.Lifetime < 0 || radv.Pref64.Lifetime > MaxPref64Lifetime {
+			v.errorf(path+".pref64.lifetime", "lifetime %d out of range 0-%d", radv.Pref64.Lifetime, MaxPref64Lifetime)
+		}
+	}
+}
+
+// validDomain checks a DNS search domain: dot separated labels of up to
+// 63 letters, digits and hyphens
+func validDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (v *validator) checkPreference(path string, value interface{}) {
+	s, ok := value.(string)
+	if ok {
+		for _, pref := range Preferences {
+			if s == pref {
+				return
+			}
+		}
+	}
+	v.errorf(path, "preference must be one of %s, got '%v'", strings.Join(Preferences, ", "), value)
+}
+
+func (v *validator) checkLifetime(path string, value interface{}) {
+	lifetime, ok := value.(int)
+	if !ok {
+		v.errorf(path, "lifetime must be a number of seconds, got '%v'", value)
+		return
+	}
+	if lifetime < 0 || lifetime > 0xffffffff {
+		v.errorf(path, "lifetime %d out of range 0-%d", lifetime, uint32(0xffffffff))
+	}
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
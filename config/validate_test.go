@@ -0,0 +1,329 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestValidate checks that problems are reported at the line and column
+// of the offending value. Every expected line is a prefix of the reported
+// error, so long key lists at the end of a message can be left out.
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want []string
+	}{
+		{
+			name: "unknown keys",
+			yaml: `
+network:
+  links:
+    eth0:
+      nat44:
+        enabled: true
+        masquerade: true
+  routes: []
+`,
+			want: []string{
+				"line 6, column 9: network.links.eth0.nat44.masquerade: unknown key 'masquerade' (expected one of: enabled, mss-clamping",
+				"line 7, column 3: network.routes: unknown key 'routes' (expected one of: backend, ra-sender, links, failover)",
+			},
+		},
+		{
+			name: "missing links",
+			yaml: `
+network:
+  backend: pf
+`,
+			want: []string{
+				"line 2, column 3: network.links: no links configured",
+				"line 2, column 12: network.backend: unknown backend 'pf' (expected auto, iptables or nftables)",
+			},
+		},
+		{
+			name: "wrong shapes",
+			yaml: `
+network:
+  links:
+    eth0:
+      nat66: true
+      port-forwards:
+        proto: tcp
+`,
+			want: []string{
+				"line 4, column 14: network.links.eth0.nat66: expected a mapping",
+				"line 6, column 9: network.links.eth0.port-forwards: expected a list",
+			},
+		},
+		{
+			name: "netmap6",
+			yaml: `
+network:
+  links:
+    eth0:
+      netmap6:
+        c1:
+          enabled: true
+          mode: npt
+          pfx-pub: "2001:db8:1::"
+          pfx-priv: "fd00::"
+          maps:
+          - pair: ["::25:0:0/96", "20:0:0/96"]
+          - pair: ["::25:0:1/96", "21:0:0/96"]
+          - pair: ["0:0:1::/48", "21:0:0/96"]
+          - pair: ["::26:0:0/96", "22:0:0/64"]
+          - pair: ["::27:0:0/96"]
+          - pair: ["::28:0:0/96", "23:0:0/96", highest, 3600]
+        c2:
+          enabled: true
+          pfx-pub: "2001:db8"
+          maps:
+          - pair: ["::25:0:0/96", 5]
+`,
+			want: []string{
+				"line 7, column 17: network.links.eth0.netmap6.c1.mode: unknown mode 'npt' (expected netmap or nptv6)",
+				"line 12, column 20: network.links.eth0.netmap6.c1.maps[1].pair[0]: '2001:db8:1::' + '::25:0:1/96' gives 2001:db8:1::25:0:1 which has bits set beyond /96",
+				"line 13, column 20: network.links.eth0.netmap6.c1.maps[2].pair[0]: fragment '0:0:1::/48' overlaps prefix '2001:db8:1::'",
+				"line 14, column 35: network.links.eth0.netmap6.c1.maps[3].pair[1]: 'fd00::' + '22:0:0/64' gives fd00::22:0:0 which has bits set beyond /64",
+				"line 15, column 19: network.links.eth0.netmap6.c1.maps[4].pair: expected [public, private] or [public, private, preference, lifetime], got 1 values",
+				"line 16, column 48: network.links.eth0.netmap6.c1.maps[5].pair[2]: preference must be one of high, medium, low, got 'highest'",
+				"line 19, column 20: network.links.eth0.netmap6.c2.pfx-pub: prefix '2001:db8' is not an IPv6 address",
+				"line 21, column 35: network.links.eth0.netmap6.c2.maps[0].pair[1]: private side must be an IPv6 address fragment",
+			},
+		},
+		{
+			name: "nptv6 with nftables",
+			yaml: `
+network:
+  backend: nftables
+  links:
+    eth0:
+      netmap6:
+        c1:
+          enabled: true
+          mode: nptv6
+          pfx-pub: "2001:db8:1::"
+          pfx-priv: "fd00::"
+          maps:
+          - pair: ["::/64", "::/64"]
+`,
+			want: []string{
+				"line 8, column 17: network.links.eth0.netmap6.c1.mode: nptv6 needs the iptables backend",
+			},
+		},
+		{
+			name: "nat",
+			yaml: `
+network:
+  links:
+    eth0:
+      nat44:
+        enabled: true
+        mss-clamping: true
+        snat-to: "2001:db8::5"
+        origins:
+        - "10.0.0.0/33"
+        - source: "10.1.0.0/16"
+          persistent: true
+      nat66:
+        enabled: true
+        mss: 1000
+        exclude: ["10.0.0.0/8"]
+      port-forwards:
+      - proto: sctp
+        port: "70000"
+        to: "10.0.0.5:8443"
+`,
+			want: []string{
+				"line 6, column 23: network.links.eth0.nat44.mss-clamping: mss-clamping requires mss",
+				"line 7, column 18: network.links.eth0.nat44.snat-to: '2001:db8::5' is not of the address family of the NAT section",
+				"line 9, column 11: network.links.eth0.nat44.origins[0]: '10.0.0.0/33' is not a valid IPv4 prefix",
+				"line 11, column 23: network.links.eth0.nat44.origins[1].persistent: persistent requires snat-to",
+				"line 14, column 14: network.links.eth0.nat66.mss: mss 1000 out of range 1220-65535",
+				"line 15, column 19: network.links.eth0.nat66.exclude[0]: '10.0.0.0/8' is not an IPv6 prefix",
+				"line 17, column 16: network.links.eth0.port-forwards[0].proto: unknown protocol 'sctp' (expected tcp or udp)",
+				"line 18, column 15: network.links.eth0.port-forwards[0].port: '70000' is not a valid port or port range",
+			},
+		},
+		{
+			name: "routing",
+			yaml: `
+network:
+  links:
+    eth0:
+      nat44:
+        enabled: true
+        origins:
+        - source: "10.0.1.0/24"
+          gateway: "203.0.113.1"
+        - source: "10.0.2.0/24"
+          table: 254
+        - source: "10.0.3.0/24"
+          table: 100
+          gateway: "203.0.113.1"
+    eth1:
+      nat44:
+        enabled: true
+        origins:
+        - source: "10.0.4.0/24"
+          table: 100
+          gateway: "198.51.100.1"
+        - source: "10.0.5.0/24"
+          table: 101
+          gateway: "2001:db8::1"
+`,
+			want: []string{
+				"line 8, column 20: network.links.eth0.nat44.origins[0].gateway: gateway requires table",
+				"line 10, column 18: network.links.eth0.nat44.origins[1].table: table 254 is reserved or out of range 1-4294967295",
+				"line 19, column 18: network.links.eth1.nat44.origins[0].table: ipv4 table 100 already routes dev eth0 via 203.0.113.1, not dev eth1 via 198.51.100.1",
+				"line 23, column 20: network.links.eth1.nat44.origins[1].gateway: '2001:db8::1' is not an address of the family of the NAT section",
+			},
+		},
+		{
+			name: "failover",
+			yaml: `
+network:
+  links:
+    eth0: {}
+    eth1: {}
+  failover:
+    wan:
+      members:
+      - link: eth0
+        gateway: "2001:db8::1"
+      - link: eth2
+        table: 201
+      checks:
+      - icmp: "192.0.2.53"
+        tcp: "192.0.2.80:443"
+      - tcp: "192.0.2.80"
+      hold-down: -1
+    backup:
+      members:
+      - link: eth0
+      checks: []
+`,
+			want: []string{
+				"line 8, column 15: network.failover.wan.members[0].link: link 'eth0' is already a member of failover group backup",
+				"line 9, column 18: network.failover.wan.members[0].gateway: '2001:db8::1' is not a valid IPv4 address",
+				"line 10, column 15: network.failover.wan.members[1].link: link 'eth2' is not configured",
+				"line 11, column 16: network.failover.wan.members[1].table: table requires gateway or gateway6",
+				"line 13, column 9: network.failover.wan.checks[0]: set exactly one of icmp and tcp",
+				"line 15, column 14: network.failover.wan.checks[1].tcp: '192.0.2.80' is not a valid address:port",
+				"line 16, column 18: network.failover.wan.hold-down: hold-down must not be negative",
+				"line 19, column 7: network.failover.backup.members: a failover group needs at least two members",
+				"line 20, column 15: network.failover.backup.checks: a failover group needs at least one health check",
+			},
+		},
+		{
+			name: "radv",
+			yaml: `
+network:
+  ra-sender: builtin
+  links:
+    eth0:
+      radv:
+        enabled: true
+        adv-interval: [2, 10]
+        lifetime: 10000
+        dhcpv6: always
+        prefixes:
+        - prefix: "2001:db8:1:1::/64"
+          lifetime: [900, 1800]
+        - prefix: "10.0.0.0/24"
+        routes:
+        - route: ["2001:db8::/48", urgent]
+        - route: ["2001:db8::/48"]
+        dnssl:
+        - domain: ["example.com", "-bad.example"]
+        pref64:
+          prefix: "64:ff9b::/80"
+        include: ["/etc/radvd.d/extra.conf"]
+`,
+			want: []string{
+				"line 7, column 24: network.links.eth0.radv.adv-interval[0]: min interval 2 out of range 3-7 (0.75 * max)",
+				"line 8, column 19: network.links.eth0.radv.lifetime: lifetime 10000 out of range 0-9000",
+				"line 9, column 17: network.links.eth0.radv.dhcpv6: unknown mode 'always' (expected stateful, stateless or off)",
+				"line 12, column 21: network.links.eth0.radv.prefixes[0].lifetime: preferred lifetime 1800 exceeds valid lifetime 900",
+				"line 13, column 19: network.links.eth0.radv.prefixes[1].prefix: '10.0.0.0/24' is not an IPv6 prefix",
+				"line 15, column 36: network.links.eth0.radv.routes[0].route[1]: preference must be one of high, medium, low, got 'urgent'",
+				"line 16, column 18: network.links.eth0.radv.routes[1].route: expected [prefix, preference] or [prefix, preference, lifetime], got 1 values",
+				"line 18, column 35: network.links.eth0.radv.dnssl[0].domain[1]: '-bad.example' is not a valid domain name",
+				"line 20, column 19: network.links.eth0.radv.pref64.prefix: PREF64 prefix length must be one of /32, /40, /48, /56, /64 or /96, got /80",
+				"line 21, column 18: network.links.eth0.radv.include: include is only supported with ra-sender radvd",
+			},
+		},
+		{
+			name: "nat64",
+			yaml: `
+network:
+  links:
+    eth0:
+      nat64:
+        enabled: true
+        prefix: "64:ff9b::/64"
+        dns64: powerdns
+    eth1:
+      nat64:
+        enabled: true
+        prefix: "64:ff9b:1::/96"
+        translator: tayga
+        pool4: "192.0.2.0/33"
+        pref64-lifetime: 70000
+`,
+			want: []string{
+				"line 6, column 17: network.links.eth0.nat64.prefix: NAT64 prefix 64:ff9b::/64 must be a /96",
+				"line 7, column 16: network.links.eth0.nat64.dns64: unknown resolver 'powerdns' (expected bind or unbound)",
+				"line 11, column 17: network.links.eth1.nat64.prefix: prefix '64:ff9b:1::/96' differs from '64:ff9b::/64' of link eth0, all links share one translator",
+				"line 12, column 21: network.links.eth1.nat64.translator: translator 'tayga' differs from 'jool' of link eth0, all links share one translator",
+				"line 13, column 16: network.links.eth1.nat64.pool4: '192.0.2.0/33' is not a valid IPv4 prefix",
+				"line 13, column 16: network.links.eth1.nat64.pool4: pool4 '192.0.2.0/33' differs from '' of link eth0, all links share one translator",
+				"line 14, column 26: network.links.eth1.nat64.pref64-lifetime: lifetime 70000 out of range 0-65528",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Validate([]byte(strings.TrimPrefix(tt.yaml, "\n")))
+
+			var errs ValidationErrors
+			if !errors.As(err, &errs) {
+				t.Fatalf("expected validation errors, got %v", err)
+			}
+
+			var got []string
+			for _, e := range errs {
+				got = append(got, e.Error())
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d errors, want %d:\n%s", len(got), len(tt.want), strings.Join(got, "\n"))
+			}
+			for i, want := range tt.want {
+				if !strings.HasPrefix(got[i], want) {
+					t.Errorf("error %d:\n got  %s\n want %s", i, got[i], want)
+				}
+			}
+		})
+	}
+}
+
+// TestValidateShippedConfig makes sure the example config in the
+// repository stays valid
+func TestValidateShippedConfig(t *testing.T) {
+	data, err := os.ReadFile("../config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Validate(data)
+	if err != nil {
+		t.Fatalf("config.yaml does not validate:\n%v", err)
+	}
+	if _, ok := cfg.Network.Links["pub1a"]; !ok {
+		t.Errorf("config.yaml lost its pub1a link")
+	}
+}
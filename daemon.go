@@ -0,0 +1,527 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"natman/config"
+	"natman/link"
+	"natman/link/failover"
+	"natman/worker/backend"
+	configwatcher "natman/worker/config-watcher"
+	failovermanager "natman/worker/failover-manager"
+	linkmonitor "natman/worker/link-monitor"
+	natmanager "natman/worker/nat-manager"
+	nat64manager "natman/worker/nat64-manager"
+	nftmanager "natman/worker/nft-manager"
+	rasender "natman/worker/ra-sender"
+	radvdmanager "natman/worker/radvd-manager"
+	routemanager "natman/worker/route-manager"
+)
+
+// Default time between two drift checks in daemon mode
+const defaultReconcileInterval = 60 * time.Second
+
+// Interfaces report several link and address events when they come up,
+// a link is re-applied once no further event arrived for this long
+const linkSettleDelay = time.Second
+
+// daemon keeps the system converged on the configuration until it is stopped
+type daemon struct {
+	configPath string
+	interval   time.Duration
+	quiet      bool
+
+	cfg      *config.Config
+	links    map[string]*link.Link
+	fw       backend.Backend
+	groups   []*failover.Group
+	failover *failovermanager.Monitor
+	ra       *rasender.Engine
+	warned   map[string]bool // config warnings already reported
+}
+
+// runDaemon applies the configuration and then periodically compares the
+// live rules and radvd.conf with it, correcting and logging any drift.
+// With ra-sender builtin the daemon sends the router advertisements itself.
+// The configuration is reloaded on SIGHUP and whenever the file changes,
+// configured links are re-applied when their interface appears, comes up
+// or changes addresses.
+func runDaemon(configPath string, interval time.Duration, quiet bool) error {
+	d := &daemon{
+		configPath: configPath,
+		interval:   interval,
+		quiet:      quiet,
+	}
+
+	cfg, links, fw, err := d.load()
+	if err != nil {
+		return err
+	}
+	d.cfg, d.links, d.fw = cfg, links, fw
+	d.groups = failover.BuildGroups(cfg)
+
+	// The monitor runs without groups too, a reload may add some
+	d.failover = failovermanager.NewMonitor(d.groups, failovermanager.SocketProber{})
+	d.failover.Start()
+	defer d.failover.Close()
+
+	// One-shot runs follow the saved state while the daemon runs
+	d.saveFailoverState()
+	defer os.Remove(failovermanager.StatePath)
+
+	// Senders start with the first pass, stopping them withdraws the router
+	d.ra = rasender.NewEngine()
+	defer d.ra.Close()
+	if d.builtinRA() {
+		warnRadvdRunning()
+	}
+
+	// The managers list the live rules on every pass, keep the journal readable
+	natmanager.SetQuietMode(true)
+	nftmanager.SetQuietMode(true)
+
+	fmt.Printf("natman daemon started with config %s (%s backend, checking every %s)\n",
+		configPath, d.fw.Name(), interval)
+
+	// The first pass applies the whole configuration
+	d.reconcile()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	return d.run(signals)
+}
+
+// run handles events until a stop signal arrives. The config watcher and
+// the interface monitor are resubscribed with backoff when they fail,
+// without them the configuration can still be reloaded with SIGHUP and
+// link changes are picked up by the periodic check.
+func (d *daemon) run(signals <-chan os.Signal) error {
+	configChanges := &source[struct{}]{
+		name: "config watcher",
+		subscribe: func() (<-chan struct{}, io.Closer, error) {
+			return watchConfig(d.configPath)
+		},
+	}
+	configChanges.open()
+	defer configChanges.close()
+
+	linkEvents := &source[linkmonitor.Event]{name: "interface monitor", subscribe: subscribeLinks}
+	linkEvents.open()
+	defer linkEvents.close()
+
+	pending := make(map[string]bool)
+	var settle <-chan time.Time
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.reconcile()
+		case event, ok := <-linkEvents.events:
+			if !ok {
+				linkEvents.lost()
+				continue
+			}
+			linkEvents.received()
+			if _, ok := d.links[event.Link]; !ok {
+				DebugPrint("Ignoring event for unconfigured interface %s", event.Link)
+				continue
+			}
+			fmt.Printf("Interface %s %s\n", event.Link, event.Kind)
+			pending[event.Link] = true
+			settle = time.After(linkSettleDelay)
+		case <-linkEvents.retry:
+			// Events missed in the meantime are picked up by the periodic check
+			linkEvents.open()
+		case <-settle:
+			settle = nil
+			d.reapplyLinks(pending)
+			pending = make(map[string]bool)
+		case event := <-d.failover.Events:
+			fmt.Println(event)
+			d.switchUplinks()
+		case _, ok := <-configChanges.events:
+			if !ok {
+				configChanges.lost()
+				continue
+			}
+			configChanges.received()
+			fmt.Printf("%s changed, reloading configuration\n", d.configPath)
+			d.reload()
+		case <-configChanges.retry:
+			// The file may have changed while it was not watched
+			if configChanges.open() {
+				d.reload()
+			}
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				fmt.Println("Received SIGHUP, reloading configuration")
+				d.reload()
+				continue
+			}
+			fmt.Printf("Received %s, stopping natman daemon\n", sig)
+			return nil
+		}
+	}
+}
+
+// Event sources of the daemon loop, replaced in tests
+var (
+	watchConfig = func(path string) (<-chan struct{}, io.Closer, error) {
+		watcher, err := configwatcher.Watch(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return watcher.Changes, watcher, nil
+	}
+	subscribeLinks = func() (<-chan linkmonitor.Event, io.Closer, error) {
+		monitor, err := linkmonitor.Subscribe()
+		if err != nil {
+			return nil, nil, err
+		}
+		return monitor.Events, monitor, nil
+	}
+)
+
+// newBackend selects the firewall backend of a configuration, replaced in tests
+var newBackend = backend.New
+
+// A failed event source is resubscribed after resubscribeDelay, doubling
+// with every further failure up to maxResubscribeDelay
+var (
+	resubscribeDelay    = time.Second
+	maxResubscribeDelay = time.Minute
+)
+
+// source is an event source of the daemon loop. Its channel closes when
+// the source fails, events is then nil until retry fires and it is
+// subscribed again.
+type source[T any] struct {
+	name      string
+	subscribe func() (<-chan T, io.Closer, error)
+
+	events <-chan T
+	closer io.Closer
+	retry  <-chan time.Time
+	delay  time.Duration
+}
+
+// open subscribes to the source, scheduling a retry when that fails
+func (s *source[T]) open() bool {
+	events, closer, err := s.subscribe()
+	if err != nil {
+		s.backoff()
+		fmt.Printf("Warning: failed to start %s, retrying in %s: %v\n", s.name, s.delay, err)
+		return false
+	}
+	s.events, s.closer, s.retry = events, closer, nil
+	return true
+}
+
+// received resets the backoff once the source delivers again
+func (s *source[T]) received() {
+	s.delay = 0
+}
+
+// lost drops the closed channel of a failed source and schedules a retry
+func (s *source[T]) lost() {
+	s.close()
+	s.backoff()
+	fmt.Printf("Warning: %s stopped, resubscribing in %s\n", s.name, s.delay)
+}
+
+func (s *source[T]) backoff() {
+	s.delay = min(max(2*s.delay, resubscribeDelay), maxResubscribeDelay)
+	s.retry = time.After(s.delay)
+}
+
+func (s *source[T]) close() {
+	if s.closer != nil {
+		s.closer.Close()
+	}
+	s.events, s.closer = nil, nil
+}
+
+// load parses and validates the configuration and builds the link model
+// and backend for it, without touching the running state
+func (d *daemon) load() (*config.Config, map[string]*link.Link, backend.Backend, error) {
+	// Check if config file exists
+	if _, err := os.Stat(d.configPath); os.IsNotExist(err) {
+		return nil, nil, nil, fmt.Errorf("config file not found: %s", d.configPath)
+	}
+
+	cfg, err := config.LoadConfig(d.configPath)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid config %s:\n%v", d.configPath, err)
+	}
+
+	if len(cfg.Network.Links) == 0 {
+		return nil, nil, nil, fmt.Errorf("no links configured in config file")
+	}
+
+	links, err := link.BuildLinks(cfg)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid link configuration:\n%v", err)
+	}
+	d.warn(links)
+	if len(links) == 0 {
+		return nil, nil, nil, fmt.Errorf("no valid links found after building link models")
+	}
+
+	fw, err := newBackend(cfg.Network.Backend, links)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to select backend: %v", err)
+	}
+
+	return cfg, links, fw, nil
+}
+
+// warn reports the config warnings of links once, a reload only reports
+// the ones that are new
+func (d *daemon) warn(links map[string]*link.Link) {
+	if d.warned == nil {
+		d.warned = make(map[string]bool)
+	}
+	for _, warning := range link.Warnings(links) {
+		if !d.warned[warning] {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+			d.warned[warning] = true
+		}
+	}
+}
+
+// reload swaps in the configuration from disk and converges on it.
+// An invalid configuration is rejected and the running state is kept.
+func (d *daemon) reload() {
+	cfg, links, fw, err := d.load()
+	if err != nil {
+		fmt.Printf("Rejected new configuration, keeping running state: %v\n", err)
+		return
+	}
+
+	changed := changedLinks(d.cfg, cfg)
+	failoverChanged := !reflect.DeepEqual(d.cfg.Network.Failover, cfg.Network.Failover)
+	raSenderChanged := cfg.Network.RASender != d.cfg.Network.RASender
+	if len(changed) == 0 && !failoverChanged && !raSenderChanged && cfg.Network.Backend == d.cfg.Network.Backend {
+		fmt.Println("Configuration unchanged")
+		return
+	}
+	if len(changed) > 0 {
+		fmt.Printf("Configuration changed for links: %s\n", strings.Join(changed, ", "))
+	}
+	if failoverChanged {
+		fmt.Println("Failover groups changed")
+	}
+	// The old backend's rules would stay active next to the new ones
+	if fw.Name() != d.fw.Name() {
+		fmt.Printf("Switching from %s to %s backend\n", d.fw.Name(), fw.Name())
+		if err := d.fw.Flush(); err != nil {
+			fmt.Printf("Rejected new configuration, keeping running state: failed to remove the %s rules: %v\n",
+				d.fw.Name(), err)
+			return
+		}
+	}
+
+	d.cfg, d.links, d.fw = cfg, links, fw
+	d.groups = failover.BuildGroups(cfg)
+	d.failover.SetGroups(d.groups)
+	d.saveFailoverState()
+
+	if raSenderChanged && d.builtinRA() {
+		fmt.Println("Switching to the built-in router advertisement sender")
+		warnRadvdRunning()
+	} else if raSenderChanged {
+		fmt.Println("Switching to radvd for router advertisements")
+	}
+
+	// Only the rules that differ from the new model are touched
+	d.reconcile()
+}
+
+// changedLinks lists the links that were added, removed or modified
+func changedLinks(old, new *config.Config) []string {
+	var changed []string
+
+	for name, linkCfg := range new.Network.Links {
+		if oldCfg, ok := old.Network.Links[name]; !ok || !reflect.DeepEqual(oldCfg, linkCfg) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range old.Network.Links {
+		if _, ok := new.Network.Links[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+
+	sort.Strings(changed)
+	return changed
+}
+
+// effective returns the link model with the active failover members
+func (d *daemon) effective() map[string]*link.Link {
+	return failovermanager.Effective(d.links, d.groups, d.failover.State())
+}
+
+// switchUplinks moves default routes and origins after a failover event
+func (d *daemon) switchUplinks() {
+	d.saveFailoverState()
+	links := d.effective()
+
+	if err := d.fw.Apply(links); err != nil {
+		fmt.Printf("Error applying rules after failover: %v\n", err)
+	}
+	if err := routemanager.ApplyRoutes(links); err != nil {
+		fmt.Printf("Error applying policy routing after failover: %v\n", err)
+	}
+}
+
+// saveFailoverState lets one-shot runs keep the active failover members
+func (d *daemon) saveFailoverState() {
+	if err := d.failover.State().Save(failovermanager.StatePath); err != nil {
+		fmt.Printf("Warning: failed to save failover state: %v\n", err)
+	}
+}
+
+// reapplyLinks converges the rules of the given links only
+func (d *daemon) reapplyLinks(pending map[string]bool) {
+	links := d.effective()
+
+	var names []string
+	for name := range pending {
+		// The link may have been removed by a reload in the meantime
+		if _, ok := links[name]; ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+
+	if err := d.fw.ApplyLinks(links, names); err != nil {
+		fmt.Printf("Error re-applying links %s: %v\n", strings.Join(names, ", "), err)
+		return
+	}
+	fmt.Printf("Re-applied rules for links: %s\n", strings.Join(names, ", "))
+
+	// The kernel drops the routes of a link that went down
+	if err := routemanager.ApplyRoutes(links); err != nil {
+		fmt.Printf("Error re-applying policy routing: %v\n", err)
+	}
+
+	if d.builtinRA() {
+		d.ra.Update(links)
+		d.ra.Advertise(names)
+		return
+	}
+	radvd := radvdmanager.PlanRadvdConfig(links)
+	if radvd.Changed {
+		if err := radvdmanager.CreateRadvdConfig(links); err != nil {
+			fmt.Printf("Error updating radvd config: %v\n", err)
+		}
+	}
+}
+
+// reconcile re-reads the live state and re-applies whatever drifted.
+// Errors are logged and retried on the next pass.
+func (d *daemon) reconcile() {
+	DebugPrint("Checking for drift")
+	links := d.effective()
+
+	plan, err := d.fw.Plan(links)
+	if err != nil {
+		fmt.Printf("Error reading current rules: %v\n", err)
+	} else if plan.Changed() {
+		fmt.Printf("Drift detected in %s rules: %d to remove, %d to add\n",
+			plan.Backend, len(plan.Remove), len(plan.Add))
+		for _, rule := range plan.Remove {
+			fmt.Printf("  - %s\n", rule)
+		}
+		for _, rule := range plan.Add {
+			fmt.Printf("  + %s\n", rule)
+		}
+
+		if err := d.fw.Apply(links); err != nil {
+			fmt.Printf("Error correcting rule drift: %v\n", err)
+		} else {
+			fmt.Println("Rule drift corrected")
+		}
+	}
+
+	add, remove, err := routemanager.PlanRoutes(links)
+	if err != nil {
+		fmt.Printf("Error reading policy routing: %v\n", err)
+	} else if len(add) > 0 || len(remove) > 0 {
+		fmt.Printf("Drift detected in policy routing: %d to remove, %d to add\n", len(remove), len(add))
+		for _, command := range remove {
+			fmt.Printf("  - %s\n", command)
+		}
+		for _, command := range add {
+			fmt.Printf("  + %s\n", command)
+		}
+
+		if err := routemanager.ApplyRoutes(links); err != nil {
+			fmt.Printf("Error correcting policy routing drift: %v\n", err)
+		} else {
+			fmt.Println("Policy routing drift corrected")
+		}
+	}
+
+	for _, file := range nat64manager.PlanNat64Config(links) {
+		if file.Changed {
+			fmt.Printf("Drift detected in %s\n", file.Path)
+			if err := nat64manager.ApplyNat64Config(links); err != nil {
+				fmt.Printf("Error correcting NAT64 drift: %v\n", err)
+			} else {
+				fmt.Println("NAT64 drift corrected")
+			}
+			break
+		}
+	}
+
+	// The senders pick up changed radv sections with their next advertisement
+	if d.builtinRA() {
+		d.ra.Update(links)
+		return
+	}
+	d.ra.Update(nil)
+
+	radvd := radvdmanager.PlanRadvdConfig(links)
+	if radvd.Changed {
+		fmt.Printf("Drift detected in %s\n", radvd.Path)
+		if !d.quiet {
+			fmt.Print(radvd.Diff)
+		}
+
+		if err := radvdmanager.CreateRadvdConfig(links); err != nil {
+			fmt.Printf("Error correcting radvd drift: %v\n", err)
+		} else {
+			fmt.Println("Radvd drift corrected")
+		}
+	}
+}
+
+// builtinRA tells whether the daemon sends the router advertisements itself
+func (d *daemon) builtinRA() bool {
+	return d.cfg.Network.RASender == config.RASenderBuiltin
+}
+
+// warnRadvdRunning points out a radvd that would advertise next to the
+// built-in sender
+func warnRadvdRunning() {
+	if active, err := radvdmanager.GetRadvdStatus(); err == nil && active {
+		fmt.Println("Warning: radvd is running next to the built-in router advertisement sender, stop it to avoid conflicting advertisements")
+	}
+}
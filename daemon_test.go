@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"natman/config"
+	"natman/link"
+	"natman/worker/backend"
+	failovermanager "natman/worker/failover-manager"
+	linkmonitor "natman/worker/link-monitor"
+	rasender "natman/worker/ra-sender"
+)
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// expectSubscription waits for the daemon to subscribe to a fake source
+func expectSubscription[T any](t *testing.T, name string, subscriptions <-chan chan T) chan T {
+	t.Helper()
+
+	select {
+	case ch := <-subscriptions:
+		return ch
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s was not subscribed", name)
+		return nil
+	}
+}
+
+func TestRunResubscribesClosedSources(t *testing.T) {
+	savedDelay, savedMax := resubscribeDelay, maxResubscribeDelay
+	savedWatch, savedSubscribe := watchConfig, subscribeLinks
+	defer func() {
+		resubscribeDelay, maxResubscribeDelay = savedDelay, savedMax
+		watchConfig, subscribeLinks = savedWatch, savedSubscribe
+	}()
+	resubscribeDelay, maxResubscribeDelay = 10*time.Millisecond, 40*time.Millisecond
+
+	configSubscriptions := make(chan chan struct{}, 8)
+	watchConfig = func(string) (<-chan struct{}, io.Closer, error) {
+		ch := make(chan struct{})
+		configSubscriptions <- ch
+		return ch, nopCloser{}, nil
+	}
+
+	// The interface monitor fails to start once
+	linkSubscriptions := make(chan chan linkmonitor.Event, 8)
+	failed := false
+	subscribeLinks = func() (<-chan linkmonitor.Event, io.Closer, error) {
+		if !failed {
+			failed = true
+			return nil, nil, errors.New("netlink unavailable")
+		}
+		ch := make(chan linkmonitor.Event)
+		linkSubscriptions <- ch
+		return ch, nopCloser{}, nil
+	}
+
+	d := &daemon{
+		configPath: filepath.Join(t.TempDir(), "missing.yaml"),
+		interval:   time.Hour,
+		cfg:        &config.Config{},
+		links:      map[string]*link.Link{},
+		failover:   failovermanager.NewMonitor(nil, nil),
+	}
+
+	signals := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- d.run(signals) }()
+
+	close(expectSubscription(t, "config watcher", configSubscriptions))
+	close(expectSubscription(t, "interface monitor", linkSubscriptions))
+
+	// Closed channels are dropped and subscribed again, not spun on
+	expectSubscription(t, "config watcher", configSubscriptions)
+	expectSubscription(t, "interface monitor", linkSubscriptions)
+
+	time.Sleep(100 * time.Millisecond)
+	if len(configSubscriptions) > 0 || len(linkSubscriptions) > 0 {
+		t.Errorf("working sources were subscribed again")
+	}
+
+	signals <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("daemon did not stop")
+	}
+}
+
+// fakeBackend records the calls of the daemon instead of touching rules
+type fakeBackend struct {
+	name     string
+	drift    bool
+	flushErr error
+	calls    *[]string
+}
+
+func (f *fakeBackend) Name() string { return f.name }
+
+func (f *fakeBackend) Apply(links map[string]*link.Link) error {
+	*f.calls = append(*f.calls, f.name+" apply")
+	return nil
+}
+
+func (f *fakeBackend) ApplyLinks(links map[string]*link.Link, names []string) error {
+	*f.calls = append(*f.calls, f.name+" apply "+strings.Join(names, ","))
+	return nil
+}
+
+func (f *fakeBackend) Plan(links map[string]*link.Link) (*backend.Plan, error) {
+	plan := &backend.Plan{Backend: f.name}
+	if f.drift {
+		plan.Add = []string{"rule"}
+	}
+	return plan, nil
+}
+
+func (f *fakeBackend) Flush() error {
+	*f.calls = append(*f.calls, f.name+" flush")
+	return f.flushErr
+}
+
+const testConfig = `network:
+  backend: %s
+  ra-sender: builtin
+  links:
+    eth0:
+      nat44:
+        enabled: true
+        mss: %d
+`
+
+// newTestDaemon loads the config with fake backends. Policy routing runs
+// against an ip without rules and the failover state goes to a temp dir.
+func newTestDaemon(t *testing.T, content string, backends map[string]*fakeBackend) *daemon {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ip"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	savedBackend, savedState := newBackend, failovermanager.StatePath
+	t.Cleanup(func() { newBackend, failovermanager.StatePath = savedBackend, savedState })
+	newBackend = func(name string, links map[string]*link.Link) (backend.Backend, error) {
+		fw, ok := backends[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown backend '%s'", name)
+		}
+		return fw, nil
+	}
+	failovermanager.StatePath = filepath.Join(dir, "failover.json")
+
+	d := &daemon{configPath: filepath.Join(dir, "natman.yaml"), interval: time.Hour, quiet: true}
+	if err := os.WriteFile(d.configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, links, fw, err := d.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.cfg, d.links, d.fw = cfg, links, fw
+	d.failover = failovermanager.NewMonitor(nil, nil)
+	d.ra = rasender.NewEngine()
+	t.Cleanup(d.ra.Close)
+	return d
+}
+
+func TestReload(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		flushErr  error
+		wantCalls []string
+		wantFw    string
+		wantMss   int
+	}{
+		{
+			name:    "unchanged",
+			config:  fmt.Sprintf(testConfig, "iptables", 1440),
+			wantFw:  "iptables",
+			wantMss: 1440,
+		},
+		{
+			name:      "link changed",
+			config:    fmt.Sprintf(testConfig, "iptables", 1400),
+			wantCalls: []string{"iptables apply"},
+			wantFw:    "iptables",
+			wantMss:   1400,
+		},
+		{
+			name:      "backend switch",
+			config:    fmt.Sprintf(testConfig, "nftables", 1440),
+			wantCalls: []string{"iptables flush", "nftables apply"},
+			wantFw:    "nftables",
+			wantMss:   1440,
+		},
+		{
+			name:      "backend switch with failed flush",
+			config:    fmt.Sprintf(testConfig, "nftables", 1400),
+			flushErr:  errors.New("iptables-restore failed"),
+			wantCalls: []string{"iptables flush"},
+			wantFw:    "iptables",
+			wantMss:   1440,
+		},
+		{
+			name:    "invalid config",
+			config:  "network:\n  links: {}\n",
+			wantFw:  "iptables",
+			wantMss: 1440,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			backends := map[string]*fakeBackend{
+				"iptables": {name: "iptables", flushErr: tt.flushErr, calls: &calls},
+				"nftables": {name: "nftables", calls: &calls},
+			}
+			d := newTestDaemon(t, fmt.Sprintf(testConfig, "iptables", 1440), backends)
+
+			// The new model differs from the live rules of the running backend
+			backends["iptables"].drift = true
+			backends["nftables"].drift = true
+			if err := os.WriteFile(d.configPath, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			d.reload()
+
+			if !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("backend calls = %v, want %v", calls, tt.wantCalls)
+			}
+			if d.fw.Name() != tt.wantFw {
+				t.Errorf("backend = %s, want %s", d.fw.Name(), tt.wantFw)
+			}
+			if mss := d.links["eth0"].Nat44.Mss; mss != tt.wantMss {
+				t.Errorf("running mss = %d, want %d", mss, tt.wantMss)
+			}
+		})
+	}
+}
+
+func TestReconcileCorrectsDrift(t *testing.T) {
+	for _, drift := range []bool{false, true} {
+		var calls []string
+		backends := map[string]*fakeBackend{"iptables": {name: "iptables", drift: drift, calls: &calls}}
+		d := newTestDaemon(t, fmt.Sprintf(testConfig, "iptables", 1440), backends)
+
+		d.reconcile()
+
+		if applied := len(calls) > 0; applied != drift {
+			t.Errorf("drift %v: backend calls = %v", drift, calls)
+		}
+	}
+}
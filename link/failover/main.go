@@ -0,0 +1,112 @@
+package failover
+
+import (
+	"sort"
+	"time"
+
+	"natman/config"
+)
+
+// Group is a set of uplinks in priority order. The first healthy member
+// is active: it carries the default route and the origins of the members
+// that are down.
+type Group struct {
+	Name     string
+	Members  []Member
+	Checks   []Check
+	Interval time.Duration
+	Timeout  time.Duration
+	Failures int
+	HoldDown time.Duration
+}
+
+type Member struct {
+	Link     string
+	Gateway  string
+	Gateway6 string
+	Table    int // routing table of the health checks, 0 to use the system routes
+}
+
+// Check is one probe target of a group
+type Check struct {
+	Proto  string // icmp or tcp
+	Target string // address, or address:port for tcp
+}
+
+func (c Check) String() string {
+	return c.Proto + " " + c.Target
+}
+
+// Primary returns the link that is active while every member is healthy
+func (g *Group) Primary() string {
+	return g.Members[0].Link
+}
+
+// Member returns the member of the given link
+func (g *Group) Member(linkName string) (Member, bool) {
+	for _, member := range g.Members {
+		if member.Link == linkName {
+			return member, true
+		}
+	}
+	return Member{}, false
+}
+
+func NewGroup(name string, cfg config.FailoverConfig) *Group {
+	group := &Group{
+		Name:     name,
+		Interval: seconds(cfg.Interval, config.DefaultFailoverInterval),
+		Timeout:  seconds(cfg.Timeout, config.DefaultFailoverTimeout),
+		Failures: cfg.Failures,
+		HoldDown: seconds(cfg.HoldDown, config.DefaultFailoverHoldDown),
+	}
+	if group.Failures == 0 {
+		group.Failures = config.DefaultFailoverFailures
+	}
+
+	for _, member := range cfg.Members {
+		group.Members = append(group.Members, Member{
+			Link:     member.Link,
+			Gateway:  member.Gateway,
+			Gateway6: member.Gateway6,
+			Table:    member.Table,
+		})
+	}
+
+	for _, check := range cfg.Checks {
+		if check.ICMP != "" {
+			group.Checks = append(group.Checks, Check{Proto: "icmp", Target: check.ICMP})
+		} else if check.TCP != "" {
+			group.Checks = append(group.Checks, Check{Proto: "tcp", Target: check.TCP})
+		}
+	}
+
+	return group
+}
+
+func seconds(value, fallback int) time.Duration {
+	if value == 0 {
+		value = fallback
+	}
+	return time.Duration(value) * time.Second
+}
+
+// BuildGroups builds the failover groups of the config sorted by name,
+// groups with fewer than two members are skipped
+func BuildGroups(cfg *config.Config) []*Group {
+	var names []string
+	for name := range cfg.Network.Failover {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var groups []*Group
+	for _, name := range names {
+		group := NewGroup(name, cfg.Network.Failover[name])
+		if len(group.Members) < 2 {
+			continue
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
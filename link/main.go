@@ -1,6 +1,12 @@
 package link
 
 import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"time"
+
 	"natman/config"
 	"natman/link/netmap6"
 	"natman/link/radv"
@@ -14,23 +20,229 @@ type Link struct {
 	Nat66   *Nat66
 	Nat44   *Nat44
 	Radv    *radv.RadvConfig
+
+	PortForwards []*PortForward
+	Nat64        *Nat64
+	Uplink       *Uplink // set while the link is a member of a failover group
+}
+
+// Nat64 is the NAT64 translation offered to the link's clients
+type Nat64 struct {
+	Enabled        bool
+	Prefix         netip.Prefix
+	Translator     string
+	Pool4          netip.Prefix // invalid with jool when the host addresses are used
+	Pref64Lifetime int          // 0 leaves the PREF64 lifetime to the radv section
+	Dns64          string
+}
+
+func newNat64(cfg config.Nat64Config) (*Nat64, error) {
+	nat64 := &Nat64{
+		Enabled:        cfg.Enabled,
+		Translator:     cfg.Translator,
+		Pref64Lifetime: cfg.Pref64Lifetime,
+		Dns64:          cfg.Dns64,
+	}
+	if nat64.Translator == "" {
+		nat64.Translator = config.TranslatorJool
+	}
+
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = config.Nat64WellKnownPrefix
+	}
+	var err error
+	if nat64.Prefix, err = netip.ParsePrefix(prefix); err != nil || !nat64.Prefix.Addr().Is6() {
+		return nil, fmt.Errorf("'%s' is not a valid NAT64 prefix", prefix)
+	}
+
+	pool4 := cfg.Pool4
+	if pool4 == "" && nat64.Translator == config.TranslatorTayga {
+		pool4 = config.DefaultTaygaPool4
+	}
+	if pool4 != "" {
+		canonical := canonicalPrefix(pool4)
+		if nat64.Pool4, err = netip.ParsePrefix(canonical); err != nil || !nat64.Pool4.Addr().Is4() {
+			return nil, fmt.Errorf("'%s' is not a valid IPv4 pool", pool4)
+		}
+	}
+
+	return nat64, nil
+}
+
+// Uplink is the failover state of a link. The active member of a group
+// carries the default route, every member gets the routes of its health checks.
+type Uplink struct {
+	Group      string
+	Gateway    string
+	Gateway6   string
+	ProbeTable int
+	Active     bool
 }
 
 type Nat66 struct {
 	Enabled     bool
 	MssClamping bool
 	Mss         int
-	Origins     []string
+	SnatTo      []string // SNAT addresses or ranges, MASQUERADE when empty
+	Persistent  bool
+	Origins     []Origin // only these sources are translated, all when empty
+	Exclude     []string // destination prefixes that are never translated
 }
 
 type Nat44 struct {
 	Enabled     bool
 	MssClamping bool
 	Mss         int
-	Origins     []string
+	SnatTo      []string // SNAT addresses or ranges, MASQUERADE when empty
+	Persistent  bool
+	Origins     []Origin // only these sources are translated, all when empty
+	Exclude     []string // destination prefixes that are never translated
+}
+
+// Origin is a source network NATed on the link. SnatTo and Persistent are
+// inherited from the NAT section unless the origin sets its own snat-to.
+// A Table routes the origin's traffic out of the link (policy routing).
+type Origin struct {
+	Source     string
+	SnatTo     []string
+	Persistent bool
+	Table      int
+	Gateway    string // empty for an on-link default route
+	Fwmark     uint32 // the ip rule matches this mark instead of the source
 }
 
-func NewLink(name string, cfg config.LinkConfig) *Link {
+func newOrigins(origins []config.OriginConfig, snatTo []string, persistent bool) []Origin {
+	var result []Origin
+	for _, origin := range origins {
+		if origin.Source == "" {
+			continue
+		}
+		entry := Origin{
+			Source:     canonicalPrefix(origin.Source),
+			SnatTo:     snatTo,
+			Persistent: persistent,
+			Table:      origin.Table,
+			Gateway:    origin.Gateway,
+			Fwmark:     origin.Fwmark,
+		}
+		if len(origin.SnatTo) > 0 {
+			entry.SnatTo, entry.Persistent = origin.SnatTo, origin.Persistent
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+func newExcludes(destinations []string) []string {
+	var result []string
+	for _, destination := range destinations {
+		if destination != "" {
+			result = append(result, canonicalPrefix(destination))
+		}
+	}
+	return result
+}
+
+// canonicalPrefix writes an address or prefix the way iptables lists it,
+// plain addresses become host prefixes. Invalid values are kept as they are.
+func canonicalPrefix(value string) string {
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		return prefix.Masked().String()
+	}
+	if addr, err := netip.ParseAddr(value); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()).String()
+	}
+	return value
+}
+
+// PortForward exposes an internal service on the link through DNAT
+type PortForward struct {
+	Proto  string
+	First  int          // first external port
+	Last   int          // last external port, equal to First for a single port
+	Addr   netip.Addr   // internal address, its family selects iptables or ip6tables
+	ToPort string       // internal port, empty keeps the external port
+	Source netip.Prefix // invalid when any source may connect
+}
+
+func newPortForward(cfg config.PortForwardConfig) (*PortForward, error) {
+	if cfg.Proto != "tcp" && cfg.Proto != "udp" {
+		return nil, fmt.Errorf("unknown protocol '%s'", cfg.Proto)
+	}
+
+	first, last, err := config.ParsePortRange(cfg.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	addr, toPort, err := config.ParseForwardTarget(cfg.To)
+	if err != nil {
+		return nil, err
+	}
+
+	forward := &PortForward{Proto: cfg.Proto, First: first, Last: last, Addr: addr, ToPort: toPort}
+
+	if cfg.Source != "" {
+		source, err := netip.ParsePrefix(cfg.Source)
+		if err != nil {
+			sourceAddr, addrErr := netip.ParseAddr(cfg.Source)
+			if addrErr != nil {
+				return nil, fmt.Errorf("'%s' is not a valid source prefix", cfg.Source)
+			}
+			source = netip.PrefixFrom(sourceAddr, sourceAddr.BitLen())
+		}
+		if source.Addr().Is6() != addr.Is6() {
+			return nil, fmt.Errorf("source %s and internal address %s differ in address family", cfg.Source, addr)
+		}
+		forward.Source = source.Masked()
+	}
+
+	return forward, nil
+}
+
+// IPv6 reports whether the forward is rendered for ip6tables
+func (p *PortForward) IPv6() bool {
+	return p.Addr.Is6()
+}
+
+// Ports returns the external ports, joined with sep for ranges
+func (p *PortForward) Ports(sep string) string {
+	if p.First == p.Last {
+		return fmt.Sprintf("%d", p.First)
+	}
+	return fmt.Sprintf("%d%s%d", p.First, sep, p.Last)
+}
+
+// Name identifies the forward in rule tags, e.g. tcp-8000-8010
+func (p *PortForward) Name() string {
+	return p.Proto + "-" + p.Ports("-")
+}
+
+// Destination is the DNAT target, e.g. 10.0.0.5:8443 or [fd00::5]:8443
+func (p *PortForward) Destination() string {
+	if p.ToPort == "" {
+		return p.Addr.String()
+	}
+	if p.IPv6() {
+		return "[" + p.Addr.String() + "]:" + p.ToPort
+	}
+	return p.Addr.String() + ":" + p.ToPort
+}
+
+func (p *PortForward) String() string {
+	s := fmt.Sprintf("%s %s -> %s", p.Proto, p.Ports("-"), p.Destination())
+	if p.Source.IsValid() {
+		s += " from " + p.Source.String()
+	}
+	return s
+}
+
+// NewLink builds the model of one link. Parts of the config that cannot be
+// turned into rules are skipped and reported in the returned errors.
+func NewLink(name string, cfg config.LinkConfig) (*Link, []error) {
+	var errs []error
+
 	link := &Link{
 		Name:    name,
 		Config:  cfg,
@@ -38,8 +250,18 @@ func NewLink(name string, cfg config.LinkConfig) *Link {
 	}
 
 	// Initialize netmap6 configurations
-	for setName, netmapCfg := range cfg.Netmap6 {
-		link.Netmap6[setName] = netmap6.NewNetmap6(setName, netmapCfg)
+	setNames := make([]string, 0, len(cfg.Netmap6))
+	for setName := range cfg.Netmap6 {
+		setNames = append(setNames, setName)
+	}
+	sort.Strings(setNames)
+
+	for _, setName := range setNames {
+		netmap, netmapErrs := netmap6.NewNetmap6(setName, cfg.Netmap6[setName])
+		link.Netmap6[setName] = netmap
+		for _, err := range netmapErrs {
+			errs = append(errs, fmt.Errorf("link %s, %v", name, err))
+		}
 	}
 
 	// Initialize NAT66 if configured
@@ -48,7 +270,10 @@ func NewLink(name string, cfg config.LinkConfig) *Link {
 			Enabled:     cfg.Nat66.Enabled,
 			MssClamping: cfg.Nat66.MssClamping,
 			Mss:         cfg.Nat66.Mss,
-			Origins:     cfg.Nat66.Origins,
+			SnatTo:      cfg.Nat66.SnatTo,
+			Persistent:  cfg.Nat66.Persistent,
+			Origins:     newOrigins(cfg.Nat66.Origins, cfg.Nat66.SnatTo, cfg.Nat66.Persistent),
+			Exclude:     newExcludes(cfg.Nat66.Exclude),
 		}
 	}
 
@@ -58,7 +283,28 @@ func NewLink(name string, cfg config.LinkConfig) *Link {
 			Enabled:     cfg.Nat44.Enabled,
 			MssClamping: cfg.Nat44.MssClamping,
 			Mss:         cfg.Nat44.Mss,
-			Origins:     cfg.Nat44.Origins,
+			SnatTo:      cfg.Nat44.SnatTo,
+			Persistent:  cfg.Nat44.Persistent,
+			Origins:     newOrigins(cfg.Nat44.Origins, cfg.Nat44.SnatTo, cfg.Nat44.Persistent),
+			Exclude:     newExcludes(cfg.Nat44.Exclude),
+		}
+	}
+
+	for i, forwardCfg := range cfg.PortForwards {
+		forward, err := newPortForward(forwardCfg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("link %s, port-forwards[%d]: %v", name, i, err))
+			continue
+		}
+		link.PortForwards = append(link.PortForwards, forward)
+	}
+
+	if cfg.Nat64 != nil {
+		nat64, err := newNat64(*cfg.Nat64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("link %s, nat64: %v", name, err))
+		} else {
+			link.Nat64 = nat64
 		}
 	}
 
@@ -68,9 +314,14 @@ func NewLink(name string, cfg config.LinkConfig) *Link {
 
 		// Auto-generate routes from netmap6 configurations
 		link.generateAutoRoutes()
+
+		// Advertise the NAT64 prefix (PREF64)
+		if link.Nat64 != nil && link.Nat64.Enabled {
+			link.Radv.SetNat64Prefix(link.Nat64.Prefix.String(), link.Nat64.Pref64Lifetime)
+		}
 	}
 
-	return link
+	return link, errs
 }
 
 // generateAutoRoutes creates radv routes from netmap6 configurations
@@ -82,7 +333,8 @@ func (l *Link) generateAutoRoutes() {
 	var autoRoutes []radv.RouteConfig
 
 	// Collect routes from all netmap6 sets
-	for _, netmap := range l.Netmap6 {
+	for _, setName := range l.Netmap6Names() {
+		netmap := l.Netmap6[setName]
 		if !netmap.Enabled {
 			continue
 		}
@@ -117,12 +369,173 @@ func (l *Link) generateAutoRoutes() {
 	l.Radv.AutoRoutes = filteredAutoRoutes
 }
 
-func BuildLinks(cfg *config.Config) map[string]*Link {
+// SortedNames returns the link names in sorted order. Generated files and
+// rules iterate links through it so that their output does not change
+// from run to run.
+func SortedNames(links map[string]*Link) []string {
+	names := make([]string, 0, len(links))
+	for name := range links {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Netmap6Names returns the names of the link's netmap6 sets in sorted order
+func (l *Link) Netmap6Names() []string {
+	names := make([]string, 0, len(l.Netmap6))
+	for name := range l.Netmap6 {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithdrawRadv returns the links with copies of their radv configuration
+// that still advertise what previous lists and is no longer configured,
+// see radv.RadvConfig.Withdraw, together with the state to remember once
+// they are advertised. Interfaces whose link or radv section was removed
+// get a radv configuration that only withdraws, see radv.Withdrawal, until
+// the withdraw period is over. Other links are returned as they are.
+func WithdrawRadv(links map[string]*Link, previous *radv.State, now time.Time) (map[string]*Link, *radv.State) {
+	result := make(map[string]*Link, len(links))
+	state := &radv.State{Interfaces: make(map[string]*radv.InterfaceState)}
+
+	for name, linkObj := range links {
+		result[name] = linkObj
+		if linkObj.Radv == nil || !linkObj.Radv.Enabled {
+			continue
+		}
+
+		clone := *linkObj
+		clone.Radv, state.Interfaces[name] = linkObj.Radv.Withdraw(previous.Interface(name), now)
+		result[name] = &clone
+	}
+
+	if previous == nil {
+		return result, state
+	}
+
+	for name, previousState := range previous.Interfaces {
+		if _, ok := state.Interfaces[name]; ok {
+			continue
+		}
+
+		withdrawal, withdrawalState := radv.Withdrawal(previousState, now)
+		if withdrawal == nil {
+			continue
+		}
+
+		withdrawing := &Link{Name: name}
+		if linkObj, ok := links[name]; ok {
+			clone := *linkObj
+			withdrawing = &clone
+		}
+		withdrawing.Radv = withdrawal
+		result[name] = withdrawing
+		state.Interfaces[name] = withdrawalState
+	}
+
+	return result, state
+}
+
+// BuildLinks builds the model of every configured link. The links are
+// always returned, the error lists every problem found so that callers
+// applying the configuration can refuse it.
+func BuildLinks(cfg *config.Config) (map[string]*Link, error) {
 	links := make(map[string]*Link)
+	var errs []error
+
+	names := make([]string, 0, len(cfg.Network.Links))
+	for linkName := range cfg.Network.Links {
+		names = append(names, linkName)
+	}
+	sort.Strings(names)
+
+	for _, linkName := range names {
+		linkObj, linkErrs := NewLink(linkName, cfg.Network.Links[linkName])
+		links[linkName] = linkObj
+		errs = append(errs, linkErrs...)
+	}
+
+	errs = append(errs, checkOverlaps(names, links)...)
+
+	return links, errors.Join(errs...)
+}
+
+// Warnings lists the deprecated forms found while building the links,
+// for the command layer to report
+func Warnings(links map[string]*Link) []string {
+	var warnings []string
+	for _, name := range SortedNames(links) {
+		for _, setName := range links[name].Netmap6Names() {
+			for _, warning := range links[name].Netmap6[setName].Warnings {
+				warnings = append(warnings, fmt.Sprintf("link %s, %s", name, warning))
+			}
+		}
+	}
+	return warnings
+}
+
+// mappedRange is one side of a netmap6 mapping, named for conflict reports
+type mappedRange struct {
+	prefix netip.Prefix
+	owner  string
+}
 
-	for linkName, linkCfg := range cfg.Network.Links {
-		links[linkName] = NewLink(linkName, linkCfg)
+// checkOverlaps reports netmap6 mappings whose public or private ranges
+// overlap each other, across sets and links, and public ranges that collide
+// with prefixes advertised by radv. Disabled sets are not checked.
+func checkOverlaps(names []string, links map[string]*Link) []error {
+	var errs []error
+	var public, private, advertised []mappedRange
+
+	for _, linkName := range names {
+		linkObj := links[linkName]
+
+		for _, setName := range linkObj.Netmap6Names() {
+			netmap := linkObj.Netmap6[setName]
+			if !netmap.Enabled {
+				continue
+			}
+			for _, mapping := range netmap.Maps {
+				owner := fmt.Sprintf("link %s, netmap6 set %s, map %d", linkName, setName, mapping.Index)
+				public = append(public, mappedRange{mapping.PublicPrefix, owner})
+				private = append(private, mappedRange{mapping.PrivatePrefix, owner})
+			}
+		}
+
+		if linkObj.Radv != nil && linkObj.Radv.Enabled {
+			for _, radvPrefix := range linkObj.Radv.Prefixes {
+				if prefix, err := netip.ParsePrefix(radvPrefix.Prefix); err == nil {
+					advertised = append(advertised, mappedRange{prefix, "radv prefix on link " + linkName})
+				}
+			}
+		}
+	}
+
+	for _, side := range []struct {
+		name   string
+		ranges []mappedRange
+	}{{"public", public}, {"private", private}} {
+		for i, a := range side.ranges {
+			for _, b := range side.ranges[i+1:] {
+				if a.prefix.Overlaps(b.prefix) {
+					errs = append(errs, fmt.Errorf("%s range %s (%s) overlaps %s (%s)",
+						side.name, a.prefix, a.owner, b.prefix, b.owner))
+				}
+			}
+		}
+	}
+
+	for _, a := range public {
+		for _, b := range advertised {
+			if a.prefix.Overlaps(b.prefix) {
+				errs = append(errs, fmt.Errorf("public range %s (%s) collides with %s (%s)",
+					a.prefix, a.owner, b.prefix, b.owner))
+			}
+		}
 	}
 
-	return links
+	return errs
 }
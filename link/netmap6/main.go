@@ -3,8 +3,9 @@ package netmap6
 import (
 	"fmt"
 	"natman/config"
-	"strconv"
-	"strings"
+	"natman/link/prefix6"
+	iptablesmanager "natman/worker/iptables-manager"
+	"net/netip"
 )
 
 // Debug flag
@@ -27,15 +28,24 @@ func DebugPrint(format string, args ...interface{}) {
 type Netmap6 struct {
 	Name    string
 	Enabled bool
+	Mode    string // config.Netmap6ModeNetmap or config.Netmap6ModeNPTv6
 	PfxPub  string
 	PfxPriv string
 	Maps    []MapPair
+
+	Warnings []string // deprecated forms in the set's config, for the caller to report
 }
 
 type MapPair struct {
 	Public  string
 	Private string
 	Radv    *RadvRoute // Optional radv configuration
+
+	// Public and Private composed with PfxPub and PfxPriv
+	PublicPrefix  netip.Prefix
+	PrivatePrefix netip.Prefix
+
+	Index int // position in the maps list of the config
 }
 
 type RadvRoute struct {
@@ -45,23 +55,39 @@ type RadvRoute struct {
 	Prefix     string // Added field for the correct prefix format
 }
 
-func NewNetmap6(name string, cfg config.Netmap6Config) *Netmap6 {
+// NewNetmap6 builds a netmap set from its config. Mappings that cannot be
+// composed into equally sized public and private prefixes are left out and
+// reported in the returned errors.
+func NewNetmap6(name string, cfg config.Netmap6Config) (*Netmap6, []error) {
 	netmap := &Netmap6{
 		Name:    name,
 		Enabled: cfg.Enabled,
+		Mode:    cfg.Mode,
 		PfxPub:  cfg.PfxPub,
 		PfxPriv: cfg.PfxPriv,
-		Maps:    make([]MapPair, len(cfg.Maps)),
 	}
 
+	if netmap.Mode == "" {
+		netmap.Mode = config.Netmap6ModeNetmap
+	}
+
+	for side, base := range []struct{ key, value string }{{"pfx-pub", cfg.PfxPub}, {"pfx-priv", cfg.PfxPriv}} {
+		if warning := legacyBaseWarning(base.key, base.value, cfg.Maps, side); warning != "" {
+			netmap.Warnings = append(netmap.Warnings, fmt.Sprintf("netmap6 set %s: %s", name, warning))
+		}
+	}
+
+	var errs []error
 	for i, mapPair := range cfg.Maps {
 		if len(mapPair.Pair) < 2 {
-			continue // Skip invalid entries
+			errs = append(errs, fmt.Errorf("netmap6 set %s, map %d: pair needs a public and a private side", name, i))
+			continue
 		}
 
 		pair := MapPair{
 			Public:  "",
 			Private: "",
+			Index:   i,
 		}
 
 		// Parse public address (index 0)
@@ -74,6 +100,24 @@ func NewNetmap6(name string, cfg config.Netmap6Config) *Netmap6 {
 			pair.Private = priv
 		}
 
+		// Compose both sides with the set prefixes
+		var err error
+		if pair.PublicPrefix, err = prefix6.Compose(cfg.PfxPub, pair.Public); err != nil {
+			errs = append(errs, fmt.Errorf("netmap6 set %s, map %d: public side: %v", name, i, err))
+			continue
+		}
+		if pair.PrivatePrefix, err = prefix6.Compose(cfg.PfxPriv, pair.Private); err != nil {
+			errs = append(errs, fmt.Errorf("netmap6 set %s, map %d: private side: %v", name, i, err))
+			continue
+		}
+
+		// NETMAP maps address by address, both ranges must be the same size
+		if pair.PublicPrefix.Bits() != pair.PrivatePrefix.Bits() {
+			errs = append(errs, fmt.Errorf("netmap6 set %s, map %d: public %s and private %s differ in prefix length",
+				name, i, pair.PublicPrefix, pair.PrivatePrefix))
+			continue
+		}
+
 		// Check if radv configuration is present (4 elements total)
 		if len(mapPair.Pair) >= 4 {
 			preference := "medium" // default
@@ -97,10 +141,44 @@ func NewNetmap6(name string, cfg config.Netmap6Config) *Netmap6 {
 			}
 		}
 
-		netmap.Maps[i] = pair
+		netmap.Maps = append(netmap.Maps, pair)
+	}
+
+	return netmap, errs
+}
+
+// NPTv6 reports whether the set uses stateless prefix translation
+func (n *Netmap6) NPTv6() bool {
+	return n.Mode == config.Netmap6ModeNPTv6
+}
+
+// legacyBaseWarning describes a partial prefix of the old form, with the
+// full address it stands for when every map's side pads it the same way.
+// It is empty for a complete address.
+func legacyBaseWarning(key, base string, maps []config.MapPair, side int) string {
+	if !prefix6.IsLegacyBase(base) {
+		return ""
+	}
+
+	full := ""
+	for _, m := range maps {
+		fragment, ok := "", len(m.Pair) > side
+		if ok {
+			fragment, ok = m.Pair[side].(string)
+		}
+		padded, err := prefix6.LegacyBase(base, fragment)
+		if !ok || err != nil || (full != "" && padded != full) {
+			full = ""
+			break
+		}
+		full = padded
 	}
 
-	return netmap
+	suggestion := ""
+	if full != "" {
+		suggestion = fmt.Sprintf(", with these maps write it as \"%s\"", full)
+	}
+	return fmt.Sprintf("%s '%s' is a partial address, this form is deprecated%s", key, base, suggestion)
 }
 
 func (n *Netmap6) GenerateIp6tablesRules(interfaceName string) []string {
@@ -109,34 +187,34 @@ func (n *Netmap6) GenerateIp6tablesRules(interfaceName string) []string {
 		return nil
 	}
 
+	if n.NPTv6() {
+		return n.generateNptRules(interfaceName)
+	}
+
 	var rules []string
 
 	DebugPrint("Generating rules for interface %s with %d mappings", interfaceName, len(n.Maps))
 	DebugPrint("Using prefixes - Public: %s, Private: %s", n.PfxPub, n.PfxPriv)
 
 	for i, mapping := range n.Maps {
-		// Skip empty mappings
-		if mapping.Public == "" || mapping.Private == "" {
-			DebugPrint("Mapping %d: Skipping empty mapping", i)
-			continue
-		}
-
 		DebugPrint("Mapping %d: Public=%s, Private=%s", i, mapping.Public, mapping.Private)
 
-		// Expand addresses using prefixes - Use simpler direct concatenation approach
-		publicAddr := n.SimpleConcatAddress(mapping.Public, n.PfxPub)
-		privateAddr := n.SimpleConcatAddress(mapping.Private, n.PfxPriv)
+		publicAddr := mapping.PublicPrefix.String()
+		privateAddr := mapping.PrivatePrefix.String()
 
 		DebugPrint("Expanded addresses - Public: %s, Private: %s", publicAddr, privateAddr)
 
+		// Tag the rules with the link and set they belong to
+		tag := iptablesmanager.NewTag(interfaceName, iptablesmanager.FeatureNetmap6, n.Name)
+
 		// POSTROUTING rule for outgoing traffic (private -> public)
-		postrouting := fmt.Sprintf("ip6tables -t nat -A POSTROUTING -o %s -s %s -j NETMAP --to %s",
-			interfaceName, privateAddr, publicAddr)
+		postrouting := fmt.Sprintf("ip6tables -t nat -A %s -o %s -s %s %s -j NETMAP --to %s",
+			iptablesmanager.ChainPostrouting, interfaceName, privateAddr, tag.Match(), publicAddr)
 		DebugPrint("Generated POSTROUTING rule: %s", postrouting)
 
 		// PREROUTING rule for incoming traffic (public -> private)
-		prerouting := fmt.Sprintf("ip6tables -t nat -A PREROUTING -i %s -d %s -j NETMAP --to %s",
-			interfaceName, publicAddr, privateAddr)
+		prerouting := fmt.Sprintf("ip6tables -t nat -A %s -i %s -d %s %s -j NETMAP --to %s",
+			iptablesmanager.ChainPrerouting, interfaceName, publicAddr, tag.Match(), privateAddr)
 		DebugPrint("Generated PREROUTING rule: %s", prerouting)
 
 		rules = append(rules, postrouting, prerouting)
@@ -146,154 +224,63 @@ func (n *Netmap6) GenerateIp6tablesRules(interfaceName string) []string {
 	return rules
 }
 
-// SimpleConcatAddress directly concatenates prefix with the address part
-// This is a simpler approach that works better for the specific format in the config
-func (n *Netmap6) SimpleConcatAddress(addressPart, prefix string) string {
-	// If no prefix, return the address as-is
-	if prefix == "" {
-		return addressPart
-	}
-
-	// Handle CIDR notation in addressPart
-	var addrPart, cidrSuffix string
-	if strings.Contains(addressPart, "/") {
-		parts := strings.Split(addressPart, "/")
-		addrPart = parts[0]
-		cidrSuffix = "/" + parts[1]
-	} else {
-		addrPart = addressPart
-		cidrSuffix = ""
-	}
-
-	// Clean up prefix by removing trailing colon
-	prefix = strings.TrimRight(prefix, ":")
-
-	// Simple concatenation
-	return prefix + ":" + addrPart + cidrSuffix
-}
+// generateNptRules renders the mappings as SNPT/DNPT rules in the mangle
+// table, in the option order ip6tables -S prints them
+func (n *Netmap6) generateNptRules(interfaceName string) []string {
+	var rules []string
+	tag := iptablesmanager.NewTag(interfaceName, iptablesmanager.FeatureNetmap6, n.Name)
 
-// isValidIPv6Address validates if the string is a proper IPv6 address or CIDR for ip6tables
-func isValidIPv6Address(addr string) bool {
-	if Debug {
-		DebugPrint("Validating IPv6 address: %s", addr)
-	}
+	for _, mapping := range n.Maps {
+		publicAddr := mapping.PublicPrefix.String()
+		privateAddr := mapping.PrivatePrefix.String()
 
-	// Basic validation for ip6tables
-	if addr == "" {
-		DebugPrint("Address is empty")
-		return false
-	}
+		// Outgoing traffic (private -> public)
+		snpt := fmt.Sprintf("ip6tables -t mangle -A %s -s %s -o %s %s -j SNPT --src-pfx %s --dst-pfx %s",
+			iptablesmanager.ChainSnpt, privateAddr, interfaceName, tag.Match(), privateAddr, publicAddr)
 
-	// Handle CIDR notation
-	var ipPart string
-	if strings.Contains(addr, "/") {
-		parts := strings.Split(addr, "/")
-		if len(parts) != 2 {
-			DebugPrint("Invalid CIDR format: wrong number of parts")
-			return false
-		}
-		ipPart = parts[0]
+		// Incoming traffic (public -> private)
+		dnpt := fmt.Sprintf("ip6tables -t mangle -A %s -d %s -i %s %s -j DNPT --src-pfx %s --dst-pfx %s",
+			iptablesmanager.ChainDnpt, publicAddr, interfaceName, tag.Match(), publicAddr, privateAddr)
 
-		// Validate prefix length is a number between 0 and 128
-		prefixLen := parts[1]
-		if pl, err := strconv.Atoi(prefixLen); err != nil || pl < 0 || pl > 128 {
-			DebugPrint("Invalid CIDR prefix length: %s", prefixLen)
-			return false
-		}
-		DebugPrint("Valid CIDR prefix length: %s", prefixLen)
-	} else {
-		ipPart = addr
+		DebugPrint("Generated NPTv6 rules: %s, %s", snpt, dnpt)
+		rules = append(rules, snpt, dnpt)
 	}
 
-	result := isValidIPv6AddressFormat(ipPart)
-	if Debug {
-		if result {
-			DebugPrint("Address is valid")
-		} else {
-			DebugPrint("Address format is invalid")
-		}
-	}
-	return result
+	return rules
 }
 
-// isValidIPv6AddressFormat checks if the string has a valid IPv6 address format
-func isValidIPv6AddressFormat(ipPart string) bool {
-	if Debug {
-		DebugPrint("Validating IPv6 address format: %s", ipPart)
-	}
-
-	// Must contain at least one colon
-	if !strings.Contains(ipPart, ":") {
-		DebugPrint("No colons found")
-		return false
-	}
-
-	// Cannot have three consecutive colons
-	if strings.Contains(ipPart, ":::") {
-		DebugPrint("Contains invalid ':::'")
-		return false
-	}
-
-	// Count double-colon (compression) occurrences - at most one is allowed
-	doubleColonCount := strings.Count(ipPart, "::")
-	if doubleColonCount > 1 {
-		DebugPrint("Contains multiple '::' compressions")
-		return false
+// GenerateNftRules renders the mappings as nftables prefix snat/dnat statements.
+// It returns the rules for the postrouting and prerouting chains separately.
+func (n *Netmap6) GenerateNftRules(interfaceName string) ([]string, []string) {
+	if !n.Enabled || interfaceName == "" {
+		DebugPrint("Netmap disabled or no interface provided")
+		return nil, nil
 	}
-
-	// Split by colon and validate each segment
-	segments := strings.Split(ipPart, ":")
-	DebugPrint("Address has %d segments", len(segments))
-
-	// Handle compressed notation with :: at start, end, or middle
-	hasCompression := strings.Contains(ipPart, "::")
-	if hasCompression {
-		// Count segments excluding empty ones from compression
-		nonEmptyCount := 0
-		for _, seg := range segments {
-			if seg != "" {
-				nonEmptyCount++
-			}
-		}
-		DebugPrint("Address has compression with %d non-empty segments", nonEmptyCount)
-
-		// With compression, we can have up to 7 non-empty segments
-		if nonEmptyCount > 7 {
-			DebugPrint("Too many segments (%d) with compression", nonEmptyCount)
-			return false
-		}
-	} else {
-		// Without compression, we must have exactly 8 segments
-		if len(segments) != 8 {
-			DebugPrint("Without compression, expected 8 segments but found %d", len(segments))
-			return false
-		}
+	if n.NPTv6() {
+		DebugPrint("Netmap %s uses nptv6, not available with nftables", n.Name)
+		return nil, nil
 	}
 
-	// Validate each segment is valid hex and correct length
-	for i, segment := range segments {
-		if segment == "" {
-			DebugPrint("Segment %d is empty (part of compression)", i)
-			continue // Empty segment is part of :: compression
-		}
+	var postrouting, prerouting []string
+	tag := iptablesmanager.NewTag(interfaceName, iptablesmanager.FeatureNetmap6, n.Name)
 
-		if len(segment) > 4 {
-			DebugPrint("Segment %d is too long: %s", i, segment)
-			return false
-		}
-
-		for j, c := range segment {
-			if !((c >= '0' && c <= '9') ||
-				(c >= 'a' && c <= 'f') ||
-				(c >= 'A' && c <= 'F')) {
-				DebugPrint("Invalid character in segment %d at position %d: %c", i, j, c)
-				return false
-			}
-		}
+	for _, mapping := range n.Maps {
+		publicAddr := mapping.PublicPrefix.String()
+		privateAddr := mapping.PrivatePrefix.String()
+
+		// Outgoing traffic (private -> public)
+		postrouting = append(postrouting, fmt.Sprintf(
+			"oifname \"%s\" ip6 saddr %s snat ip6 prefix to ip6 saddr map { %s : %s } comment \"%s\"",
+			interfaceName, privateAddr, privateAddr, publicAddr, tag))
+
+		// Incoming traffic (public -> private)
+		prerouting = append(prerouting, fmt.Sprintf(
+			"iifname \"%s\" ip6 daddr %s dnat ip6 prefix to ip6 daddr map { %s : %s } comment \"%s\"",
+			interfaceName, publicAddr, publicAddr, privateAddr, tag))
 	}
 
-	DebugPrint("Address format is valid")
-	return true
+	DebugPrint("Total nft rules generated: %d", len(postrouting)+len(prerouting))
+	return postrouting, prerouting
 }
 
 // GetRadvRoutes returns routes that should be automatically added to radvd config
@@ -306,19 +293,14 @@ func (n *Netmap6) GetRadvRoutes() []RadvRoute {
 
 	for _, mapping := range n.Maps {
 		if mapping.Radv != nil {
-			// Create route for the public prefix/address
-			publicAddr := n.SimpleConcatAddress(mapping.Public, n.PfxPub)
-
-			// Ensure it's a valid IPv6 address/prefix
-			if isValidIPv6Address(publicAddr) {
-				route := RadvRoute{
-					Prefix:     publicAddr, // Use the full public address/prefix
-					Preference: mapping.Radv.Preference,
-					Metric:     mapping.Radv.Metric,
-					Lifetime:   mapping.Radv.Lifetime,
-				}
-				routes = append(routes, route)
+			// Create route for the public prefix
+			route := RadvRoute{
+				Prefix:     mapping.PublicPrefix.String(),
+				Preference: mapping.Radv.Preference,
+				Metric:     mapping.Radv.Metric,
+				Lifetime:   mapping.Radv.Lifetime,
 			}
+			routes = append(routes, route)
 		}
 	}
 
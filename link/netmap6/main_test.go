@@ -0,0 +1,49 @@
+package netmap6
+
+import (
+	"reflect"
+	"testing"
+
+	"natman/config"
+)
+
+func TestLegacyBaseWarnings(t *testing.T) {
+	pairs := func(pairs ...[]interface{}) []config.MapPair {
+		var maps []config.MapPair
+		for _, pair := range pairs {
+			maps = append(maps, config.MapPair{Pair: pair})
+		}
+		return maps
+	}
+
+	tests := []struct {
+		name string
+		cfg  config.Netmap6Config
+		want []string
+	}{
+		{
+			name: "full addresses",
+			cfg: config.Netmap6Config{PfxPub: "2001:db8:1::", PfxPriv: "fd00::",
+				Maps: pairs([]interface{}{"::25:0:0/96", "::20:0:0/96"})},
+		},
+		{
+			name: "legacy private base",
+			cfg: config.Netmap6Config{PfxPub: "2001:db8:1::", PfxPriv: "b30::20:",
+				Maps: pairs([]interface{}{"::25:0:0/96", "20:0:0/96"}, []interface{}{"::26:0:0/96", "21:0:0/96"})},
+			want: []string{`netmap6 set c1: pfx-priv 'b30::20:' is a partial address, this form is deprecated, with these maps write it as "b30::20:0:0:0"`},
+		},
+		{
+			name: "maps padding differently",
+			cfg: config.Netmap6Config{PfxPub: "e2::3:", PfxPriv: "fd00::",
+				Maps: pairs([]interface{}{"25:0:0/96", "::20:0:0/96"}, []interface{}{"0:26:0:0/96", "::21:0:0/96"})},
+			want: []string{"netmap6 set c1: pfx-pub 'e2::3:' is a partial address, this form is deprecated"},
+		},
+	}
+
+	for _, tt := range tests {
+		netmap, _ := NewNetmap6("c1", tt.cfg)
+		if !reflect.DeepEqual(netmap.Warnings, tt.want) {
+			t.Errorf("%s: warnings %q, want %q", tt.name, netmap.Warnings, tt.want)
+		}
+	}
+}
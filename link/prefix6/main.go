@@ -0,0 +1,145 @@
+package prefix6
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Netmap6 addresses are written as a base prefix (pfx-pub, pfx-priv) and a
+// fragment per map entry. They combine bitwise:
+//
+//   - the base is a full IPv6 address such as "2001:db8:1::", empty means ::
+//   - the fragment is an IPv6 address with an optional /length. A fragment
+//     without "::" and with fewer than eight groups is aligned to the right,
+//     so "20:0:0/96" is the same as "::20:0:0/96"
+//   - the result is base OR fragment with the fragment's length (/128 when
+//     it has none). Base and fragment must not set the same bits and the
+//     result must not have bits set beyond its length.
+//
+// For example "2001:db8:1::" + "::25:0:0/96" gives 2001:db8:1::25:0:0/96.
+//
+// Older configs wrote partial bases ending in a single colon, such as
+// "b30::20:", whose groups were followed directly by the fragment's groups.
+// They are still accepted: the base is padded with a zero group for every
+// group of the fragment, so "b30::20:" + "20:0:0/96" gives b30::20:20:0:0/96
+// as before.
+
+// IsLegacyBase reports whether base is a partial address of the old form
+func IsLegacyBase(base string) bool {
+	return strings.HasSuffix(base, ":") && !strings.HasSuffix(base, "::")
+}
+
+// ParseBase parses a pfx-pub or pfx-priv value. A legacy partial base is
+// checked with its trailing colon replaced by "::", Compose pads it for
+// the fragment it is combined with.
+func ParseBase(base string) (netip.Addr, error) {
+	if base == "" {
+		return netip.IPv6Unspecified(), nil
+	}
+
+	value := base
+	if IsLegacyBase(base) {
+		value = strings.TrimSuffix(base, ":")
+		if !strings.Contains(value, "::") {
+			value += "::"
+		}
+	}
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil || !addr.Is6() || addr.Is4In6() || addr.Zone() != "" {
+		return netip.Addr{}, fmt.Errorf("prefix '%s' is not an IPv6 address", base)
+	}
+
+	return addr, nil
+}
+
+// LegacyBase returns the full address a legacy partial base stands for
+// when it is combined with fragment
+func LegacyBase(base, fragment string) (string, error) {
+	if _, err := ParseBase(base); err != nil {
+		return "", err
+	}
+
+	addrPart, _, _ := strings.Cut(fragment, "/")
+	if strings.Contains(addrPart, "::") {
+		return "", fmt.Errorf("fragment '%s' cannot follow the partial prefix '%s', write the prefix as a full IPv6 address", fragment, base)
+	}
+
+	padded := strings.TrimSuffix(base, ":") + strings.Repeat(":0", strings.Count(addrPart, ":")+1)
+	if !strings.Contains(padded, "::") && strings.Count(padded, ":") < 7 {
+		padded += "::"
+	}
+
+	addr, err := netip.ParseAddr(padded)
+	if err != nil || !addr.Is6() || addr.Is4In6() {
+		return "", fmt.Errorf("partial prefix '%s' and fragment '%s' have more than eight groups", base, fragment)
+	}
+	return addr.String(), nil
+}
+
+// ParseFragment parses the address fragment of a map entry
+func ParseFragment(fragment string) (netip.Prefix, error) {
+	addrPart, bits := fragment, 128
+	if i := strings.Index(fragment, "/"); i >= 0 {
+		addrPart = fragment[:i]
+		n, err := strconv.Atoi(fragment[i+1:])
+		if err != nil || n < 0 || n > 128 {
+			return netip.Prefix{}, fmt.Errorf("fragment '%s' has an invalid prefix length", fragment)
+		}
+		bits = n
+	}
+
+	// Short fragments fill the lowest groups
+	if !strings.Contains(addrPart, "::") && strings.Count(addrPart, ":") < 7 {
+		addrPart = "::" + addrPart
+	}
+
+	addr, err := netip.ParseAddr(addrPart)
+	if err != nil || !addr.Is6() || addr.Zone() != "" {
+		return netip.Prefix{}, fmt.Errorf("fragment '%s' is not an IPv6 address fragment", fragment)
+	}
+
+	return netip.PrefixFrom(addr, bits), nil
+}
+
+// Compose combines a base prefix and a map fragment into the prefix used
+// in the NETMAP rules
+func Compose(base, fragment string) (netip.Prefix, error) {
+	full := base
+	if IsLegacyBase(base) {
+		var err error
+		if full, err = LegacyBase(base, fragment); err != nil {
+			return netip.Prefix{}, err
+		}
+	}
+
+	baseAddr, err := ParseBase(full)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	frag, err := ParseFragment(fragment)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	b := baseAddr.As16()
+	f := frag.Addr().As16()
+	var result [16]byte
+	for i := range result {
+		if b[i]&f[i] != 0 {
+			return netip.Prefix{}, fmt.Errorf("fragment '%s' overlaps prefix '%s'", fragment, base)
+		}
+		result[i] = b[i] | f[i]
+	}
+
+	composed := netip.PrefixFrom(netip.AddrFrom16(result), frag.Bits())
+	if composed.Masked() != composed {
+		return netip.Prefix{}, fmt.Errorf("'%s' + '%s' gives %s which has bits set beyond /%d",
+			base, fragment, composed.Addr(), composed.Bits())
+	}
+
+	return composed, nil
+}
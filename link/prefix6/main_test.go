@@ -0,0 +1,154 @@
+package prefix6
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseBase(t *testing.T) {
+	tests := []struct {
+		base string
+		want string // empty when an error is expected
+	}{
+		{"", "::"},
+		{"2001:db8:1::", "2001:db8:1::"},
+		{"e2:0:0:3::", "e2:0:0:3::"},
+		{"fd00::1", "fd00::1"},
+		// Legacy partial bases
+		{"b30::20:", "b30::20"},
+		{"e2::3:", "e2::3"},
+		{"2001:db8:1:", "2001:db8:1::"},
+		{"2001:db8", ""},
+		{"192.0.2.1", ""},
+		{"::ffff:192.0.2.1", ""},
+		{"fe80::1%eth0", ""},
+		{"b30:::", ""},
+		{"zz::", ""},
+	}
+
+	for _, tt := range tests {
+		addr, err := ParseBase(tt.base)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("ParseBase(%q) = %s, want an error", tt.base, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseBase(%q) failed: %v", tt.base, err)
+			continue
+		}
+		if addr != netip.MustParseAddr(tt.want) {
+			t.Errorf("ParseBase(%q) = %s, want %s", tt.base, addr, tt.want)
+		}
+	}
+}
+
+func TestParseFragment(t *testing.T) {
+	tests := []struct {
+		fragment string
+		want     string // empty when an error is expected
+	}{
+		{"20:0:0/96", "::20:0:0/96"},
+		{"::25:0:0/96", "::25:0:0/96"},
+		{"0:25:0:0/96", "::25:0:0/96"},
+		{"1", "::1/128"},
+		{"::/48", "::/48"},
+		{"0:0:0:1::/64", "0:0:0:1::/64"},
+		{"1:2:3:4:5:6:7:8/128", "1:2:3:4:5:6:7:8/128"},
+		{"20:0:0/129", ""},
+		{"20:0:0/-1", ""},
+		{"20:0:0/x", ""},
+		{"20:0:0:g/96", ""},
+		{"::1%eth0", ""},
+	}
+
+	for _, tt := range tests {
+		prefix, err := ParseFragment(tt.fragment)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("ParseFragment(%q) = %s, want an error", tt.fragment, prefix)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseFragment(%q) failed: %v", tt.fragment, err)
+			continue
+		}
+		if prefix != netip.MustParsePrefix(tt.want) {
+			t.Errorf("ParseFragment(%q) = %s, want %s", tt.fragment, prefix, tt.want)
+		}
+	}
+}
+
+func TestCompose(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     string
+		fragment string
+		want     string // composed prefix, or a part of the error message
+		fails    bool
+	}{
+		{"readme example", "2001:db8:1::", "::25:0:0/96", "2001:db8:1::25:0:0/96", false},
+		{"short fragment", "b30::", "20:0:0/96", "b30::20:0:0/96", false},
+		{"empty base", "", "fd00::/64", "fd00::/64", false},
+		{"host address", "2001:db8::", "5", "2001:db8::5/128", false},
+		{"/48 subnet", "2001:db8::", "0:0:1::/48", "2001:db8:1::/48", false},
+		{"/64 subnet", "2001:db8:1::", "0:0:0:2::/64", "2001:db8:1:2::/64", false},
+		{"whole /48", "2001:db8:1::", "::/48", "2001:db8:1::/48", false},
+		{"/48 with a /64 base", "2001:db8:1:2::", "::/48", "beyond /48", true},
+		{"bits beyond /64", "2001:db8:1::", "::1:0:0:1/64", "beyond /64", true},
+		{"bits beyond /96", "b30::", "20:0:1/96", "beyond /96", true},
+		{"overlap", "2001:db8:1::", "0:0:1::/48", "overlaps", true},
+		{"overlap in one group", "2001:db8:1:f0::", "0:0:0:10::/64", "overlaps", true},
+		{"invalid base", "2001:db8", "20:0:0/96", "not an IPv6 address", true},
+		{"invalid fragment", "2001:db8::", "20:0:0/200", "invalid prefix length", true},
+		// Legacy partial bases keep their old results
+		{"legacy private base", "b30::20:", "20:0:0/96", "b30::20:20:0:0/96", false},
+		{"legacy public base", "e2::3:", "0:25:0:0/96", "e2:0:0:3:0:25::/96", false},
+		{"legacy base without ::", "2001:db8:1:", "25:0:0/96", "2001:db8:1::25:0:0/96", false},
+		{"legacy base with a :: fragment", "b30::20:", "::20:0:0/96", "cannot follow", true},
+		{"legacy base too long", "1:2:3:4:5:6:", "20:0:0/96", "more than eight groups", true},
+	}
+
+	for _, tt := range tests {
+		prefix, err := Compose(tt.base, tt.fragment)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%s: Compose(%q, %q) = %s, want an error", tt.name, tt.base, tt.fragment, prefix)
+			} else if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("%s: Compose(%q, %q) error %q does not mention %q", tt.name, tt.base, tt.fragment, err, tt.want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Compose(%q, %q) failed: %v", tt.name, tt.base, tt.fragment, err)
+			continue
+		}
+		if prefix != netip.MustParsePrefix(tt.want) {
+			t.Errorf("%s: Compose(%q, %q) = %s, want %s", tt.name, tt.base, tt.fragment, prefix, tt.want)
+		}
+	}
+}
+
+func TestLegacyBase(t *testing.T) {
+	tests := []struct {
+		base, fragment, want string
+	}{
+		{"b30::20:", "20:0:0/96", "b30::20:0:0:0"},
+		{"e2::3:", "0:25:0:0/96", "e2::3:0:0:0:0"},
+		{"2001:db8:1:", "25:0:0/96", "2001:db8:1::"},
+	}
+
+	for _, tt := range tests {
+		got, err := LegacyBase(tt.base, tt.fragment)
+		if err != nil {
+			t.Errorf("LegacyBase(%q, %q) failed: %v", tt.base, tt.fragment, err)
+			continue
+		}
+		if netip.MustParseAddr(got) != netip.MustParseAddr(tt.want) {
+			t.Errorf("LegacyBase(%q, %q) = %s, want %s", tt.base, tt.fragment, got, tt.want)
+		}
+	}
+}
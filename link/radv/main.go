@@ -1,25 +1,54 @@
 package radv
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"natman/config"
 )
 
 const RadvdConfPath = "/etc/radvd.conf"
 
+// StatePath remembers the prefixes and routes that were advertised, so
+// that the ones removed from the configuration can be withdrawn
+const StatePath = "/var/lib/natman/radv.json"
+
 type RadvConfig struct {
-	Enabled         bool
-	MinAdvInterval  int
-	MaxAdvInterval  int
-	DefaultLifetime int
-	Dhcp            bool
-	Prefixes        []PrefixConfig
-	Routes          []RouteConfig
-	AutoRoutes      []RouteConfig // Auto-generated from netmap6
-	RDNSS           []RDNSSConfig // Recursive DNS Server configuration
-	Include         []string
+	Enabled           bool
+	MinAdvInterval    int
+	MaxAdvInterval    int
+	DefaultLifetime   int
+	DefaultPreference string // empty leaves radvd's default (medium)
+	DHCPv6            string // stateful sets the M and O flags, stateless only O
+	LinkMTU           int
+	ReachableTime     int
+	RetransTimer      int
+	CurHopLimit       *int
+	HomeAgent         bool
+	SourceLLAddress   *bool
+	RASrcAddress      []string
+	Clients           []string
+	Prefixes          []PrefixConfig
+	Routes            []RouteConfig
+	AutoRoutes        []RouteConfig // Auto-generated from netmap6
+	RDNSS             []RDNSSConfig // Recursive DNS Server configuration
+	DNSSL             []DNSSLConfig // DNS Search List configuration
+	Nat64Prefix       *Nat64PrefixConfig
+	Include           []string
+	WithdrawPeriod    int            // seconds removed prefixes and routes are still advertised
+	WithdrawnPrefixes []PrefixConfig // removed prefixes, zero preferred lifetime
+	WithdrawnRoutes   []RouteConfig  // removed routes, zero lifetime
+}
+
+// Nat64PrefixConfig is the PREF64 option (RFC 8781), set from the link's nat64 section
+type Nat64PrefixConfig struct {
+	Prefix   string
+	Lifetime int
 }
 
 type PrefixConfig struct {
@@ -44,15 +73,39 @@ type RDNSSConfig struct {
 	Lifetime int
 }
 
+type DNSSLConfig struct {
+	Domains  []string
+	Lifetime int
+}
+
 type Config struct {
 	Interfaces map[string]*RadvConfig
 }
 
 func NewRadvConfig(cfg config.RadvConfig) *RadvConfig {
 	radv := &RadvConfig{
-		Enabled: cfg.Enabled,
-		Dhcp:    cfg.Dhcp,
-		Include: cfg.Include,
+		Enabled:           cfg.Enabled,
+		DefaultPreference: cfg.Preference,
+		DHCPv6:            cfg.DHCPv6,
+		LinkMTU:           cfg.MTU,
+		ReachableTime:     cfg.ReachableTime,
+		RetransTimer:      cfg.RetransTimer,
+		CurHopLimit:       cfg.HopLimit,
+		HomeAgent:         cfg.HomeAgent,
+		SourceLLAddress:   cfg.SrcLLAddr,
+		RASrcAddress:      cfg.SrcAddr,
+		Clients:           cfg.Clients,
+		Include:           cfg.Include,
+		WithdrawPeriod:    config.DefaultWithdrawPeriod,
+	}
+
+	if cfg.WithdrawPeriod != nil {
+		radv.WithdrawPeriod = *cfg.WithdrawPeriod
+	}
+
+	// The deprecated dhcp flag announced stateful DHCPv6
+	if radv.DHCPv6 == "" && cfg.Dhcp {
+		radv.DHCPv6 = config.DHCPv6Stateful
 	}
 
 	// Parse adv-interval [min, max]
@@ -146,74 +199,375 @@ func NewRadvConfig(cfg config.RadvConfig) *RadvConfig {
 		radv.RDNSS = append(radv.RDNSS, rc)
 	}
 
+	// Convert DNSSL configuration
+	for _, dnssl := range cfg.DNSSL {
+		dc := DNSSLConfig{
+			Domains:  dnssl.Domain,
+			Lifetime: dnssl.Lifetime,
+		}
+
+		// Same default lifetime as RDNSS
+		if dc.Lifetime == 0 {
+			dc.Lifetime = 300
+		}
+
+		radv.DNSSL = append(radv.DNSSL, dc)
+	}
+
+	if cfg.Pref64 != nil {
+		radv.Nat64Prefix = &Nat64PrefixConfig{
+			Prefix:   cfg.Pref64.Prefix,
+			Lifetime: radv.pref64Lifetime(cfg.Pref64.Lifetime),
+		}
+	}
+
 	return radv
 }
 
+// SetNat64Prefix advertises the NAT64 prefix of the link's nat64 section,
+// unless the radv section sets its own pref64
+func (r *RadvConfig) SetNat64Prefix(prefix string, lifetime int) {
+	if r.Nat64Prefix != nil {
+		return
+	}
+	r.Nat64Prefix = &Nat64PrefixConfig{Prefix: prefix, Lifetime: r.pref64Lifetime(lifetime)}
+}
+
+// pref64Lifetime defaults to three times the maximum advertisement
+// interval as RFC 8781 recommends
+func (r *RadvConfig) pref64Lifetime(lifetime int) int {
+	if lifetime == 0 {
+		lifetime = 3 * r.MaxAdvInterval
+		if lifetime > config.MaxPref64Lifetime {
+			lifetime = config.MaxPref64Lifetime
+		}
+	}
+	return lifetime
+}
+
 func (r *RadvConfig) GenerateConfig(interfaceName string) string {
 	if !r.Enabled {
 		return ""
 	}
 
-	var config strings.Builder
+	var conf strings.Builder
 
-	config.WriteString(fmt.Sprintf("interface %s {\n", interfaceName))
-	config.WriteString("    AdvSendAdvert on;\n")
-	config.WriteString(fmt.Sprintf("    MinRtrAdvInterval %d;\n", r.MinAdvInterval))
-	config.WriteString(fmt.Sprintf("    MaxRtrAdvInterval %d;\n", r.MaxAdvInterval))
-	config.WriteString(fmt.Sprintf("    AdvDefaultLifetime %d;\n", r.DefaultLifetime))
+	conf.WriteString(fmt.Sprintf("interface %s {\n", interfaceName))
+	conf.WriteString("    AdvSendAdvert on;\n")
+	conf.WriteString(fmt.Sprintf("    MinRtrAdvInterval %d;\n", r.MinAdvInterval))
+	conf.WriteString(fmt.Sprintf("    MaxRtrAdvInterval %d;\n", r.MaxAdvInterval))
+	conf.WriteString(fmt.Sprintf("    AdvDefaultLifetime %d;\n", r.DefaultLifetime))
 
-	if r.Dhcp {
-		config.WriteString("    AdvManagedFlag on;\n")
-		config.WriteString("    AdvOtherConfigFlag on;\n")
+	if r.DefaultPreference != "" {
+		conf.WriteString(fmt.Sprintf("    AdvDefaultPreference %s;\n", r.DefaultPreference))
+	}
+	if r.LinkMTU != 0 {
+		conf.WriteString(fmt.Sprintf("    AdvLinkMTU %d;\n", r.LinkMTU))
+	}
+	if r.ReachableTime != 0 {
+		conf.WriteString(fmt.Sprintf("    AdvReachableTime %d;\n", r.ReachableTime))
+	}
+	if r.RetransTimer != 0 {
+		conf.WriteString(fmt.Sprintf("    AdvRetransTimer %d;\n", r.RetransTimer))
+	}
+	if r.CurHopLimit != nil {
+		conf.WriteString(fmt.Sprintf("    AdvCurHopLimit %d;\n", *r.CurHopLimit))
+	}
+	if r.HomeAgent {
+		conf.WriteString("    AdvHomeAgentFlag on;\n")
+	}
+	if r.SourceLLAddress != nil {
+		conf.WriteString(fmt.Sprintf("    AdvSourceLLAddress %s;\n", boolToOnOff(*r.SourceLLAddress)))
 	}
 
+	// Managed addresses imply other configuration from DHCPv6 as well
+	switch r.DHCPv6 {
+	case config.DHCPv6Stateful:
+		conf.WriteString("    AdvManagedFlag on;\n")
+		conf.WriteString("    AdvOtherConfigFlag on;\n")
+	case config.DHCPv6Stateless:
+		conf.WriteString("    AdvOtherConfigFlag on;\n")
+	}
+
+	// Limit the source addresses and the receivers of advertisements
+	writeAddressList(&conf, "AdvRASrcAddress", r.RASrcAddress)
+	writeAddressList(&conf, "clients", r.Clients)
+
 	// Add prefixes
 	for _, prefix := range r.Prefixes {
-		config.WriteString(fmt.Sprintf("    prefix %s {\n", prefix.Prefix))
-		config.WriteString(fmt.Sprintf("        AdvOnLink %s;\n", boolToOnOff(prefix.OnLink)))
-		config.WriteString(fmt.Sprintf("        AdvAutonomous %s;\n", boolToOnOff(prefix.Autonomous)))
-		config.WriteString(fmt.Sprintf("        AdvRouterAddr %s;\n", boolToOnOff(prefix.RouterAddr)))
+		conf.WriteString(fmt.Sprintf("    prefix %s {\n", prefix.Prefix))
+		conf.WriteString(fmt.Sprintf("        AdvOnLink %s;\n", boolToOnOff(prefix.OnLink)))
+		conf.WriteString(fmt.Sprintf("        AdvAutonomous %s;\n", boolToOnOff(prefix.Autonomous)))
+		conf.WriteString(fmt.Sprintf("        AdvRouterAddr %s;\n", boolToOnOff(prefix.RouterAddr)))
 
 		// Only include lifetime settings if they differ from defaults
 		if prefix.ValidLifetime != 1800 {
-			config.WriteString(fmt.Sprintf("        AdvValidLifetime %d;\n", prefix.ValidLifetime))
+			conf.WriteString(fmt.Sprintf("        AdvValidLifetime %d;\n", prefix.ValidLifetime))
 		}
 		if prefix.PreferredLifetime != 900 {
-			config.WriteString(fmt.Sprintf("        AdvPreferredLifetime %d;\n", prefix.PreferredLifetime))
+			conf.WriteString(fmt.Sprintf("        AdvPreferredLifetime %d;\n", prefix.PreferredLifetime))
 		}
 
-		config.WriteString("    };\n")
+		conf.WriteString("    };\n")
 	}
 
 	// Add manual routes (one-liner format)
 	for _, route := range r.Routes {
-		config.WriteString(fmt.Sprintf("    route %s { AdvRoutePreference %s; AdvRouteLifetime %d; };\n",
+		conf.WriteString(fmt.Sprintf("    route %s { AdvRoutePreference %s; AdvRouteLifetime %d; };\n",
 			route.Prefix, route.Preference, route.Lifetime))
 	}
 
 	// Add auto-generated routes from netmap6 (one-liner format)
 	if len(r.AutoRoutes) > 0 {
-		config.WriteString("    # Auto-generated routes from netmap6\n")
+		conf.WriteString("    # Auto-generated routes from netmap6\n")
 		for _, route := range r.AutoRoutes {
-			config.WriteString(fmt.Sprintf("    route %s { AdvRoutePreference %s; AdvRouteLifetime %d; };\n",
+			conf.WriteString(fmt.Sprintf("    route %s { AdvRoutePreference %s; AdvRouteLifetime %d; };\n",
 				route.Prefix, route.Preference, route.Lifetime))
 		}
 	}
 
+	// Add withdrawn prefixes and routes until the withdraw period is over
+	if len(r.WithdrawnPrefixes) > 0 || len(r.WithdrawnRoutes) > 0 {
+		conf.WriteString("    # Withdrawn, no longer configured\n")
+		for _, prefix := range r.WithdrawnPrefixes {
+			conf.WriteString(fmt.Sprintf("    prefix %s {\n", prefix.Prefix))
+			conf.WriteString(fmt.Sprintf("        AdvOnLink %s;\n", boolToOnOff(prefix.OnLink)))
+			conf.WriteString(fmt.Sprintf("        AdvAutonomous %s;\n", boolToOnOff(prefix.Autonomous)))
+			conf.WriteString(fmt.Sprintf("        AdvValidLifetime %d;\n", prefix.ValidLifetime))
+			conf.WriteString("        AdvPreferredLifetime 0;\n")
+			conf.WriteString("    };\n")
+		}
+		for _, route := range r.WithdrawnRoutes {
+			conf.WriteString(fmt.Sprintf("    route %s { AdvRoutePreference %s; AdvRouteLifetime 0; };\n",
+				route.Prefix, route.Preference))
+		}
+	}
+
 	// Add RDNSS entries
 	for _, rdnss := range r.RDNSS {
 		if len(rdnss.Servers) > 0 {
-			config.WriteString("    RDNSS")
+			conf.WriteString("    RDNSS")
 			for _, server := range rdnss.Servers {
-				config.WriteString(fmt.Sprintf(" %s", server))
+				conf.WriteString(fmt.Sprintf(" %s", server))
 			}
-			config.WriteString(fmt.Sprintf(" { AdvRDNSSLifetime %d; };\n", rdnss.Lifetime))
+			conf.WriteString(fmt.Sprintf(" { AdvRDNSSLifetime %d; };\n", rdnss.Lifetime))
+		}
+	}
+
+	// Add DNSSL entries
+	for _, dnssl := range r.DNSSL {
+		if len(dnssl.Domains) > 0 {
+			conf.WriteString(fmt.Sprintf("    DNSSL %s { AdvDNSSLLifetime %d; };\n",
+				strings.Join(dnssl.Domains, " "), dnssl.Lifetime))
+		}
+	}
+
+	// Add the NAT64 prefix (PREF64)
+	if r.Nat64Prefix != nil {
+		conf.WriteString(fmt.Sprintf("    nat64prefix %s { AdvValidLifetime %d; };\n",
+			r.Nat64Prefix.Prefix, r.Nat64Prefix.Lifetime))
+	}
+
+	conf.WriteString("};\n\n")
+
+	return conf.String()
+}
+
+// State is what was advertised on each interface
+type State struct {
+	Interfaces map[string]*InterfaceState `json:"interfaces"`
+}
+
+// InterfaceState lists the prefixes and routes advertised on an interface.
+// Withdrawn is the time an entry was removed from the configuration.
+type InterfaceState struct {
+	Prefixes       []AdvertisedPrefix `json:"prefixes,omitempty"`
+	Routes         []AdvertisedRoute  `json:"routes,omitempty"`
+	WithdrawPeriod *int               `json:"withdraw-period,omitempty"` // of the configuration, for when it is removed
+}
+
+type AdvertisedPrefix struct {
+	Prefix        string     `json:"prefix"`
+	OnLink        bool       `json:"on-link"`
+	Autonomous    bool       `json:"auto"`
+	ValidLifetime int        `json:"valid-lifetime"`
+	Withdrawn     *time.Time `json:"withdrawn,omitempty"`
+}
+
+type AdvertisedRoute struct {
+	Prefix     string     `json:"prefix"`
+	Preference string     `json:"preference"`
+	Withdrawn  *time.Time `json:"withdrawn,omitempty"`
+}
+
+// LoadState reads the state file, a missing file is an empty state. The
+// empty state is returned along with any error.
+func LoadState(path string) (*State, error) {
+	state := &State{Interfaces: make(map[string]*InterfaceState)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read radv state: %v", err)
+	}
+
+	var loaded State
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return state, fmt.Errorf("failed to parse radv state %s: %v", path, err)
+	}
+	if loaded.Interfaces != nil {
+		state = &loaded
+	}
+	return state, nil
+}
+
+// Save writes the state file
+func (s *State) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Interface returns what was advertised on an interface, nil if nothing
+func (s *State) Interface(name string) *InterfaceState {
+	if s == nil {
+		return nil
+	}
+	return s.Interfaces[name]
+}
+
+// Withdraw returns a copy of the configuration that also advertises what
+// previous lists and the configuration no longer contains: prefixes with
+// a zero preferred lifetime and routes with a zero lifetime, until the
+// withdraw period since their removal is over. The returned state is what
+// the copy advertises.
+func (r *RadvConfig) Withdraw(previous *InterfaceState, now time.Time) (*RadvConfig, *InterfaceState) {
+	withdrawn := *r
+	withdrawn.WithdrawnPrefixes = nil
+	withdrawn.WithdrawnRoutes = nil
+
+	period := r.WithdrawPeriod
+	state := &InterfaceState{WithdrawPeriod: &period}
+	advertised := make(map[string]bool)
+
+	for _, prefix := range r.Prefixes {
+		advertised[prefixKey(prefix.Prefix)] = true
+		state.Prefixes = append(state.Prefixes, AdvertisedPrefix{
+			Prefix:        prefix.Prefix,
+			OnLink:        prefix.OnLink,
+			Autonomous:    prefix.Autonomous,
+			ValidLifetime: prefix.ValidLifetime,
+		})
+	}
+	for _, route := range append(append([]RouteConfig{}, r.Routes...), r.AutoRoutes...) {
+		// Routes live in their own namespace, a route may match a prefix
+		advertised["route "+prefixKey(route.Prefix)] = true
+		state.Routes = append(state.Routes, AdvertisedRoute{Prefix: route.Prefix, Preference: route.Preference})
+	}
+
+	if previous == nil {
+		return &withdrawn, state
+	}
+
+	for _, prefix := range previous.Prefixes {
+		key := prefixKey(prefix.Prefix)
+		removed, ok := r.withdrawing(prefix.Withdrawn, now)
+		if advertised[key] || !ok {
+			continue
+		}
+		advertised[key] = true
+
+		// Addresses of the prefix stay valid for the rest of the period at most
+		validLifetime := prefix.ValidLifetime
+		if validLifetime > r.WithdrawPeriod {
+			validLifetime = r.WithdrawPeriod
 		}
+		withdrawn.WithdrawnPrefixes = append(withdrawn.WithdrawnPrefixes, PrefixConfig{
+			Prefix:        prefix.Prefix,
+			OnLink:        prefix.OnLink,
+			Autonomous:    prefix.Autonomous,
+			ValidLifetime: validLifetime,
+		})
+		prefix.Withdrawn = &removed
+		state.Prefixes = append(state.Prefixes, prefix)
 	}
 
-	config.WriteString("};\n\n")
+	for _, route := range previous.Routes {
+		key := "route " + prefixKey(route.Prefix)
+		removed, ok := r.withdrawing(route.Withdrawn, now)
+		if advertised[key] || !ok {
+			continue
+		}
+		advertised[key] = true
+
+		withdrawn.WithdrawnRoutes = append(withdrawn.WithdrawnRoutes, RouteConfig{
+			Prefix:     route.Prefix,
+			Preference: route.Preference,
+		})
+		route.Withdrawn = &removed
+		state.Routes = append(state.Routes, route)
+	}
+
+	return &withdrawn, state
+}
 
-	return config.String()
+// Withdrawal returns the configuration of an interface whose link or radv
+// section was removed. It advertises only what previous still withdraws,
+// with a zero router lifetime so that clients drop the default route.
+// Both are nil once the withdraw period is over.
+func Withdrawal(previous *InterfaceState, now time.Time) (*RadvConfig, *InterfaceState) {
+	r := &RadvConfig{
+		Enabled:        true,
+		MinAdvInterval: 30,
+		MaxAdvInterval: 60,
+		WithdrawPeriod: config.DefaultWithdrawPeriod,
+	}
+	if previous.WithdrawPeriod != nil {
+		r.WithdrawPeriod = *previous.WithdrawPeriod
+	}
+
+	withdrawn, state := r.Withdraw(previous, now)
+	if len(withdrawn.WithdrawnPrefixes) == 0 && len(withdrawn.WithdrawnRoutes) == 0 {
+		return nil, nil
+	}
+	return withdrawn, state
+}
+
+// withdrawing returns when an entry was removed, now if it just was, and
+// whether that is less than the withdraw period ago
+func (r *RadvConfig) withdrawing(since *time.Time, now time.Time) (time.Time, bool) {
+	removed := now
+	if since != nil {
+		removed = *since
+	}
+	return removed, now.Sub(removed) < time.Duration(r.WithdrawPeriod)*time.Second
+}
+
+// prefixKey compares prefixes regardless of how they are written
+func prefixKey(value string) string {
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		return prefix.Masked().String()
+	}
+	return value
+}
+
+// writeAddressList renders a block of addresses such as clients
+func writeAddressList(config *strings.Builder, name string, addresses []string) {
+	if len(addresses) == 0 {
+		return
+	}
+	config.WriteString(fmt.Sprintf("    %s {\n", name))
+	for _, address := range addresses {
+		config.WriteString(fmt.Sprintf("        %s;\n", address))
+	}
+	config.WriteString("    };\n")
 }
 
 func boolToOnOff(b bool) string {
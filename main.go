@@ -4,14 +4,26 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"natman/config"
 	"natman/link"
+	"natman/link/failover"
+	"natman/worker/backend"
 	configmaker "natman/worker/config-maker"
+	configwatcher "natman/worker/config-watcher"
+	failovermanager "natman/worker/failover-manager"
+	iptablesmanager "natman/worker/iptables-manager"
+	linkmonitor "natman/worker/link-monitor"
 	natmanager "natman/worker/nat-manager"
+	nat64manager "natman/worker/nat64-manager"
 	netmapmanager "natman/worker/netmap-manager"
+	nftmanager "natman/worker/nft-manager"
+	rasender "natman/worker/ra-sender"
 	radvdmanager "natman/worker/radvd-manager"
+	routemanager "natman/worker/route-manager"
 )
 
 // Global debug flag
@@ -23,6 +35,13 @@ func SetDebug(debug bool) {
 
 	// Also set debug for component managers
 	netmapmanager.SetDebug(debug)
+	iptablesmanager.SetDebug(debug)
+	configwatcher.SetDebug(debug)
+	linkmonitor.SetDebug(debug)
+	routemanager.SetDebug(debug)
+	failovermanager.SetDebug(debug)
+	nat64manager.SetDebug(debug)
+	rasender.SetDebug(debug)
 }
 
 // DebugPrint prints a message if debug mode is enabled
@@ -38,6 +57,8 @@ func main() {
 	var slim bool = false                             // default
 	var quiet bool = false                            // default
 	var debug bool = false                            // default
+	var jsonOutput bool = false                       // default
+	var interval = defaultReconcileInterval           // default
 	var command string
 
 	// Parse arguments manually
@@ -60,6 +81,16 @@ func main() {
 			quiet = true
 		} else if arg == "--debug" || arg == "-d" {
 			debug = true
+		} else if strings.HasPrefix(arg, "--interval=") {
+			value := strings.TrimPrefix(arg, "--interval=")
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed <= 0 {
+				fmt.Printf("Error: invalid interval '%s'\n", value)
+				os.Exit(1)
+			}
+			interval = parsed
+		} else if arg == "--json" {
+			jsonOutput = true
 		} else if arg == "-h" || arg == "--help" {
 			showHelp()
 			return
@@ -101,19 +132,25 @@ func main() {
 		}
 		return
 	case "show-netmap":
-		if err := runShowNetmap(); err != nil {
+		if err := runShowNetmap(configPath); err != nil {
 			fmt.Printf("Error showing netmap rules: %v\n", err)
 			os.Exit(1)
 		}
 		return
 	case "show-nat":
-		if err := runShowNat(); err != nil {
+		if err := runShowNat(configPath); err != nil {
 			fmt.Printf("Error showing NAT rules: %v\n", err)
 			os.Exit(1)
 		}
 		return
+	case "show-nft":
+		if err := runShowNft(); err != nil {
+			fmt.Printf("Error showing nftables rules: %v\n", err)
+			os.Exit(1)
+		}
+		return
 	case "capture-rules":
-		if err := runCaptureRules(); err != nil {
+		if err := runCaptureRules(configPath); err != nil {
 			fmt.Printf("Error capturing rules: %v\n", err)
 			os.Exit(1)
 		}
@@ -124,6 +161,22 @@ func main() {
 			os.Exit(1)
 		}
 		return
+	case "plan":
+		changes, err := runPlan(configPath, jsonOutput)
+		if err != nil {
+			fmt.Printf("Error computing plan: %v\n", err)
+			os.Exit(1)
+		}
+		if changes {
+			os.Exit(exitChangesPending)
+		}
+		return
+	case "daemon":
+		if err := runDaemon(configPath, interval, quiet); err != nil {
+			fmt.Printf("Error in daemon: %v\n", err)
+			os.Exit(1)
+		}
+		return
 	case "":
 		// No command provided, proceed with normal flow
 		break
@@ -151,6 +204,8 @@ func showHelp() {
 	fmt.Println("    -c, --c=PATH     Configuration file path (default: /etc/natman/config.yaml)")
 	fmt.Println("    -q, --quiet      Suppress non-essential output")
 	fmt.Println("    -d, --debug      Enable debug output")
+	fmt.Println("        --json       Machine-readable output (plan)")
+	fmt.Println("        --interval=D Time between drift checks (daemon, default 60s)")
 	fmt.Println("    -h, --help       Show this help message")
 	fmt.Println("")
 	fmt.Println("COMMANDS:")
@@ -158,8 +213,12 @@ func showHelp() {
 	fmt.Println("                     Use --slim to generate minimal configuration")
 	fmt.Println("    status           Show current system status and configuration")
 	fmt.Println("    validate         Validate configuration file")
+	fmt.Println("    plan             Show rule and radvd changes without applying them")
+	fmt.Println("                     Exits with 2 when changes are pending")
+	fmt.Println("    daemon           Apply configuration and keep correcting drift")
 	fmt.Println("    show-netmap      Display current NETMAP rules")
 	fmt.Println("    show-nat         Display current NAT rules")
+	fmt.Println("    show-nft         Display the natman nftables tables")
 	fmt.Println("    show-radvd       Display current radvd settings and routes")
 	fmt.Println("    capture-rules    Capture and display all current rules")
 	fmt.Println("")
@@ -168,6 +227,7 @@ func showHelp() {
 	fmt.Println("    natman config-capture                    # Generate config from system")
 	fmt.Println("    natman config-capture --slim             # Generate minimal config")
 	fmt.Println("    natman -c /path/to/config.yaml validate  # Validate custom config")
+	fmt.Println("    natman plan --json                       # Show pending changes as JSON")
 	fmt.Println("    natman status --quiet                    # Check status quietly")
 }
 
@@ -219,7 +279,11 @@ func runStatus(configPath string) error {
 	}
 
 	// Build links
-	links := link.BuildLinks(cfg)
+	links, err := link.BuildLinks(cfg)
+	if err != nil {
+		fmt.Printf("\nConfiguration problems:\n%v\n", err)
+	}
+	printWarnings(links)
 
 	// Print netmap status if function exists
 	fmt.Println("\nNETMAP Status:")
@@ -227,6 +291,9 @@ func runStatus(configPath string) error {
 		fmt.Printf("  Error displaying NETMAP rules: %v\n", err)
 	}
 
+	fmt.Println("\nPort Forwards:")
+	printPortForwards(cfg, links)
+
 	// Check radvd status
 	fmt.Println("\nRadvd Service Status:")
 	active, err := radvdmanager.GetRadvdStatus()
@@ -243,6 +310,61 @@ func runStatus(configPath string) error {
 	return nil
 }
 
+// printPortForwards lists the configured port forwards and whether their
+// rules are in place, a forward is pending when the backend would add it
+func printPortForwards(cfg *config.Config, links map[string]*link.Link) {
+	var names []string
+	for name, linkObj := range links {
+		if len(linkObj.PortForwards) > 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		fmt.Println("  No port forwards configured")
+		return
+	}
+	sort.Strings(names)
+
+	natmanager.SetQuietMode(true)
+	nftmanager.SetQuietMode(true)
+
+	var pending []string
+	fw, err := backend.New(cfg.Network.Backend, links)
+	if err == nil {
+		var plan *backend.Plan
+		if plan, err = fw.Plan(links); err == nil {
+			pending = plan.Add
+		}
+	}
+	if err != nil {
+		fmt.Printf("  Error checking port forward rules: %v\n", err)
+	}
+
+	for _, name := range names {
+		for _, forward := range links[name].PortForwards {
+			state := "active"
+			tag := iptablesmanager.NewTag(name, iptablesmanager.FeaturePortForward, forward.Name()).String()
+			switch {
+			case err != nil:
+				state = "unknown"
+			case containsTag(pending, tag):
+				state = "pending"
+			}
+			fmt.Printf("  %s: %s [%s]\n", name, forward, state)
+		}
+	}
+}
+
+// containsTag reports whether one of the rules carries the tag
+func containsTag(rules []string, tag string) bool {
+	for _, rule := range rules {
+		if strings.Contains(rule, "\""+tag+"\"") {
+			return true
+		}
+	}
+	return false
+}
+
 func runValidate(configPath string) error {
 	fmt.Println("Validating configuration...")
 
@@ -251,15 +373,35 @@ func runValidate(configPath string) error {
 		return fmt.Errorf("config file not found: %s", configPath)
 	}
 
-	// Parse config
-	_, err := config.ParseConfig(configPath)
+	// Parse and check the config against the schema
+	cfg, err := config.LoadConfig(configPath)
 	if err != nil {
+		if errs, ok := err.(config.ValidationErrors); ok {
+			fmt.Printf("Problems in %s:\n", configPath)
+			for _, e := range errs {
+				fmt.Printf("  %v\n", e)
+			}
+			return fmt.Errorf("%d problem(s) found", len(errs))
+		}
 		return fmt.Errorf("config validation failed: %v", err)
 	}
 
-	// Validate radvd config if it exists
-	if err := radvdmanager.ValidateRadvdConfig(); err != nil {
-		fmt.Printf("Warning: radvd config validation failed: %v\n", err)
+	// Build the link model to find conflicting mappings
+	links, err := link.BuildLinks(cfg)
+	printWarnings(links)
+	if err != nil {
+		fmt.Printf("Link configuration problems in %s:\n", configPath)
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Printf("  %s\n", line)
+		}
+		return fmt.Errorf("link configuration is invalid")
+	}
+
+	// Check the radvd config an apply would install
+	if cfg.Network.RASender != config.RASenderBuiltin {
+		if err := radvdmanager.ValidateGeneratedConfig(links); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
 	}
 
 	fmt.Println("Configuration is valid")
@@ -278,9 +420,9 @@ func runNormalFlow(configPath string, quiet bool) error {
 
 	// Parse config file
 	DebugPrint("Parsing config file: %s", configPath)
-	cfg, err := config.ParseConfig(configPath)
+	cfg, err := config.LoadConfig(configPath)
 	if err != nil {
-		return fmt.Errorf("failed to parse config: %v", err)
+		return fmt.Errorf("invalid config %s:\n%v", configPath, err)
 	}
 
 	// Validate config has links
@@ -294,20 +436,34 @@ func runNormalFlow(configPath string, quiet bool) error {
 	DebugPrint("Configuration loaded with %d links", len(cfg.Network.Links))
 
 	// Build the link model
-	links := link.BuildLinks(cfg)
+	links, err := link.BuildLinks(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid link configuration:\n%v", err)
+	}
+	printWarnings(links)
 	if len(links) == 0 {
 		return fmt.Errorf("no valid links found after building link models")
 	}
 	if !quiet {
 		fmt.Println("Built link models")
 	}
+
+	// A running daemon saves the outcome of its health checks, without it
+	// the primary members are active
+	failoverState, err := failovermanager.LoadState(failovermanager.StatePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v, assuming the primary members are active\n", err)
+	}
+	links = failovermanager.Effective(links, failover.BuildGroups(cfg), failoverState)
 	DebugPrint("Built link models with %d links", len(links))
 
 	// Dump link configuration in debug mode
 	if Debug {
-		for name, linkObj := range links {
+		for _, name := range link.SortedNames(links) {
+			linkObj := links[name]
 			DebugPrint("Link: %s", name)
-			for netmapName, netmapObj := range linkObj.Netmap6 {
+			for _, netmapName := range linkObj.Netmap6Names() {
+				netmapObj := linkObj.Netmap6[netmapName]
 				DebugPrint("  Netmap6: %s (enabled: %t)", netmapName, netmapObj.Enabled)
 				DebugPrint("    PfxPub: %s", netmapObj.PfxPub)
 				DebugPrint("    PfxPriv: %s", netmapObj.PfxPriv)
@@ -321,45 +477,59 @@ func runNormalFlow(configPath string, quiet bool) error {
 
 	// Set quiet mode for component managers
 	natmanager.SetQuietMode(quiet)
+	nftmanager.SetQuietMode(quiet)
 
-	// Run natmaker (NAT44/NAT66 configuration)
-	if !quiet {
-		fmt.Println("Applying NAT rules...")
-	}
-	DebugPrint("Applying NAT rules")
-	if err := natmanager.ApplyNatRules(links); err != nil {
-		return fmt.Errorf("failed to apply NAT rules: %v", err)
-	}
-	if !quiet {
-		fmt.Println("NAT rules applied successfully")
+	// Select the packet filter backend
+	fw, err := backend.New(cfg.Network.Backend, links)
+	if err != nil {
+		return fmt.Errorf("failed to select backend: %v", err)
 	}
-	DebugPrint("NAT rules applied successfully")
+	DebugPrint("Using %s backend", fw.Name())
 
-	// Run netmapmaker (IPv6 network mapping)
+	// Apply NAT44/NAT66 and netmap rules
 	if !quiet {
-		fmt.Println("Applying netmap rules...")
+		fmt.Printf("Applying NAT and netmap rules (%s backend)...\n", fw.Name())
 	}
-	DebugPrint("Applying netmap rules")
-	if err := netmapmanager.ApplyNetmapRules(links); err != nil {
-		return fmt.Errorf("failed to apply netmap rules: %v", err)
+	DebugPrint("Applying NAT and netmap rules")
+	if err := fw.Apply(links); err != nil {
+		return err
 	}
 	if !quiet {
-		fmt.Println("Netmap rules applied successfully")
+		fmt.Println("NAT and netmap rules applied successfully")
 	}
-	DebugPrint("Netmap rules applied successfully")
+	DebugPrint("NAT and netmap rules applied successfully")
 
-	// Run radvdmaker (Router Advertisement configuration)
-	if !quiet {
-		fmt.Println("Updating radvd configuration...")
+	// Policy routing of origins with a routing table
+	DebugPrint("Applying policy routing")
+	if err := routemanager.ApplyRoutes(links); err != nil {
+		return fmt.Errorf("failed to apply policy routing: %v", err)
 	}
-	DebugPrint("Updating radvd configuration")
-	if err := radvdmanager.CreateRadvdConfig(links); err != nil {
-		return fmt.Errorf("failed to update radvd config: %v", err)
+
+	// NAT64 translator and DNS64 configuration
+	DebugPrint("Updating NAT64 configuration")
+	if err := nat64manager.ApplyNat64Config(links); err != nil {
+		return fmt.Errorf("failed to update NAT64 config: %v", err)
 	}
-	if !quiet {
-		fmt.Println("Radvd configuration updated successfully")
+
+	// Run radvdmaker (Router Advertisement configuration). The built-in
+	// sender needs a running process, radvd.conf is left alone then.
+	if cfg.Network.RASender == config.RASenderBuiltin {
+		if !quiet {
+			fmt.Println("Router advertisements are sent by the natman daemon (ra-sender: builtin), not updating radvd")
+		}
+	} else {
+		if !quiet {
+			fmt.Println("Updating radvd configuration...")
+		}
+		DebugPrint("Updating radvd configuration")
+		if err := radvdmanager.CreateRadvdConfig(links); err != nil {
+			return fmt.Errorf("failed to update radvd config: %v", err)
+		}
+		if !quiet {
+			fmt.Println("Radvd configuration updated successfully")
+		}
+		DebugPrint("Radvd configuration updated successfully")
 	}
-	DebugPrint("Radvd configuration updated successfully")
 
 	if !quiet {
 		fmt.Println("All configurations applied successfully!")
@@ -368,18 +538,48 @@ func runNormalFlow(configPath string, quiet bool) error {
 	return nil
 }
 
-func runShowNetmap() error {
+// printWarnings reports deprecated forms in the config on stderr, where
+// they stay out of the output of plan --json
+func printWarnings(links map[string]*link.Link) {
+	for _, warning := range link.Warnings(links) {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+}
+
+func runShowNetmap(configPath string) error {
 	fmt.Println("Showing current netmap rules from system...")
-	return netmapmanager.PrintCurrentNetmapRules()
+	return netmapmanager.PrintCurrentNetmapRules(loadLinksForAttribution(configPath))
 }
 
-func runShowNat() error {
+func runShowNat(configPath string) error {
 	fmt.Println("Showing current NAT rules from system...")
-	return natmanager.PrintCurrentNatRules()
+	return natmanager.PrintCurrentNatRules(loadLinksForAttribution(configPath))
 }
 
-func runCaptureRules() error {
+// loadLinksForAttribution builds the link model used to attribute live rules
+// back to the config. Rules are still shown when the config cannot be loaded.
+func loadLinksForAttribution(configPath string) map[string]*link.Link {
+	cfg, err := config.ParseConfig(configPath)
+	if err != nil {
+		DebugPrint("Could not load config for rule attribution: %v", err)
+		return make(map[string]*link.Link)
+	}
+
+	links, err := link.BuildLinks(cfg)
+	if err != nil {
+		DebugPrint("Config problems while building links for attribution: %v", err)
+	}
+	return links
+}
+
+func runShowNft() error {
+	fmt.Println("Showing current natman nftables tables from system...")
+	return nftmanager.PrintCurrentNftRules()
+}
+
+func runCaptureRules(configPath string) error {
 	fmt.Println("Capturing current rules from system...")
+	links := loadLinksForAttribution(configPath)
 
 	// Capture netmap rules
 	fmt.Println("\nCapturing NETMAP rules...")
@@ -388,11 +588,22 @@ func runCaptureRules() error {
 		return fmt.Errorf("failed to capture netmap rules: %v", err)
 	}
 
-	fmt.Println("NETMAP rules by interface:")
-	for iface, rules := range netmapRules {
-		fmt.Printf("  Interface %s: %d rules\n", iface, len(rules))
-		for _, rule := range rules {
-			fmt.Printf("    %s\n", rule)
+	fmt.Println("NETMAP rules by link and set:")
+	for _, linkName := range sortedKeys(netmapRules) {
+		sets := netmapRules[linkName]
+		fmt.Printf("  Link %s%s:\n", linkName, configNote(links, linkName))
+		for _, setName := range sortedKeys(sets) {
+			rules := sets[setName]
+			note := ""
+			if linkObj, ok := links[linkName]; ok {
+				if _, ok := linkObj.Netmap6[setName]; !ok {
+					note = " (not in config)"
+				}
+			}
+			fmt.Printf("    Set %s%s: %d rules\n", setName, note, len(rules))
+			for _, rule := range rules {
+				fmt.Printf("      %s\n", rule)
+			}
 		}
 	}
 
@@ -405,9 +616,10 @@ func runCaptureRules() error {
 
 	fmt.Println("NAT rules:")
 	if ipv4Rules, ok := natRules["ipv4"].(map[string][]string); ok {
-		fmt.Println("  IPv4 rules by interface:")
-		for iface, rules := range ipv4Rules {
-			fmt.Printf("    Interface %s: %d rules\n", iface, len(rules))
+		fmt.Println("  IPv4 rules by link:")
+		for _, linkName := range sortedKeys(ipv4Rules) {
+			rules := ipv4Rules[linkName]
+			fmt.Printf("    Link %s%s: %d rules\n", linkName, configNote(links, linkName), len(rules))
 			for _, rule := range rules {
 				fmt.Printf("      %s\n", rule)
 			}
@@ -415,9 +627,10 @@ func runCaptureRules() error {
 	}
 
 	if ipv6Rules, ok := natRules["ipv6"].(map[string][]string); ok {
-		fmt.Println("  IPv6 rules by interface:")
-		for iface, rules := range ipv6Rules {
-			fmt.Printf("    Interface %s: %d rules\n", iface, len(rules))
+		fmt.Println("  IPv6 rules by link:")
+		for _, linkName := range sortedKeys(ipv6Rules) {
+			rules := ipv6Rules[linkName]
+			fmt.Printf("    Link %s%s: %d rules\n", linkName, configNote(links, linkName), len(rules))
 			for _, rule := range rules {
 				fmt.Printf("      %s\n", rule)
 			}
@@ -427,6 +640,24 @@ func runCaptureRules() error {
 	return nil
 }
 
+// sortedKeys returns the keys of captured rules in sorted order
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// configNote flags links found in rule tags that are missing from the config
+func configNote(links map[string]*link.Link, linkName string) string {
+	if _, ok := links[linkName]; ok {
+		return ""
+	}
+	return " (not in config)"
+}
+
 func runShowRadvd() error {
 	fmt.Println("Showing current radvd settings with focus on routes...")
 
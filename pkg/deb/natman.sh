@@ -31,6 +31,12 @@ fi
 # Get interface name from environment
 INTERFACE="${IFACE:-unknown}"
 
+# The daemon re-applies links itself and owns the failover state
+if systemctl is-active --quiet natman-daemon; then
+    log "natman-daemon is running, leaving interface $INTERFACE to it"
+    exit 0
+fi
+
 log "Interface $INTERFACE became routable, triggering natman configuration"
 
 # Apply natman configuration with error handling
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"natman/config"
+	"natman/link"
+	"natman/link/failover"
+	"natman/worker/backend"
+	failovermanager "natman/worker/failover-manager"
+	natmanager "natman/worker/nat-manager"
+	nat64manager "natman/worker/nat64-manager"
+	nftmanager "natman/worker/nft-manager"
+	radvdmanager "natman/worker/radvd-manager"
+	routemanager "natman/worker/route-manager"
+)
+
+// Exit code returned by `natman plan` when applying the config would change the system
+const exitChangesPending = 2
+
+// PlanResult is the JSON document printed by `natman plan --json`
+type PlanResult struct {
+	Backend string                   `json:"backend"`
+	Rules   PlanRules                `json:"rules"`
+	Routes  PlanRules                `json:"routes"`
+	Nat64   []*nat64manager.FilePlan `json:"nat64"`
+	Radvd   *radvdmanager.RadvdPlan  `json:"radvd"` // null with the built-in RA sender
+	Changes bool                     `json:"changes"`
+}
+
+// PlanRules lists the rules (or ip commands) an apply would add and remove
+type PlanRules struct {
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// runPlan computes what a normal run would change without executing anything.
+// It returns true when changes are pending.
+func runPlan(configPath string, asJSON bool) (bool, error) {
+	// Check if config file exists
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		return false, fmt.Errorf("config file not found: %s", configPath)
+	}
+
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		return false, fmt.Errorf("invalid config %s:\n%v", configPath, err)
+	}
+
+	links, err := link.BuildLinks(cfg)
+	if err != nil {
+		return false, fmt.Errorf("invalid link configuration:\n%v", err)
+	}
+	printWarnings(links)
+	if len(links) == 0 {
+		return false, fmt.Errorf("no valid links found after building link models")
+	}
+
+	// A running daemon saves the outcome of its health checks, without it
+	// the primary members are active. Warnings go to stderr, stdout only
+	// carries the plan.
+	failoverState, err := failovermanager.LoadState(failovermanager.StatePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v, assuming the primary members are active\n", err)
+	}
+	links = failovermanager.Effective(links, failover.BuildGroups(cfg), failoverState)
+
+	// The managers list the live rules while staging, keep that out of the plan
+	natmanager.SetQuietMode(true)
+	nftmanager.SetQuietMode(true)
+
+	fw, err := backend.New(cfg.Network.Backend, links)
+	if err != nil {
+		return false, fmt.Errorf("failed to select backend: %v", err)
+	}
+
+	rules, err := fw.Plan(links)
+	if err != nil {
+		return false, err
+	}
+
+	routesAdd, routesRemove, err := routemanager.PlanRoutes(links)
+	if err != nil {
+		return false, err
+	}
+
+	nat64 := nat64manager.PlanNat64Config(links)
+	nat64Changed := false
+	for _, file := range nat64 {
+		nat64Changed = nat64Changed || file.Changed
+	}
+
+	// The built-in sender has no configuration file to compare
+	var radvd *radvdmanager.RadvdPlan
+	if cfg.Network.RASender != config.RASenderBuiltin {
+		radvd = radvdmanager.PlanRadvdConfig(links)
+	}
+
+	result := PlanResult{
+		Backend: rules.Backend,
+		Rules:   PlanRules{Add: rules.Add, Remove: rules.Remove},
+		Routes:  PlanRules{Add: routesAdd, Remove: routesRemove},
+		Nat64:   nat64,
+		Radvd:   radvd,
+		Changes: rules.Changed() || len(routesAdd) > 0 || len(routesRemove) > 0 || nat64Changed || (radvd != nil && radvd.Changed),
+	}
+
+	if asJSON {
+		// Emit empty lists rather than null for consumers
+		if result.Rules.Add == nil {
+			result.Rules.Add = []string{}
+		}
+		if result.Rules.Remove == nil {
+			result.Rules.Remove = []string{}
+		}
+		if result.Routes.Add == nil {
+			result.Routes.Add = []string{}
+		}
+		if result.Routes.Remove == nil {
+			result.Routes.Remove = []string{}
+		}
+		if result.Nat64 == nil {
+			result.Nat64 = []*nat64manager.FilePlan{}
+		}
+
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return false, fmt.Errorf("failed to encode plan: %v", err)
+		}
+		fmt.Println(string(data))
+		return result.Changes, nil
+	}
+
+	printPlan(result)
+	return result.Changes, nil
+}
+
+func printPlan(result PlanResult) {
+	fmt.Printf("Plan (%s backend):\n", result.Backend)
+	fmt.Println("==================")
+
+	fmt.Printf("\nRules to remove (%d):\n", len(result.Rules.Remove))
+	for _, rule := range result.Rules.Remove {
+		fmt.Printf("  - %s\n", rule)
+	}
+
+	fmt.Printf("\nRules to add (%d):\n", len(result.Rules.Add))
+	for _, rule := range result.Rules.Add {
+		fmt.Printf("  + %s\n", rule)
+	}
+
+	if len(result.Routes.Add) > 0 || len(result.Routes.Remove) > 0 {
+		fmt.Println("\nPolicy routing:")
+		for _, command := range result.Routes.Remove {
+			fmt.Printf("  - %s\n", command)
+		}
+		for _, command := range result.Routes.Add {
+			fmt.Printf("  + %s\n", command)
+		}
+	}
+
+	if len(result.Nat64) > 0 {
+		fmt.Println("\nNAT64 configuration:")
+		for _, file := range result.Nat64 {
+			switch {
+			case file.Foreign:
+				fmt.Printf("  %s: not generated by natman, left alone\n", file.Path)
+			case file.Remove:
+				fmt.Printf("  %s: remove\n", file.Path)
+			case file.Changed:
+				fmt.Printf("  %s: update\n", file.Path)
+			default:
+				fmt.Printf("  %s: unchanged\n", file.Path)
+			}
+		}
+	}
+
+	if result.Radvd == nil {
+		fmt.Println("\nRouter advertisements are sent by the natman daemon (ra-sender: builtin)")
+	} else {
+		fmt.Printf("\nRadvd configuration (%s):\n", result.Radvd.Path)
+		if result.Radvd.Changed {
+			fmt.Print(result.Radvd.Diff)
+		} else {
+			fmt.Println("  unchanged")
+		}
+	}
+
+	fmt.Println("")
+	if result.Changes {
+		fmt.Println("Changes pending, run 'natman' to apply them")
+	} else {
+		fmt.Println("No changes, system matches configuration")
+	}
+}
@@ -0,0 +1,182 @@
+package backend
+
+import (
+	"fmt"
+	"os/exec"
+
+	"natman/config"
+	"natman/link"
+	iptablesmanager "natman/worker/iptables-manager"
+	natmanager "natman/worker/nat-manager"
+	netmapmanager "natman/worker/netmap-manager"
+	nftmanager "natman/worker/nft-manager"
+)
+
+// A Backend renders the link model into kernel packet filter rules
+// and applies them. The iptables backend drives the nat and netmap
+// managers, the nftables backend loads a native nft ruleset.
+type Backend interface {
+	Name() string
+	Apply(links map[string]*link.Link) error
+	ApplyLinks(links map[string]*link.Link, names []string) error
+	Plan(links map[string]*link.Link) (*Plan, error)
+	Flush() error
+}
+
+// Plan lists the rule changes an Apply would make, without executing anything
+type Plan struct {
+	Backend string   `json:"backend"`
+	Add     []string `json:"add"`
+	Remove  []string `json:"remove"`
+}
+
+// Changed reports whether applying the plan would modify the system
+func (p *Plan) Changed() bool {
+	return len(p.Add) > 0 || len(p.Remove) > 0
+}
+
+// New returns the backend selected in the config, "auto" (or empty)
+// picks iptables when available and falls back to nftables. The links
+// are checked against the resolved backend, so nptv6 sets fail here
+// rather than when the rules are applied.
+func New(name string, links map[string]*link.Link) (Backend, error) {
+	var fw Backend
+	switch name {
+	case config.BackendIptables:
+		fw = &iptablesBackend{}
+	case config.BackendNftables:
+		fw = &nftablesBackend{}
+	case config.BackendAuto, "":
+		var err error
+		if fw, err = Detect(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown backend '%s' (use '%s', '%s' or '%s')",
+			name, config.BackendAuto, config.BackendIptables, config.BackendNftables)
+	}
+
+	if fw.Name() == config.BackendNftables {
+		if err := nftmanager.CheckSupported(links); err != nil {
+			if name != config.BackendNftables {
+				return nil, fmt.Errorf("%v, iptables/ip6tables not found in PATH", err)
+			}
+			return nil, err
+		}
+	}
+
+	return fw, nil
+}
+
+// Detect picks the backend based on the tools installed on the host
+func Detect() (Backend, error) {
+	if _, err := exec.LookPath("iptables"); err == nil {
+		if _, err := exec.LookPath("ip6tables"); err == nil {
+			return &iptablesBackend{}, nil
+		}
+	}
+
+	if nftmanager.Available() {
+		return &nftablesBackend{}, nil
+	}
+
+	return nil, fmt.Errorf("neither iptables/ip6tables nor nft found in PATH")
+}
+
+type iptablesBackend struct{}
+
+func (b *iptablesBackend) Name() string {
+	return config.BackendIptables
+}
+
+// Apply stages the NAT and netmap changes of both managers and commits
+// them with one iptables-restore and one ip6tables-restore transaction
+func (b *iptablesBackend) Apply(links map[string]*link.Link) error {
+	return b.ApplyLinks(links, nil)
+}
+
+// ApplyLinks converges only the rules tagged for the named links, rules of
+// other links stay untouched. A nil list converges every link.
+func (b *iptablesBackend) ApplyLinks(links map[string]*link.Link, names []string) error {
+	ipv4, ipv6, err := b.stage(links, names)
+	if err != nil {
+		return err
+	}
+
+	if err := iptablesmanager.Commit(ipv4, ipv6); err != nil {
+		return fmt.Errorf("failed to commit rules: %v", err)
+	}
+
+	return nil
+}
+
+func (b *iptablesBackend) Plan(links map[string]*link.Link) (*Plan, error) {
+	ipv4, ipv6, err := b.stage(links, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{Backend: b.Name()}
+	for _, tx := range []*iptablesmanager.Transaction{ipv4, ipv6} {
+		plan.Add = append(plan.Add, tx.Added()...)
+		plan.Remove = append(plan.Remove, tx.Removed()...)
+	}
+
+	return plan, nil
+}
+
+// Flush removes every rule natman added, what an Apply without links does
+func (b *iptablesBackend) Flush() error {
+	return b.Apply(map[string]*link.Link{})
+}
+
+func (b *iptablesBackend) stage(links map[string]*link.Link, names []string) (*iptablesmanager.Transaction, *iptablesmanager.Transaction, error) {
+	ipv4 := iptablesmanager.NewTransaction("iptables")
+	ipv6 := iptablesmanager.NewTransaction("ip6tables")
+	if names != nil {
+		ipv4.Limit(names...)
+		ipv6.Limit(names...)
+	}
+
+	// Run natmaker (NAT44/NAT66 configuration)
+	if err := natmanager.StageNatRules(links, ipv4, ipv6); err != nil {
+		return nil, nil, fmt.Errorf("failed to apply NAT rules: %v", err)
+	}
+
+	// Run netmapmaker (IPv6 network mapping)
+	if err := netmapmanager.StageNetmapRules(links, ipv6); err != nil {
+		return nil, nil, fmt.Errorf("failed to apply netmap rules: %v", err)
+	}
+
+	return ipv4, ipv6, nil
+}
+
+type nftablesBackend struct{}
+
+func (b *nftablesBackend) Name() string {
+	return config.BackendNftables
+}
+
+func (b *nftablesBackend) Apply(links map[string]*link.Link) error {
+	return nftmanager.ApplyNftRules(links)
+}
+
+// ApplyLinks reloads the whole natman table, nft replaces it atomically
+// and rules of links that did not change come out identical
+func (b *nftablesBackend) ApplyLinks(links map[string]*link.Link, names []string) error {
+	return nftmanager.ApplyNftRules(links)
+}
+
+func (b *nftablesBackend) Plan(links map[string]*link.Link) (*Plan, error) {
+	add, remove, err := nftmanager.PlanNftRules(links)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Plan{Backend: b.Name(), Add: add, Remove: remove}, nil
+}
+
+// Flush deletes the natman tables
+func (b *nftablesBackend) Flush() error {
+	return nftmanager.ApplyNftRules(map[string]*link.Link{})
+}
@@ -0,0 +1,66 @@
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"natman/config"
+	"natman/link"
+	"natman/link/netmap6"
+)
+
+// onlyNft leaves nft as the only packet filter tool in PATH
+func onlyNft(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "nft"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+}
+
+func nptv6Links(mode string) map[string]*link.Link {
+	return map[string]*link.Link{
+		"eth0": {Name: "eth0", Netmap6: map[string]*netmap6.Netmap6{
+			"c1": {Name: "c1", Enabled: true, Mode: mode},
+		}},
+	}
+}
+
+func TestNewChecksResolvedBackend(t *testing.T) {
+	onlyNft(t)
+
+	tests := []struct {
+		name    string
+		backend string
+		mode    string
+		want    string // resolved backend, or a part of the error message
+		fails   bool
+	}{
+		{"auto without nptv6", config.BackendAuto, config.Netmap6ModeNetmap, config.BackendNftables, false},
+		{"auto with nptv6", config.BackendAuto, config.Netmap6ModeNPTv6, "iptables/ip6tables not found", true},
+		{"default with nptv6", "", config.Netmap6ModeNPTv6, "nptv6 mode needs the iptables backend", true},
+		{"nftables with nptv6", config.BackendNftables, config.Netmap6ModeNPTv6, "nptv6 mode needs the iptables backend", true},
+		{"iptables with nptv6", config.BackendIptables, config.Netmap6ModeNPTv6, config.BackendIptables, false},
+	}
+
+	for _, tt := range tests {
+		fw, err := New(tt.backend, nptv6Links(tt.mode))
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%s: got the %s backend, want an error", tt.name, fw.Name())
+			} else if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("%s: error %q does not mention %q", tt.name, err, tt.want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if fw.Name() != tt.want {
+			t.Errorf("%s: got the %s backend, want %s", tt.name, fw.Name(), tt.want)
+		}
+	}
+}
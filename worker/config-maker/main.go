@@ -1,12 +1,17 @@
 package configmaker
 
 import (
+	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"os/exec"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+
+	iptablesmanager "natman/worker/iptables-manager"
 )
 
 // It can scan existing setting nin the system and compose the config from them
@@ -196,13 +201,13 @@ func parseNetmapRuleForConfig(line, chain string) NetmapRule {
 	}
 
 	// Determine interface and direction based on chain
-	if chain == "PREROUTING" {
+	if chainDirection(chain) == "PREROUTING" {
 		// For PREROUTING, packets come IN on the interface
 		if inInterface != "any" && inInterface != "*" && inInterface != "--" {
 			rule.Interface = inInterface
 			rule.Direction = "PREROUTING"
 		}
-	} else if chain == "POSTROUTING" {
+	} else if chainDirection(chain) == "POSTROUTING" {
 		// For POSTROUTING, packets go OUT on the interface
 		if outInterface != "any" && outInterface != "*" && outInterface != "--" {
 			rule.Interface = outInterface
@@ -295,17 +300,17 @@ func parseNat66RuleForConfig(line, chain string) Nat66Rule {
 	}
 
 	// Determine interface and direction based on chain
-	if chain == "POSTROUTING" {
+	if chainDirection(chain) == "POSTROUTING" {
 		// For POSTROUTING, packets go OUT on the interface
 		if outInterface != "any" && outInterface != "*" && outInterface != "--" {
 			rule.Interface = outInterface
 			rule.Direction = "POSTROUTING"
-		} else if chain == "PREROUTING" {
-			// For PREROUTING, packets come IN on the interface
-			if inInterface != "any" && inInterface != "*" && inInterface != "--" {
-				rule.Interface = inInterface
-				rule.Direction = "PREROUTING"
-			}
+		}
+	} else if chainDirection(chain) == "PREROUTING" {
+		// For PREROUTING, packets come IN on the interface
+		if inInterface != "any" && inInterface != "*" && inInterface != "--" {
+			rule.Interface = inInterface
+			rule.Direction = "PREROUTING"
 		}
 	}
 
@@ -386,13 +391,13 @@ func parseNat44RuleForConfig(line, chain string) Nat44Rule {
 	}
 
 	// Determine interface and direction based on chain
-	if chain == "POSTROUTING" {
+	if chainDirection(chain) == "POSTROUTING" {
 		// For POSTROUTING, packets go OUT on the interface
 		if outInterface != "any" && outInterface != "*" && outInterface != "--" {
 			rule.Interface = outInterface
 			rule.Direction = "POSTROUTING"
 		}
-	} else if chain == "PREROUTING" {
+	} else if chainDirection(chain) == "PREROUTING" {
 		// For PREROUTING, packets come IN on the interface
 		if inInterface != "any" && inInterface != "*" && inInterface != "--" {
 			rule.Interface = inInterface
@@ -403,6 +408,18 @@ func parseNat44RuleForConfig(line, chain string) Nat44Rule {
 	return rule
 }
 
+// chainDirection maps the built-in chains and the natman chains jumped
+// from them to the built-in direction
+func chainDirection(chain string) string {
+	switch chain {
+	case "POSTROUTING", iptablesmanager.ChainPostrouting:
+		return "POSTROUTING"
+	case "PREROUTING", iptablesmanager.ChainPrerouting:
+		return "PREROUTING"
+	}
+	return ""
+}
+
 func generateConfigYAML(interfaces []NetworkInterface, routes []Route, radvdConfig map[string]RadvdInterface, netmapRules map[string][]NetmapRule, nat66Rules map[string][]Nat66Rule, nat44Rules map[string][]Nat44Rule, slim bool) string {
 	config := `network:
   links:
@@ -436,7 +453,14 @@ func generateConfigYAML(interfaces []NetworkInterface, routes []Route, radvdConf
 		allInterfaces[ifaceName] = true
 	}
 
+	// Sorted so that the generated file only changes with the system
+	ifaceNames := make([]string, 0, len(allInterfaces))
 	for ifaceName := range allInterfaces {
+		ifaceNames = append(ifaceNames, ifaceName)
+	}
+	sort.Strings(ifaceNames)
+
+	for _, ifaceName := range ifaceNames {
 		// Get radvd config for this interface
 		radvdIface, hasRadvd := radvdConfig[ifaceName]
 
@@ -564,7 +588,7 @@ func generateConfigYAML(interfaces []NetworkInterface, routes []Route, radvdConf
 		minInterval := 30
 		maxInterval := 60
 		defaultLifetime := 180
-		dhcp := false
+		dhcpv6 := "off"
 
 		if hasRadvd {
 			if radvdIface.MinRtrAdvInterval > 0 {
@@ -576,7 +600,11 @@ func generateConfigYAML(interfaces []NetworkInterface, routes []Route, radvdConf
 			if radvdIface.AdvDefaultLifetime >= 0 {
 				defaultLifetime = radvdIface.AdvDefaultLifetime
 			}
-			dhcp = radvdIface.AdvManagedFlag
+			if radvdIface.AdvManagedFlag {
+				dhcpv6 = "stateful"
+			} else if radvdIface.AdvOtherConfigFlag {
+				dhcpv6 = "stateless"
+			}
 		}
 
 		// Check if nat66 is enabled based on captured rules
@@ -653,7 +681,7 @@ func generateConfigYAML(interfaces []NetworkInterface, routes []Route, radvdConf
         enabled: ` + boolToString(hasRadvd) + `
         adv-interval: [` + strconv.Itoa(minInterval) + `, ` + strconv.Itoa(maxInterval) + `]
         lifetime: ` + strconv.Itoa(defaultLifetime) + `
-        dhcp: ` + boolToString(dhcp) + `
+        dhcpv6: ` + dhcpv6 + `
 `
 
 			// Add prefixes - only if they exist or not slim
@@ -723,17 +751,22 @@ func correlateNetmapWithRadvRoutes(mappings []NetmapMapping, routes []RadvdRoute
 func extractNetmapMappings(rules []NetmapRule) []NetmapMapping {
 	var mappings []NetmapMapping
 
-	// Create a map to pair PREROUTING and POSTROUTING rules
-	preRouting := make(map[string]NetmapRule)
-	postRouting := make(map[string]NetmapRule)
+	// Collect PREROUTING and POSTROUTING rules, one per source, in the
+	// order of the rule set
+	var preRouting, postRouting []NetmapRule
+	seen := make(map[string]bool)
 
 	for _, rule := range rules {
+		key := rule.Direction + " " + rule.Source
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
 		if rule.Direction == "PREROUTING" {
-			// Use source as key for PREROUTING rules
-			preRouting[rule.Source] = rule
+			preRouting = append(preRouting, rule)
 		} else if rule.Direction == "POSTROUTING" {
-			// Use source as key for POSTROUTING rules
-			postRouting[rule.Source] = rule
+			postRouting = append(postRouting, rule)
 		}
 	}
 
@@ -782,86 +815,94 @@ func extractNetmapPrefixes(mappings []NetmapMapping) NetmapPrefixConfig {
 	return config
 }
 
-// findCommonIPv6Prefix finds the common /64 prefix for public or private addresses
+// findCommonIPv6Prefix finds the longest prefix, in whole 16 bit groups, shared
+// by the public or private side of all mappings. It is returned as a full
+// address suitable for pfx-pub/pfx-priv, or "" when there is none.
 func findCommonIPv6Prefix(mappings []NetmapMapping, isPublic bool) string {
 	if len(mappings) == 0 {
 		return ""
 	}
 
-	var addresses []string
+	var prefixes []netip.Prefix
 	for _, mapping := range mappings {
+		address := mapping.Private
 		if isPublic {
-			addresses = append(addresses, mapping.Public)
-		} else {
-			addresses = append(addresses, mapping.Private)
+			address = mapping.Public
 		}
-	}
 
-	// Find the longest common prefix
-	commonPrefix := ""
-	if len(addresses) > 0 {
-		// Parse the first address to establish base
-		firstAddr := addresses[0]
-		if strings.Contains(firstAddr, "/") {
-			// Remove CIDR notation
-			firstAddr = strings.Split(firstAddr, "/")[0]
+		prefix, err := parseMappingPrefix(address)
+		if err != nil {
+			return ""
 		}
+		prefixes = append(prefixes, prefix)
+	}
 
-		// Split by colons to analyze segments
-
-		// Try different prefix lengths to find the optimal one
-		segments := strings.Split(firstAddr, ":")
-		for prefixLen := 3; prefixLen >= 1; prefixLen-- {
-			if len(segments) >= prefixLen {
-				candidatePrefix := strings.Join(segments[:prefixLen], ":") + ":"
-
-				// Verify this prefix works for all addresses and results in meaningful reduction
-				allMatch := true
-				hasReduction := false
-
-				for _, addr := range addresses {
-					cleanAddr := addr
-					if strings.Contains(cleanAddr, "/") {
-						cleanAddr = strings.Split(cleanAddr, "/")[0]
-					}
-
-					if !strings.HasPrefix(cleanAddr, candidatePrefix) {
-						allMatch = false
-						break
-					}
-
-					// Check if using this prefix would actually reduce the address
-					remaining := strings.TrimPrefix(cleanAddr, candidatePrefix)
-					remaining = strings.TrimPrefix(remaining, ":")
-					if len(remaining) > 0 && remaining != cleanAddr {
-						hasReduction = true
-					}
-				}
+	// The common part must not reach into any of the mapped ranges
+	common := prefixes[0].Bits()
+	for _, prefix := range prefixes[1:] {
+		if prefix.Bits() < common {
+			common = prefix.Bits()
+		}
+	}
 
-				if allMatch && hasReduction {
-					commonPrefix = candidatePrefix
-					break // Use the longest valid prefix
-				}
+	for bits := common - common%16; bits > 0; bits -= 16 {
+		base := netip.PrefixFrom(prefixes[0].Addr(), bits).Masked()
+		allMatch := true
+		for _, prefix := range prefixes[1:] {
+			if !base.Contains(prefix.Addr()) {
+				allMatch = false
+				break
 			}
 		}
+
+		// The fragments have to keep something of their own
+		if allMatch && base.Addr().IsUnspecified() {
+			return ""
+		}
+		if allMatch && bits < prefixes[0].Bits() {
+			return base.Addr().String()
+		}
 	}
 
-	return commonPrefix
+	return ""
 }
 
-// removePrefix removes the given prefix from an IPv6 address/range
+// removePrefix turns an IPv6 address/range into the fragment that composes
+// back to it together with the given pfx-pub/pfx-priv base
 func removePrefix(address, prefix string) string {
-	if prefix == "" || !strings.HasPrefix(address, prefix) {
+	full, err := parseMappingPrefix(address)
+	if err != nil {
+		return address
+	}
+	base, err := netip.ParseAddr(prefix)
+	if err != nil {
 		return address
 	}
 
-	// Remove the prefix and return the remaining part
-	remaining := strings.TrimPrefix(address, prefix)
+	a := full.Addr().As16()
+	b := base.As16()
+	for i := range a {
+		if a[i]&b[i] != b[i] {
+			return address
+		}
+		a[i] &^= b[i]
+	}
 
-	// Handle cases where the remaining part starts with ":"
-	remaining = strings.TrimPrefix(remaining, ":")
+	return fmt.Sprintf("%s/%d", netip.AddrFrom16(a), full.Bits())
+}
 
-	return remaining
+// parseMappingPrefix parses an address of a NETMAP rule, plain addresses
+// are read as host prefixes
+func parseMappingPrefix(address string) (netip.Prefix, error) {
+	if strings.Contains(address, "/") {
+		return netip.ParsePrefix(address)
+	}
+
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
 }
 
 func scanRadvdConfig() (map[string]RadvdInterface, error) {
@@ -952,6 +993,7 @@ func parseInterfaceBlock(block string) RadvdInterface {
 	radvdIface := RadvdInterface{
 		AdvSendAdvert:      true, // Default
 		AdvManagedFlag:     false,
+		AdvOtherConfigFlag: false,
 		MinRtrAdvInterval:  30,
 		MaxRtrAdvInterval:  60,
 		AdvDefaultLifetime: 180,
@@ -969,6 +1011,10 @@ func parseInterfaceBlock(block string) RadvdInterface {
 		// Parse simple key-value pairs
 		if strings.Contains(line, "AdvManagedFlag") {
 			radvdIface.AdvManagedFlag = strings.Contains(line, "on")
+		} else if strings.Contains(line, "AdvOtherConfigFlag") {
+			// "Config" contains "on" as well, look at the value only
+			fields := strings.Fields(strings.TrimSuffix(line, ";"))
+			radvdIface.AdvOtherConfigFlag = fields[len(fields)-1] == "on"
 		} else if strings.Contains(line, "MinRtrAdvInterval") {
 			if val := extractNumber(line); val >= 0 {
 				radvdIface.MinRtrAdvInterval = val
@@ -1052,10 +1098,14 @@ func parsePrefixBlocks(content string) []RadvdPrefix {
 				RouterAddr: false, // Default
 			}
 
+			withdrawn := false
 			blockLines := strings.Split(blockContent.String(), "\n")
 			for _, blockLine := range blockLines {
 				blockLine = strings.TrimSpace(blockLine)
-				if strings.Contains(blockLine, "AdvOnLink") {
+				if strings.Contains(blockLine, "AdvPreferredLifetime") {
+					// A zero preferred lifetime withdraws a prefix that is no longer configured
+					withdrawn = extractNumber(blockLine) == 0
+				} else if strings.Contains(blockLine, "AdvOnLink") {
 					if strings.Contains(blockLine, "off") {
 						prefix.OnLink = false
 					} else if strings.Contains(blockLine, "on") {
@@ -1076,7 +1126,9 @@ func parsePrefixBlocks(content string) []RadvdPrefix {
 				}
 			}
 
-			results = append(results, prefix)
+			if !withdrawn {
+				results = append(results, prefix)
+			}
 		}
 	}
 
@@ -1123,7 +1175,10 @@ func parseRouteBlocks(content string) []RadvdRoute {
 					}
 				}
 
-				results = append(results, route)
+				// A zero lifetime withdraws a route that is no longer configured
+				if route.Lifetime != 0 {
+					results = append(results, route)
+				}
 				continue
 			}
 
@@ -1183,7 +1238,9 @@ func parseRouteBlocks(content string) []RadvdRoute {
 				}
 			}
 
-			results = append(results, route)
+			if route.Lifetime != 0 {
+				results = append(results, route)
+			}
 		}
 	}
 
@@ -1372,6 +1429,7 @@ type Route struct {
 type RadvdInterface struct {
 	AdvSendAdvert      bool
 	AdvManagedFlag     bool
+	AdvOtherConfigFlag bool
 	MinRtrAdvInterval  int
 	MaxRtrAdvInterval  int
 	AdvDefaultLifetime int
@@ -0,0 +1,104 @@
+package configmaker
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"natman/config"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// readTestdata returns the content of a file in testdata
+func readTestdata(t *testing.T, name string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// golden compares got with the golden file, or rewrites it with -update
+func golden(t *testing.T, name, got string) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("output differs from %s, got:\n%s", path, got)
+	}
+}
+
+func TestGenerateConfigYAML(t *testing.T) {
+	interfaces := []NetworkInterface{
+		{Name: "wan0", IPv4Addresses: []string{"203.0.113.2/24"}, IPv6Addresses: []string{"2001:db8::2/64"}},
+		{Name: "wan1", IPv4Addresses: []string{"198.51.100.2/24"}},
+		{Name: "lan0", IPv4Addresses: []string{"192.168.10.1/24"}, IPv6Addresses: []string{"fd00:10::1/64"}},
+		{Name: "gtwl", IPv6Addresses: []string{"b30::1/64"}},
+	}
+	routes := []Route{
+		{Destination: "default", Gateway: "203.0.113.1", Interface: "wan0"},
+	}
+	radvdConfig := parseRadvdConfig(readTestdata(t, "radvd.conf"))
+	ip6tables := readTestdata(t, "ip6tables-nat.txt")
+	netmapRules := parseNetmapRulesForConfig(ip6tables)
+	nat66Rules := parseNat66RulesForConfig(ip6tables)
+	nat44Rules := parseNat44RulesForConfig(readTestdata(t, "iptables-nat.txt"))
+
+	for _, slim := range []bool{false, true} {
+		name := "full"
+		if slim {
+			name = "slim"
+		}
+		t.Run(name, func(t *testing.T) {
+			got := generateConfigYAML(interfaces, routes, radvdConfig, netmapRules, nat66Rules, nat44Rules, slim)
+
+			// The scanned state lives in maps, every rendering must come out the same
+			for i := 0; i < 20; i++ {
+				again := generateConfigYAML(interfaces, routes, radvdConfig, netmapRules, nat66Rules, nat44Rules, slim)
+				if again != got {
+					t.Fatalf("rendering is not deterministic, got:\n%s\nthen:\n%s", got, again)
+				}
+			}
+
+			// The scanned config must be usable as it is
+			if _, err := config.Validate([]byte(got)); err != nil {
+				t.Errorf("generated config does not validate: %v", err)
+			}
+
+			golden(t, name+".yaml", got)
+		})
+	}
+}
+
+func TestExtractNetmapMappingsKeepsRuleOrder(t *testing.T) {
+	rules := parseNetmapRulesForConfig(readTestdata(t, "ip6tables-nat.txt"))["gtwl"]
+
+	var got []string
+	for _, mapping := range extractNetmapMappings(rules) {
+		got = append(got, mapping.Public+" "+mapping.Private)
+	}
+
+	want := []string{
+		"e2:0:0:3:0:25::/96 b30::20:0:0/96",
+		"e2:0:0:3:0:a15::/96 b30::21:0:0/96",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("mappings = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,134 @@
+package configwatcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Debug flag
+var Debug bool = false
+
+// SetDebug enables debug logging
+func SetDebug(debug bool) {
+	Debug = debug
+}
+
+// DebugPrint prints a message if debug mode is enabled
+func DebugPrint(format string, args ...interface{}) {
+	if Debug {
+		fmt.Printf("[WATCHER-DEBUG] "+format+"\n", args...)
+	}
+}
+
+// Editors and config management tools often write a file in several steps,
+// events arriving within this window are reported as one change
+const settleDelay = 500 * time.Millisecond
+
+// Watcher reports changes of a single file through inotify.
+// The parent directory is watched so that files replaced by rename
+// (as most editors and config management tools do) are still noticed.
+type Watcher struct {
+	Changes <-chan struct{}
+
+	file *os.File
+	name string
+}
+
+// Watch starts watching path. A value is sent on Changes after the file
+// was written, created, replaced or removed.
+func Watch(path string) (*Watcher, error) {
+	dir := filepath.Dir(path)
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize inotify: %v", err)
+	}
+
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_DELETE)
+	if _, err := syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to watch %s: %v", dir, err)
+	}
+
+	changes := make(chan struct{}, 1)
+	w := &Watcher{
+		Changes: changes,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		name:    filepath.Base(path),
+	}
+
+	go w.run(changes)
+	return w, nil
+}
+
+// Close stops the watcher and closes the Changes channel. The channel is
+// also closed when reading the inotify events fails.
+func (w *Watcher) Close() error {
+	return w.file.Close()
+}
+
+func (w *Watcher) run(changes chan<- struct{}) {
+	defer close(changes)
+
+	events := make(chan struct{})
+	go func() {
+		defer close(events)
+		w.read(events)
+	}()
+
+	var settle <-chan time.Time
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+			settle = time.After(settleDelay)
+		case <-settle:
+			settle = nil
+			select {
+			case changes <- struct{}{}:
+			default:
+				// A change is already pending
+			}
+		}
+	}
+}
+
+// read decodes inotify events and forwards those concerning the watched file
+func (w *Watcher) read(events chan<- struct{}) {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			DebugPrint("Stopped reading inotify events: %v", err)
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + int(event.Len)
+			offset = nameEnd
+
+			if event.Len == 0 || nameEnd > n {
+				continue
+			}
+
+			name := string(buf[nameStart:nameEnd])
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+
+			if name == w.name {
+				DebugPrint("Event 0x%x on %s", event.Mask, name)
+				events <- struct{}{}
+			}
+		}
+	}
+}
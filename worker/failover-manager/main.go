@@ -0,0 +1,606 @@
+package failovermanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"natman/link"
+	"natman/link/failover"
+)
+
+// It health-checks the members of every failover group and decides which
+// member is active. Effective turns that decision into the link model the
+// backends and the route manager apply: the active member carries the
+// default route and takes over the origins of members that are down.
+// Failing back to a preferred member waits until it stayed healthy for
+// the hold-down period.
+
+// Debug flag
+var Debug bool = false
+
+// SetDebug enables debug logging
+func SetDebug(debug bool) {
+	Debug = debug
+}
+
+// DebugPrint prints a message if debug mode is enabled
+func DebugPrint(format string, args ...interface{}) {
+	if Debug {
+		fmt.Printf("[FAILOVER-DEBUG] "+format+"\n", args...)
+	}
+}
+
+// How often the monitor looks for groups due for a probe round
+const tickInterval = time.Second
+
+// Prober runs one health check out of the given link
+type Prober interface {
+	Probe(linkName string, check failover.Check, timeout time.Duration) error
+}
+
+// SocketProber sends ICMP echo requests and opens TCP connections bound to
+// the member's interface
+type SocketProber struct{}
+
+func (SocketProber) Probe(linkName string, check failover.Check, timeout time.Duration) error {
+	switch check.Proto {
+	case "icmp":
+		return probeICMP(linkName, check.Target, timeout)
+	case "tcp":
+		return probeTCP(linkName, check.Target, timeout)
+	}
+	return fmt.Errorf("unknown health check protocol '%s'", check.Proto)
+}
+
+func probeTCP(linkName, target string, timeout time.Duration) error {
+	dialer := net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var bindErr error
+			if err := c.Control(func(fd uintptr) {
+				bindErr = syscall.BindToDevice(int(fd), linkName)
+			}); err != nil {
+				return err
+			}
+			return bindErr
+		},
+	}
+
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// ICMP echo sequence numbers, unique per probe so concurrent probes
+// do not take each other's replies
+var echoSequence atomic.Uint32
+
+func probeICMP(linkName, target string, timeout time.Duration) error {
+	addr, err := netip.ParseAddr(target)
+	if err != nil {
+		return fmt.Errorf("invalid ICMP target %s: %v", target, err)
+	}
+
+	domain, proto := syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+	echoRequest, echoReply := byte(128), byte(129)
+	var sockaddr syscall.Sockaddr = &syscall.SockaddrInet6{Addr: addr.As16()}
+	if addr.Is4() {
+		domain, proto = syscall.AF_INET, syscall.IPPROTO_ICMP
+		echoRequest, echoReply = 8, 0
+		sockaddr = &syscall.SockaddrInet4{Addr: addr.As4()}
+	}
+
+	fd, err := syscall.Socket(domain, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return fmt.Errorf("failed to open ICMP socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.BindToDevice(fd, linkName); err != nil {
+		return fmt.Errorf("failed to bind ICMP socket to %s: %v", linkName, err)
+	}
+
+	id := uint16(os.Getpid())
+	seq := uint16(echoSequence.Add(1))
+	request := []byte{echoRequest, 0, 0, 0, byte(id >> 8), byte(id), byte(seq >> 8), byte(seq), 'n', 'a', 't', 'm', 'a', 'n'}
+	if !addr.Is6() {
+		// The kernel fills in the ICMPv6 checksum, ICMPv4 is up to us
+		sum := checksum(request)
+		request[2], request[3] = byte(sum>>8), byte(sum)
+	}
+
+	if err := syscall.Sendto(fd, request, 0, sockaddr); err != nil {
+		return fmt.Errorf("failed to send echo request to %s: %v", target, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("no echo reply from %s within %s", target, timeout)
+		}
+		tv := syscall.NsecToTimeval(remaining.Nanoseconds())
+		if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			return err
+		}
+
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read echo reply from %s: %v", target, err)
+		}
+
+		reply := buf[:n]
+		if !addr.Is6() && len(reply) > 0 {
+			// Raw IPv4 sockets deliver the IP header as well
+			headerLen := int(reply[0]&0x0f) * 4
+			if headerLen > len(reply) {
+				continue
+			}
+			reply = reply[headerLen:]
+		}
+		if len(reply) >= 8 && reply[0] == echoReply &&
+			reply[4] == byte(id>>8) && reply[5] == byte(id) && reply[6] == byte(seq>>8) && reply[7] == byte(seq) {
+			return nil
+		}
+	}
+}
+
+// checksum is the internet checksum of RFC 1071
+func checksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// Event reports that a group switched its active member
+type Event struct {
+	Group  string
+	From   string
+	To     string
+	Reason string
+}
+
+func (e Event) String() string {
+	return fmt.Sprintf("Failover group %s: switching from %s to %s (%s)", e.Group, e.From, e.To, e.Reason)
+}
+
+// State is the outcome of the health checks: the active member of every
+// group and the members that are down
+type State struct {
+	Active map[string]string `json:"active"`
+	Down   map[string]bool   `json:"down,omitempty"`
+}
+
+// StatePath holds the state of the running daemon, so that one-shot runs
+// do not move the uplinks back to the primary members
+var StatePath = "/var/lib/natman/failover.json"
+
+// LoadState reads the state the daemon saved. Without a daemon running
+// there is no file and the empty state makes the primary members active.
+func LoadState(path string) (State, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return State{}, nil
+	}
+	if err != nil {
+		return State{}, fmt.Errorf("failed to read failover state: %v", err)
+	}
+
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return State{}, fmt.Errorf("failed to parse failover state %s: %v", path, err)
+	}
+	return state, nil
+}
+
+// Save writes the state for one-shot runs
+func (s State) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+type memberState struct {
+	up       bool
+	since    time.Time // last change of up, zero for the initial state
+	failures int       // consecutive failed probe rounds
+}
+
+type groupState struct {
+	group     *failover.Group
+	active    string
+	members   map[string]*memberState
+	nextProbe time.Time
+}
+
+func newGroupState(group *failover.Group) *groupState {
+	gs := &groupState{
+		group:   group,
+		active:  group.Primary(),
+		members: make(map[string]*memberState),
+	}
+	// Members count as healthy until probes say otherwise
+	for _, member := range group.Members {
+		gs.members[member.Link] = &memberState{up: true}
+	}
+	return gs
+}
+
+// Monitor probes the groups and reports switches on Events
+type Monitor struct {
+	Events chan Event
+
+	prober Prober
+	mu     sync.Mutex
+	groups map[string]*groupState
+	done   chan struct{}
+}
+
+func NewMonitor(groups []*failover.Group, prober Prober) *Monitor {
+	m := &Monitor{
+		Events: make(chan Event, 16),
+		prober: prober,
+		groups: make(map[string]*groupState),
+		done:   make(chan struct{}),
+	}
+	m.SetGroups(groups)
+	return m
+}
+
+// SetGroups replaces the monitored groups after a reload. Health and the
+// active member are kept for members that are still in their group.
+func (m *Monitor) SetGroups(groups []*failover.Group) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	states := make(map[string]*groupState)
+	for _, group := range groups {
+		gs := newGroupState(group)
+		if old, ok := m.groups[group.Name]; ok {
+			for name, member := range old.members {
+				if _, ok := gs.members[name]; ok {
+					gs.members[name] = member
+				}
+			}
+			if _, ok := group.Member(old.active); ok {
+				gs.active = old.active
+			}
+		}
+		states[group.Name] = gs
+	}
+	m.groups = states
+}
+
+// State returns the current health check outcome
+func (m *Monitor) State() State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := State{Active: make(map[string]string), Down: make(map[string]bool)}
+	for name, gs := range m.groups {
+		state.Active[name] = gs.active
+		for linkName, member := range gs.members {
+			if !member.up {
+				state.Down[linkName] = true
+			}
+		}
+	}
+	return state
+}
+
+// Start probes the groups in the background until Close is called
+func (m *Monitor) Start() {
+	go func() {
+		ticker := time.NewTicker(tickInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-m.done:
+				return
+			case now := <-ticker.C:
+				for _, event := range m.Round(now) {
+					select {
+					case m.Events <- event:
+					case <-m.done:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+func (m *Monitor) Close() {
+	close(m.done)
+}
+
+// Round runs a probe round for every group that is due and returns the
+// resulting switches. It is what Start runs every tick.
+func (m *Monitor) Round(now time.Time) []Event {
+	m.mu.Lock()
+	var names []string
+	for name := range m.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var due []*groupState
+	for _, name := range names {
+		gs := m.groups[name]
+		if !now.Before(gs.nextProbe) {
+			gs.nextProbe = now.Add(gs.group.Interval)
+			due = append(due, gs)
+		}
+	}
+	m.mu.Unlock()
+
+	var events []Event
+	for _, gs := range due {
+		// Probes run without the lock, the group may be replaced meanwhile
+		results := m.probeGroup(gs.group)
+
+		m.mu.Lock()
+		if m.groups[gs.group.Name] == gs {
+			if event, ok := gs.update(results, now); ok {
+				events = append(events, event)
+			}
+		}
+		m.mu.Unlock()
+	}
+	return events
+}
+
+// probeGroup checks every member concurrently, a member is healthy when
+// one of the group's checks succeeds
+func (m *Monitor) probeGroup(group *failover.Group) map[string]bool {
+	results := make(map[string]bool)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, member := range group.Members {
+		wg.Add(1)
+		go func(linkName string) {
+			defer wg.Done()
+
+			healthy := false
+			for _, check := range group.Checks {
+				err := m.prober.Probe(linkName, check, group.Timeout)
+				if err == nil {
+					healthy = true
+					break
+				}
+				DebugPrint("Group %s: %s check %s failed: %v", group.Name, linkName, check, err)
+			}
+
+			mu.Lock()
+			results[linkName] = healthy
+			mu.Unlock()
+		}(member.Link)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// update records a probe round and selects the active member
+func (gs *groupState) update(results map[string]bool, now time.Time) (Event, bool) {
+	for _, member := range gs.group.Members {
+		state := gs.members[member.Link]
+
+		if results[member.Link] {
+			state.failures = 0
+			if !state.up {
+				state.up, state.since = true, now
+				fmt.Printf("Failover group %s: %s is up\n", gs.group.Name, member.Link)
+			}
+			continue
+		}
+
+		state.failures++
+		if state.up && state.failures >= gs.group.Failures {
+			state.up, state.since = false, now
+			fmt.Printf("Failover group %s: %s is down after %d failed probe rounds\n",
+				gs.group.Name, member.Link, state.failures)
+		}
+	}
+
+	active, reason := gs.selectActive(now)
+	if active == gs.active {
+		return Event{}, false
+	}
+
+	event := Event{Group: gs.group.Name, From: gs.active, To: active, Reason: reason}
+	gs.active = active
+	return event, true
+}
+
+// selectActive keeps a healthy active member unless a preferred member
+// has been healthy for the hold-down period. A failed active member is
+// replaced right away by the first healthy member.
+func (gs *groupState) selectActive(now time.Time) (string, string) {
+	if gs.members[gs.active].up {
+		for _, member := range gs.group.Members {
+			if member.Link == gs.active {
+				break
+			}
+			state := gs.members[member.Link]
+			if state.up && now.Sub(state.since) >= gs.group.HoldDown {
+				return member.Link, fmt.Sprintf("%s healthy for %s", member.Link, gs.group.HoldDown)
+			}
+		}
+		return gs.active, ""
+	}
+
+	for _, member := range gs.group.Members {
+		if gs.members[member.Link].up {
+			return member.Link, fmt.Sprintf("%s is down", gs.active)
+		}
+	}
+
+	// Nothing is healthy, stay where we are
+	return gs.active, ""
+}
+
+// Effective returns the link model for the given state. Members of a group
+// get their Uplink, the active member carries the default route and takes
+// over the origins of the members that are down with its own gateway and
+// snat-to. An active member that translated all of its traffic keeps
+// doing so with a catch-all origin behind the adopted ones, one without
+// NAT only translates the adopted origins. Links outside of groups are
+// returned as they are.
+func Effective(links map[string]*link.Link, groups []*failover.Group, state State) map[string]*link.Link {
+	if len(groups) == 0 {
+		return links
+	}
+
+	result := make(map[string]*link.Link, len(links))
+	for name, linkObj := range links {
+		result[name] = linkObj
+	}
+
+	for _, group := range groups {
+		activeName := state.Active[group.Name]
+		activeMember, ok := group.Member(activeName)
+		if !ok {
+			activeName = group.Primary()
+			activeMember = group.Members[0]
+		}
+		if _, ok := links[activeName]; !ok {
+			continue
+		}
+
+		for _, member := range group.Members {
+			linkObj, ok := links[member.Link]
+			if !ok {
+				continue
+			}
+			member := member
+			clone := cloneLink(linkObj)
+			clone.Uplink = &link.Uplink{
+				Group:      group.Name,
+				Gateway:    member.Gateway,
+				Gateway6:   member.Gateway6,
+				ProbeTable: member.Table,
+				Active:     member.Link == activeName,
+			}
+			result[member.Link] = clone
+		}
+
+		target := result[activeName]
+		blanket44 := target.Nat44 != nil && target.Nat44.Enabled && len(target.Nat44.Origins) == 0
+		blanket66 := target.Nat66 != nil && target.Nat66.Enabled && len(target.Nat66.Origins) == 0
+		for _, member := range group.Members {
+			standby, ok := result[member.Link]
+			if !ok || member.Link == activeName || !state.Down[member.Link] {
+				continue
+			}
+
+			if standby.Nat44 != nil && standby.Nat44.Enabled && len(standby.Nat44.Origins) > 0 {
+				if target.Nat44 == nil || !target.Nat44.Enabled {
+					target.Nat44 = &link.Nat44{Enabled: true}
+				}
+				target.Nat44.Origins = adoptOrigins(target.Nat44.Origins, standby.Nat44.Origins,
+					target.Nat44.SnatTo, target.Nat44.Persistent, activeMember.Gateway)
+				standby.Nat44.Origins = withoutRouting(standby.Nat44.Origins)
+			}
+
+			if standby.Nat66 != nil && standby.Nat66.Enabled && len(standby.Nat66.Origins) > 0 {
+				if target.Nat66 == nil || !target.Nat66.Enabled {
+					target.Nat66 = &link.Nat66{Enabled: true}
+				}
+				target.Nat66.Origins = adoptOrigins(target.Nat66.Origins, standby.Nat66.Origins,
+					target.Nat66.SnatTo, target.Nat66.Persistent, activeMember.Gateway6)
+				standby.Nat66.Origins = withoutRouting(standby.Nat66.Origins)
+			}
+		}
+
+		// Origins replace the blanket rule, which has to become one of them
+		if blanket44 && len(target.Nat44.Origins) > 0 {
+			target.Nat44.Origins = append(target.Nat44.Origins, link.Origin{
+				Source: "0.0.0.0/0", SnatTo: target.Nat44.SnatTo, Persistent: target.Nat44.Persistent})
+		}
+		if blanket66 && len(target.Nat66.Origins) > 0 {
+			target.Nat66.Origins = append(target.Nat66.Origins, link.Origin{
+				Source: "::/0", SnatTo: target.Nat66.SnatTo, Persistent: target.Nat66.Persistent})
+		}
+	}
+
+	return result
+}
+
+// cloneLink copies the parts of a link Effective changes
+func cloneLink(linkObj *link.Link) *link.Link {
+	clone := *linkObj
+	if linkObj.Nat44 != nil {
+		nat44 := *linkObj.Nat44
+		nat44.Origins = append([]link.Origin(nil), linkObj.Nat44.Origins...)
+		clone.Nat44 = &nat44
+	}
+	if linkObj.Nat66 != nil {
+		nat66 := *linkObj.Nat66
+		nat66.Origins = append([]link.Origin(nil), linkObj.Nat66.Origins...)
+		clone.Nat66 = &nat66
+	}
+	return &clone
+}
+
+// adoptOrigins moves origins to the active member, translated with its
+// snat-to and routed through its gateway
+func adoptOrigins(existing, moved []link.Origin, snatTo []string, persistent bool, gateway string) []link.Origin {
+	present := make(map[string]bool)
+	for _, origin := range existing {
+		present[origin.Source] = true
+	}
+
+	for _, origin := range moved {
+		if present[origin.Source] {
+			continue
+		}
+		origin.SnatTo, origin.Persistent = snatTo, persistent
+		if origin.Table != 0 {
+			origin.Gateway = gateway
+		}
+		existing = append(existing, origin)
+	}
+	return existing
+}
+
+// withoutRouting keeps the origins of a failed member for NAT only, their
+// tables now point at the active member
+func withoutRouting(origins []link.Origin) []link.Origin {
+	result := make([]link.Origin, len(origins))
+	for i, origin := range origins {
+		origin.Table, origin.Gateway, origin.Fwmark = 0, "", 0
+		result[i] = origin
+	}
+	return result
+}
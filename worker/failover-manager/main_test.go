@@ -0,0 +1,282 @@
+package failovermanager
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"natman/link"
+	"natman/link/failover"
+)
+
+// fakeProber answers health checks from a table of healthy links
+type fakeProber struct {
+	mu      sync.Mutex
+	healthy map[string]bool
+	probes  int
+}
+
+func (p *fakeProber) Probe(linkName string, check failover.Check, timeout time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.probes++
+	if !p.healthy[linkName] {
+		return errors.New("no answer")
+	}
+	return nil
+}
+
+func (p *fakeProber) set(linkName string, healthy bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.healthy[linkName] = healthy
+}
+
+func testGroup() *failover.Group {
+	return &failover.Group{
+		Name: "wan",
+		Members: []failover.Member{
+			{Link: "eth0", Gateway: "203.0.113.1", Table: 201},
+			{Link: "eth1", Gateway: "198.51.100.1", Table: 202},
+		},
+		Checks:   []failover.Check{{Proto: "icmp", Target: "192.0.2.53"}},
+		Interval: 5 * time.Second,
+		Timeout:  time.Second,
+		Failures: 2,
+		HoldDown: time.Minute,
+	}
+}
+
+func testLinks() map[string]*link.Link {
+	return map[string]*link.Link{
+		"eth0": {Name: "eth0", Nat44: &link.Nat44{
+			Enabled: true,
+			SnatTo:  []string{"203.0.113.5"},
+			Origins: []link.Origin{
+				{Source: "10.0.1.0/24", SnatTo: []string{"203.0.113.5"}, Table: 101, Gateway: "203.0.113.1"},
+			},
+		}},
+		"eth1": {Name: "eth1", Nat44: &link.Nat44{
+			Enabled: true,
+			SnatTo:  []string{"198.51.100.5"},
+			Origins: []link.Origin{
+				{Source: "10.0.2.0/24", SnatTo: []string{"198.51.100.5"}},
+			},
+		}},
+		"lan": {Name: "lan"},
+	}
+}
+
+// expectRound runs a probe round and compares the switches it reports
+func expectRound(t *testing.T, m *Monitor, now time.Time, want ...Event) {
+	t.Helper()
+
+	got := m.Round(now)
+	if len(got) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("round at %s: got %v, want %v", now.Format(time.TimeOnly), got, want)
+	}
+}
+
+func TestRoundFailoverAndRecovery(t *testing.T) {
+	prober := &fakeProber{healthy: map[string]bool{"eth0": true, "eth1": true}}
+	group := testGroup()
+	m := NewMonitor([]*failover.Group{group}, prober)
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	expectRound(t, m, at(0))
+	if got := m.State().Active["wan"]; got != "eth0" {
+		t.Fatalf("active member is %s, want the primary eth0", got)
+	}
+
+	// A round before the group's interval does not probe
+	probes := prober.probes
+	expectRound(t, m, at(2))
+	if prober.probes != probes {
+		t.Errorf("round before the interval probed %d times", prober.probes-probes)
+	}
+
+	// One failed round is tolerated, the second one switches
+	prober.set("eth0", false)
+	expectRound(t, m, at(5))
+	if state := m.State(); state.Active["wan"] != "eth0" || state.Down["eth0"] {
+		t.Fatalf("switched after one failed round: %+v", state)
+	}
+	expectRound(t, m, at(10), Event{Group: "wan", From: "eth0", To: "eth1", Reason: "eth0 is down"})
+
+	state := m.State()
+	want := State{Active: map[string]string{"wan": "eth1"}, Down: map[string]bool{"eth0": true}}
+	if !reflect.DeepEqual(state, want) {
+		t.Fatalf("state after failover is %+v, want %+v", state, want)
+	}
+
+	links := Effective(testLinks(), []*failover.Group{group}, state)
+	eth0, eth1 := links["eth0"], links["eth1"]
+	if eth0.Uplink == nil || eth0.Uplink.Active || eth1.Uplink == nil || !eth1.Uplink.Active {
+		t.Fatalf("uplinks after failover: eth0 %+v, eth1 %+v", eth0.Uplink, eth1.Uplink)
+	}
+	if links["lan"].Uplink != nil {
+		t.Errorf("lan is not a member but got %+v", links["lan"].Uplink)
+	}
+	wantOrigins := []link.Origin{
+		{Source: "10.0.2.0/24", SnatTo: []string{"198.51.100.5"}},
+		{Source: "10.0.1.0/24", SnatTo: []string{"198.51.100.5"}, Table: 101, Gateway: "198.51.100.1"},
+	}
+	if !reflect.DeepEqual(eth1.Nat44.Origins, wantOrigins) {
+		t.Errorf("eth1 origins are %+v, want %+v", eth1.Nat44.Origins, wantOrigins)
+	}
+	wantStandby := []link.Origin{{Source: "10.0.1.0/24", SnatTo: []string{"203.0.113.5"}}}
+	if !reflect.DeepEqual(eth0.Nat44.Origins, wantStandby) {
+		t.Errorf("eth0 origins are %+v, want %+v", eth0.Nat44.Origins, wantStandby)
+	}
+
+	// The configured links are not modified
+	if origins := testLinks()["eth0"].Nat44.Origins; len(origins) != 1 || origins[0].Table != 101 {
+		t.Errorf("Effective changed the configured origins")
+	}
+
+	// The recovered primary waits out the hold-down period
+	prober.set("eth0", true)
+	expectRound(t, m, at(15))
+	if state := m.State(); state.Active["wan"] != "eth1" || state.Down["eth0"] {
+		t.Fatalf("state after recovery is %+v, want eth1 active and eth0 up", state)
+	}
+	expectRound(t, m, at(70))
+	expectRound(t, m, at(75), Event{Group: "wan", From: "eth1", To: "eth0", Reason: "eth0 healthy for 1m0s"})
+
+	links = Effective(testLinks(), []*failover.Group{group}, m.State())
+	if !links["eth0"].Uplink.Active || links["eth1"].Uplink.Active {
+		t.Errorf("primary is not active after the hold-down period")
+	}
+	if len(links["eth1"].Nat44.Origins) != 1 {
+		t.Errorf("eth1 kept the origins of eth0: %+v", links["eth1"].Nat44.Origins)
+	}
+}
+
+func TestEffectiveKeepsBlanketNat(t *testing.T) {
+	group := testGroup()
+	state := State{Active: map[string]string{"wan": "eth1"}, Down: map[string]bool{"eth0": true}}
+	adopted := link.Origin{Source: "10.0.1.0/24", Table: 101, Gateway: "198.51.100.1"}
+
+	tests := []struct {
+		name  string
+		nat44 *link.Nat44
+		want  []link.Origin
+	}{
+		{
+			name:  "masquerade",
+			nat44: &link.Nat44{Enabled: true},
+			want:  []link.Origin{adopted, {Source: "0.0.0.0/0"}},
+		},
+		{
+			name:  "snat-to",
+			nat44: &link.Nat44{Enabled: true, SnatTo: []string{"198.51.100.5"}, Persistent: true},
+			want: []link.Origin{
+				{Source: "10.0.1.0/24", SnatTo: []string{"198.51.100.5"}, Persistent: true, Table: 101, Gateway: "198.51.100.1"},
+				{Source: "0.0.0.0/0", SnatTo: []string{"198.51.100.5"}, Persistent: true},
+			},
+		},
+		{
+			name:  "no NAT",
+			nat44: nil,
+			want:  []link.Origin{adopted},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			links := testLinks()
+			links["eth1"] = &link.Link{Name: "eth1", Nat44: tt.nat44}
+
+			eth1 := Effective(links, []*failover.Group{group}, state)["eth1"]
+			if eth1.Nat44 == nil || !eth1.Nat44.Enabled {
+				t.Fatalf("active member has no NAT44: %+v", eth1.Nat44)
+			}
+			if !reflect.DeepEqual(eth1.Nat44.Origins, tt.want) {
+				t.Errorf("origins are %+v, want %+v", eth1.Nat44.Origins, tt.want)
+			}
+		})
+	}
+
+	// Without a member down the blanket rule stays as it is
+	links := testLinks()
+	links["eth1"] = &link.Link{Name: "eth1", Nat44: &link.Nat44{Enabled: true}}
+	healthy := State{Active: map[string]string{"wan": "eth1"}}
+	if origins := Effective(links, []*failover.Group{group}, healthy)["eth1"].Nat44.Origins; len(origins) != 0 {
+		t.Errorf("origins without a member down: %+v", origins)
+	}
+}
+
+func TestRoundKeepsActiveWhenAllDown(t *testing.T) {
+	prober := &fakeProber{healthy: map[string]bool{}}
+	m := NewMonitor([]*failover.Group{testGroup()}, prober)
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	expectRound(t, m, start)
+	expectRound(t, m, start.Add(5*time.Second))
+
+	want := State{Active: map[string]string{"wan": "eth0"}, Down: map[string]bool{"eth0": true, "eth1": true}}
+	if state := m.State(); !reflect.DeepEqual(state, want) {
+		t.Errorf("state is %+v, want %+v", state, want)
+	}
+}
+
+func TestStateSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "natman", "failover.json")
+
+	state, err := LoadState(path)
+	if err != nil || state.Active != nil {
+		t.Fatalf("LoadState without a file returned %+v, %v", state, err)
+	}
+
+	saved := State{Active: map[string]string{"wan": "eth1"}, Down: map[string]bool{"eth0": true}}
+	if err := saved.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if state, err = LoadState(path); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state, saved) {
+		t.Errorf("loaded %+v, want %+v", state, saved)
+	}
+}
+
+func TestSocketProberTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := listener.Addr().String()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	check := failover.Check{Proto: "tcp", Target: target}
+	err = SocketProber{}.Probe("lo", check, time.Second)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("binding to an interface needs CAP_NET_RAW")
+	}
+	if err != nil {
+		t.Fatalf("probe of listening %s failed: %v", target, err)
+	}
+
+	listener.Close()
+	if err := (SocketProber{}).Probe("lo", check, time.Second); err == nil {
+		t.Errorf("probe of closed %s succeeded", target)
+	}
+}
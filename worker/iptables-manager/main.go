@@ -0,0 +1,418 @@
+package iptablesmanager
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// It collects rule changes for one iptables family (iptables or ip6tables)
+// and commits them as a single iptables-restore --noflush transaction.
+// Before committing, the touched tables are saved with iptables-save so
+// the previous state can be restored if the commit fails.
+
+// Chains owned by natman. Rules are only ever reconciled inside these
+// chains, the built-in chains just get a single jump to them.
+const (
+	ChainPostrouting = "NATMAN-POSTROUTING"
+	ChainPrerouting  = "NATMAN-PREROUTING"
+	ChainMss         = "NATMAN-MSS"
+	ChainMark        = "NATMAN-MARK"
+	ChainSnpt        = "NATMAN-SNPT"
+	ChainDnpt        = "NATMAN-DNPT"
+)
+
+type OwnedChain struct {
+	Table   string
+	Chain   string
+	Parent  string // built-in chain jumping to Chain
+	Command string // only created for this command when set
+}
+
+var OwnedChains = []OwnedChain{
+	{Table: "nat", Chain: ChainPostrouting, Parent: "POSTROUTING"},
+	{Table: "nat", Chain: ChainPrerouting, Parent: "PREROUTING"},
+	{Table: "mangle", Chain: ChainMss, Parent: "FORWARD"},
+	{Table: "mangle", Chain: ChainMark, Parent: "PREROUTING"},
+	{Table: "mangle", Chain: ChainSnpt, Parent: "POSTROUTING", Command: "ip6tables"},
+	{Table: "mangle", Chain: ChainDnpt, Parent: "PREROUTING", Command: "ip6tables"},
+}
+
+// Every rule natman creates carries a comment "natman:<link>:<feature>:<set>"
+// so live rules can be attributed back to the config. Untagged rules
+// are never touched.
+const TagPrefix = "natman"
+
+// Features used in rule tags
+const (
+	FeatureNat44       = "nat44"
+	FeatureNat66       = "nat66"
+	FeatureNetmap6     = "netmap6"
+	FeaturePortForward = "portfwd"
+)
+
+type Tag struct {
+	Link    string
+	Feature string
+	Set     string
+}
+
+func NewTag(linkName, feature, set string) Tag {
+	return Tag{Link: linkName, Feature: feature, Set: set}
+}
+
+func (t Tag) String() string {
+	return fmt.Sprintf("%s:%s:%s:%s", TagPrefix, t.Link, t.Feature, t.Set)
+}
+
+// Match returns the comment match to embed in a rule
+func (t Tag) Match() string {
+	return fmt.Sprintf("-m comment --comment \"%s\"", t.String())
+}
+
+// ParseTag extracts the natman tag from a rule in command or -S format
+func ParseTag(rule string) (Tag, bool) {
+	parts := strings.Fields(rule)
+	for i, part := range parts {
+		if part != "--comment" || i+1 >= len(parts) {
+			continue
+		}
+
+		comment := strings.Trim(parts[i+1], "\"'")
+		fields := strings.Split(comment, ":")
+		if len(fields) != 4 || fields[0] != TagPrefix {
+			return Tag{}, false
+		}
+		return NewTag(fields[1], fields[2], fields[3]), true
+	}
+
+	return Tag{}, false
+}
+
+// Debug flag
+var Debug bool = false
+
+// SetDebug enables debug logging
+func SetDebug(debug bool) {
+	Debug = debug
+}
+
+// DebugPrint prints a message if debug mode is enabled
+func DebugPrint(format string, args ...interface{}) {
+	if Debug {
+		fmt.Printf("[IPTABLES-DEBUG] "+format+"\n", args...)
+	}
+}
+
+type Transaction struct {
+	Command string // iptables or ip6tables
+	tables  []string
+	chains  map[string][]string
+	lines   map[string][]string
+	added   []string
+	removed []string
+	ensured bool
+	limit   map[string]bool // links whose rules may change, nil for all
+}
+
+func NewTransaction(iptablesCmd string) *Transaction {
+	return &Transaction{
+		Command: iptablesCmd,
+		chains:  make(map[string][]string),
+		lines:   make(map[string][]string),
+	}
+}
+
+// EnsureChains stages the creation of missing natman chains and of the
+// jumps from the built-in chains. It only checks the system once per transaction.
+func (t *Transaction) EnsureChains() error {
+	if t.ensured {
+		return nil
+	}
+
+	for _, owned := range OwnedChains {
+		if owned.Command != "" && owned.Command != t.Command {
+			continue
+		}
+
+		_, exists, err := ListChain(t.Command, owned.Table, owned.Chain)
+		if err != nil {
+			return err
+		}
+
+		jump := fmt.Sprintf("%s -t %s -A %s -j %s", t.Command, owned.Table, owned.Parent, owned.Chain)
+
+		if !exists {
+			DebugPrint("Creating %s chain %s in table %s", t.Command, owned.Chain, owned.Table)
+			t.declareChain(owned.Table, owned.Chain)
+			t.added = append(t.added, fmt.Sprintf("%s -t %s -N %s", t.Command, owned.Table, owned.Chain))
+			if err := t.AddRule(jump); err != nil {
+				return err
+			}
+			continue
+		}
+
+		cmd := exec.Command(t.Command, "-t", owned.Table, "-C", owned.Parent, "-j", owned.Chain)
+		if err := cmd.Run(); err != nil {
+			DebugPrint("Adding jump from %s to %s in table %s", owned.Parent, owned.Chain, owned.Table)
+			if err := t.AddRule(jump); err != nil {
+				return err
+			}
+		}
+	}
+
+	t.ensured = true
+	return nil
+}
+
+// declareChain stages a user-defined chain declaration
+func (t *Transaction) declareChain(table, chain string) {
+	if _, ok := t.lines[table]; !ok {
+		t.tables = append(t.tables, table)
+		t.lines[table] = nil
+	}
+	t.chains[table] = append(t.chains[table], chain)
+}
+
+// Limit restricts the transaction to rules tagged for the given links.
+// Rules of other links are left as they are, untagged rules such as the
+// jumps into the natman chains are always staged.
+func (t *Transaction) Limit(links ...string) {
+	t.limit = make(map[string]bool)
+	for _, name := range links {
+		t.limit[name] = true
+	}
+}
+
+// inScope reports whether the transaction may change the rule
+func (t *Transaction) inScope(rule string) bool {
+	if t.limit == nil {
+		return true
+	}
+
+	tag, ok := ParseTag(rule)
+	if !ok || t.limit[tag.Link] {
+		return true
+	}
+
+	DebugPrint("Skipping rule outside of the transaction scope: %s", rule)
+	return false
+}
+
+// AddRule stages a rule in command format ("iptables -t nat -A CHAIN ...")
+func (t *Transaction) AddRule(rule string) error {
+	if !t.inScope(rule) {
+		return nil
+	}
+
+	table, spec, err := t.splitRule(rule)
+	if err != nil {
+		return err
+	}
+
+	t.Append(table, spec)
+	t.added = append(t.added, rule)
+	return nil
+}
+
+// InsertRule stages a rule in command format at the top of its chain, for
+// rules that must be evaluated before the ones already in place
+func (t *Transaction) InsertRule(rule string) error {
+	if !t.inScope(rule) {
+		return nil
+	}
+
+	table, spec, err := t.splitRule(rule)
+	if err != nil {
+		return err
+	}
+
+	t.Append(table, strings.Replace(spec, "-A ", "-I ", 1))
+	t.added = append(t.added, rule)
+	return nil
+}
+
+// DeleteRule stages the removal of a rule in command format
+func (t *Transaction) DeleteRule(rule string) error {
+	if !t.inScope(rule) {
+		return nil
+	}
+
+	table, spec, err := t.splitRule(rule)
+	if err != nil {
+		return err
+	}
+
+	t.Append(table, strings.Replace(spec, "-A ", "-D ", 1))
+	t.removed = append(t.removed, rule)
+	return nil
+}
+
+// Append stages a raw iptables-restore line for the given table
+func (t *Transaction) Append(table, line string) {
+	if _, ok := t.lines[table]; !ok {
+		t.tables = append(t.tables, table)
+	}
+	t.lines[table] = append(t.lines[table], line)
+}
+
+// Added returns the rules staged for addition
+func (t *Transaction) Added() []string {
+	return t.added
+}
+
+// Removed returns the rules staged for removal
+func (t *Transaction) Removed() []string {
+	return t.removed
+}
+
+func (t *Transaction) Empty() bool {
+	return len(t.tables) == 0
+}
+
+// Payload renders the staged changes in iptables-restore format
+func (t *Transaction) Payload() string {
+	var payload strings.Builder
+
+	for _, table := range t.tables {
+		payload.WriteString(fmt.Sprintf("*%s\n", table))
+		for _, chain := range t.chains[table] {
+			payload.WriteString(fmt.Sprintf(":%s - [0:0]\n", chain))
+		}
+		for _, line := range t.lines[table] {
+			payload.WriteString(line)
+			payload.WriteString("\n")
+		}
+		payload.WriteString("COMMIT\n")
+	}
+
+	return payload.String()
+}
+
+// splitRule turns "iptables -t nat -A CHAIN ..." into the table and the rule spec
+func (t *Transaction) splitRule(rule string) (string, string, error) {
+	parts := strings.Fields(rule)
+	if len(parts) == 0 {
+		return "", "", fmt.Errorf("empty rule")
+	}
+	if parts[0] != t.Command {
+		return "", "", fmt.Errorf("rule '%s' does not belong to a %s transaction", rule, t.Command)
+	}
+
+	table := "filter"
+	var spec []string
+	for i := 1; i < len(parts); i++ {
+		if parts[i] == "-t" && i+1 < len(parts) {
+			table = parts[i+1]
+			i++
+			continue
+		}
+		spec = append(spec, parts[i])
+	}
+
+	if len(spec) == 0 {
+		return "", "", fmt.Errorf("rule '%s' has no rule spec", rule)
+	}
+
+	return table, strings.Join(spec, " "), nil
+}
+
+// ListChain returns the rules of a chain in -S format. A missing chain
+// is not an error, it is reported through the exists flag.
+func ListChain(iptablesCmd, table, chain string) ([]string, bool, error) {
+	cmd := exec.Command(iptablesCmd, "-t", table, "-S", chain)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(output), "No chain") || strings.Contains(string(output), "does not exist") {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("failed to list %s chain %s: %v, output: %s",
+			iptablesCmd, chain, err, strings.TrimSpace(string(output)))
+	}
+
+	var rules []string
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "-A ") {
+			rules = append(rules, line)
+		}
+	}
+
+	return rules, true, nil
+}
+
+// Commit applies all transactions, rolling every one of them back to
+// the saved state if any commit fails
+func Commit(transactions ...*Transaction) error {
+	var pending []*Transaction
+	for _, t := range transactions {
+		if t != nil && !t.Empty() {
+			pending = append(pending, t)
+		}
+	}
+
+	if len(pending) == 0 {
+		DebugPrint("Nothing to commit")
+		return nil
+	}
+
+	// Keep the previous state for rollback
+	snapshots := make([]string, len(pending))
+	for i, t := range pending {
+		snapshot, err := t.save()
+		if err != nil {
+			return fmt.Errorf("failed to save current %s state: %v", t.Command, err)
+		}
+		snapshots[i] = snapshot
+	}
+
+	for i, t := range pending {
+		DebugPrint("Committing %s transaction:\n%s", t.Command, t.Payload())
+		if err := restore(t.Command, t.Payload(), true); err != nil {
+			commitErr := fmt.Errorf("%s transaction failed: %v", t.Command, err)
+
+			// Roll back this and every previously committed transaction
+			for j := i; j >= 0; j-- {
+				if rbErr := restore(pending[j].Command, snapshots[j], false); rbErr != nil {
+					return fmt.Errorf("%v; rollback of %s failed: %v", commitErr, pending[j].Command, rbErr)
+				}
+			}
+
+			return fmt.Errorf("%v (previous state restored)", commitErr)
+		}
+	}
+
+	return nil
+}
+
+// save captures the tables touched by the transaction
+func (t *Transaction) save() (string, error) {
+	var snapshot strings.Builder
+
+	for _, table := range t.tables {
+		cmd := exec.Command(t.Command+"-save", "-t", table)
+		output, err := cmd.Output()
+		if err != nil {
+			return "", err
+		}
+		snapshot.Write(output)
+	}
+
+	return snapshot.String(), nil
+}
+
+func restore(iptablesCmd, payload string, noflush bool) error {
+	var args []string
+	if noflush {
+		args = append(args, "--noflush")
+	}
+
+	cmd := exec.Command(iptablesCmd+"-restore", args...)
+	cmd.Stdin = strings.NewReader(payload)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v, output: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
@@ -0,0 +1,223 @@
+package iptablesmanager
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPayload(t *testing.T) {
+	tx := NewTransaction("iptables")
+	tx.declareChain("nat", ChainPostrouting)
+
+	for _, step := range []struct {
+		stage func(string) error
+		rule  string
+	}{
+		{tx.AddRule, "iptables -t nat -A POSTROUTING -j NATMAN-POSTROUTING"},
+		{tx.AddRule, `iptables -t nat -A NATMAN-POSTROUTING -o eth0 -m comment --comment "natman:eth0:nat44:masquerade" -j MASQUERADE`},
+		{tx.InsertRule, `iptables -t nat -A NATMAN-POSTROUTING -d 10.0.0.0/8 -o eth0 -m comment --comment "natman:eth0:nat44:exclude" -j RETURN`},
+		{tx.DeleteRule, `iptables -t mangle -A NATMAN-MSS -o eth0 -p tcp -m comment --comment "natman:eth0:nat44:mss" -j TCPMSS --set-mss 1400`},
+		{tx.AddRule, "iptables -A FORWARD -j ACCEPT"},
+	} {
+		if err := step.stage(step.rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := `*nat
+:NATMAN-POSTROUTING - [0:0]
+-A POSTROUTING -j NATMAN-POSTROUTING
+-A NATMAN-POSTROUTING -o eth0 -m comment --comment "natman:eth0:nat44:masquerade" -j MASQUERADE
+-I NATMAN-POSTROUTING -d 10.0.0.0/8 -o eth0 -m comment --comment "natman:eth0:nat44:exclude" -j RETURN
+COMMIT
+*mangle
+-D NATMAN-MSS -o eth0 -p tcp -m comment --comment "natman:eth0:nat44:mss" -j TCPMSS --set-mss 1400
+COMMIT
+*filter
+-A FORWARD -j ACCEPT
+COMMIT
+`
+	if got := tx.Payload(); got != want {
+		t.Errorf("payload:\n%s\nwant\n%s", got, want)
+	}
+	if len(tx.Added()) != 4 || len(tx.Removed()) != 1 {
+		t.Errorf("staged %d additions and %d removals, want 4 and 1", len(tx.Added()), len(tx.Removed()))
+	}
+}
+
+func TestStageInvalidRules(t *testing.T) {
+	for _, rule := range []string{
+		"",
+		"ip6tables -t nat -A NATMAN-POSTROUTING -j MASQUERADE",
+		"iptables -t nat",
+	} {
+		tx := NewTransaction("iptables")
+		if err := tx.AddRule(rule); err == nil {
+			t.Errorf("AddRule(%q) succeeded", rule)
+		}
+		if !tx.Empty() {
+			t.Errorf("AddRule(%q) staged %q", rule, tx.Payload())
+		}
+	}
+}
+
+func TestLimit(t *testing.T) {
+	rule := func(linkName string) string {
+		return "iptables -t nat -A NATMAN-POSTROUTING -o " + linkName + " " +
+			NewTag(linkName, FeatureNat44, "masquerade").Match() + " -j MASQUERADE"
+	}
+	jump := "iptables -t nat -A POSTROUTING -j NATMAN-POSTROUTING"
+
+	tests := []struct {
+		name    string
+		limit   []string // nil for no limit
+		added   []string
+		removed int // removals of eth0's rule
+	}{
+		{"no limit", nil, []string{rule("eth0"), rule("eth1"), jump}, 1},
+		{"one link", []string{"eth1"}, []string{rule("eth1"), jump}, 0},
+		{"no links", []string{}, []string{jump}, 0},
+	}
+
+	for _, tt := range tests {
+		tx := NewTransaction("iptables")
+		if tt.limit != nil {
+			tx.Limit(tt.limit...)
+		}
+		for _, r := range []string{rule("eth0"), rule("eth1"), jump} {
+			if err := tx.AddRule(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.DeleteRule(rule("eth0")); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(tx.Added(), tt.added) {
+			t.Errorf("%s: added\n%q\nwant\n%q", tt.name, tx.Added(), tt.added)
+		}
+		if len(tx.Removed()) != tt.removed {
+			t.Errorf("%s: removed %q", tt.name, tx.Removed())
+		}
+	}
+}
+
+func TestParseTag(t *testing.T) {
+	tag := NewTag("eth0", FeaturePortForward, "tcp-8080")
+	if tag.String() != "natman:eth0:portfwd:tcp-8080" {
+		t.Errorf("tag renders as %s", tag)
+	}
+
+	tests := []struct {
+		rule string
+		want Tag
+		ok   bool
+	}{
+		// A rule as natman renders it and as iptables -S lists it
+		{"iptables -t nat -A NATMAN-PREROUTING -p tcp --dport 8080 " + tag.Match() + " -j DNAT", tag, true},
+		{"-A NATMAN-PREROUTING -p tcp -m tcp --dport 8080 -m comment --comment natman:eth0:portfwd:tcp-8080 -j DNAT", tag, true},
+		{"-A NATMAN-POSTROUTING -m comment --comment 'natman:eth1:netmap6:c1' -j NETMAP", NewTag("eth1", FeatureNetmap6, "c1"), true},
+		{"-A POSTROUTING -o eth0 -j MASQUERADE", Tag{}, false},
+		{"-A POSTROUTING -m comment --comment \"added by hand\" -j MASQUERADE", Tag{}, false},
+		{"-A POSTROUTING -m comment --comment other:eth0:nat44:masquerade -j MASQUERADE", Tag{}, false},
+		{"-A POSTROUTING -m comment --comment natman:eth0:nat44 -j MASQUERADE", Tag{}, false},
+		{"-A POSTROUTING -m comment --comment", Tag{}, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := ParseTag(tt.rule)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("ParseTag(%q) = %+v, %t, want %+v, %t", tt.rule, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// fakeRestore puts iptables-save and iptables-restore stubs for both
+// families on PATH. The save stubs print a snapshot naming the table, the
+// restore stubs log their arguments and input and fail on input
+// containing FAIL. It returns the path of the log.
+func fakeRestore(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	save := "#!/bin/sh\nprintf '*%s\\n:snapshot-of-%s - [0:0]\\nCOMMIT\\n' \"$2\" \"$(basename $0)\"\n"
+	restore := "#!/bin/sh\ninput=$(cat)\nprintf '%s %s\\n%s\\n' \"$(basename $0)\" \"$*\" \"$input\" >> " + log + "\n" +
+		"case \"$input\" in *FAIL*) echo 'line 2 failed' >&2; exit 1;; esac\n"
+
+	for _, command := range []string{"iptables", "ip6tables"} {
+		if err := os.WriteFile(filepath.Join(dir, command+"-save"), []byte(save), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, command+"-restore"), []byte(restore), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return log
+}
+
+func TestCommitRollsBack(t *testing.T) {
+	log := fakeRestore(t)
+
+	ipv4 := NewTransaction("iptables")
+	ipv4.Append("nat", "-A NATMAN-POSTROUTING -j MASQUERADE")
+	ipv6 := NewTransaction("ip6tables")
+	ipv6.Append("nat", "-A NATMAN-POSTROUTING -j FAIL")
+
+	err := Commit(ipv4, NewTransaction("iptables"), ipv6)
+	if err == nil || !strings.Contains(err.Error(), "ip6tables transaction failed") ||
+		!strings.Contains(err.Error(), "previous state restored") {
+		t.Fatalf("Commit returned %v", err)
+	}
+
+	// Both families went back to their snapshots, the failed one first
+	want := `iptables-restore --noflush
+*nat
+-A NATMAN-POSTROUTING -j MASQUERADE
+COMMIT
+ip6tables-restore --noflush
+*nat
+-A NATMAN-POSTROUTING -j FAIL
+COMMIT
+ip6tables-restore 
+*nat
+:snapshot-of-ip6tables-save - [0:0]
+COMMIT
+iptables-restore 
+*nat
+:snapshot-of-iptables-save - [0:0]
+COMMIT
+`
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Errorf("restore calls:\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestCommitSuccess(t *testing.T) {
+	log := fakeRestore(t)
+
+	if err := Commit(NewTransaction("iptables"), nil); err != nil {
+		t.Fatalf("empty commit failed: %v", err)
+	}
+	if _, err := os.Stat(log); !os.IsNotExist(err) {
+		t.Errorf("empty transactions were restored")
+	}
+
+	tx := NewTransaction("iptables")
+	tx.Append("mangle", "-A NATMAN-MSS -j ACCEPT")
+	if err := Commit(tx); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(log)
+	if !strings.HasPrefix(string(data), "iptables-restore --noflush\n*mangle\n") || strings.Count(string(data), "iptables-restore") != 1 {
+		t.Errorf("restore calls:\n%s", data)
+	}
+}
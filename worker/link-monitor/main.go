@@ -0,0 +1,205 @@
+package linkmonitor
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Debug flag
+var Debug bool = false
+
+// SetDebug enables debug logging
+func SetDebug(debug bool) {
+	Debug = debug
+}
+
+// DebugPrint prints a message if debug mode is enabled
+func DebugPrint(format string, args ...interface{}) {
+	if Debug {
+		fmt.Printf("[LINKMON-DEBUG] "+format+"\n", args...)
+	}
+}
+
+// Kinds of interface events reported by the monitor
+const (
+	EventAppeared = "appeared"
+	EventUp       = "up"
+	EventAddress  = "address changed"
+)
+
+// rtnetlink multicast groups from linux/rtnetlink.h, not exported by syscall
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4Ifaddr = 0x10
+	rtmgrpIPv6Ifaddr = 0x100
+)
+
+// Event reports a change on a network interface
+type Event struct {
+	Link string
+	Kind string
+}
+
+// Monitor receives rtnetlink link and address notifications
+type Monitor struct {
+	Events <-chan Event
+
+	file *os.File
+
+	// Last known name and state per interface index, so that repeated
+	// RTM_NEWLINK notifications for an unchanged link are not reported
+	names map[int32]string
+	up    map[int32]bool
+}
+
+// Subscribe joins the rtnetlink link and IPv4/IPv6 address multicast groups
+func Subscribe() (*Monitor, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK,
+		syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %v", err)
+	}
+
+	addr := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4Ifaddr | rtmgrpIPv6Ifaddr,
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to subscribe to rtnetlink events: %v", err)
+	}
+
+	events := make(chan Event, 16)
+	m := &Monitor{
+		Events: events,
+		file:   os.NewFile(uintptr(fd), "rtnetlink"),
+		names:  make(map[int32]string),
+		up:     make(map[int32]bool),
+	}
+
+	// Interfaces present at startup have not appeared
+	if ifaces, err := net.Interfaces(); err == nil {
+		for _, iface := range ifaces {
+			index := int32(iface.Index)
+			m.names[index] = iface.Name
+			m.up[index] = iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagRunning != 0
+		}
+	}
+
+	go m.run(events)
+	return m, nil
+}
+
+// Close stops the monitor and closes the Events channel. The channel is
+// also closed when reading the socket fails.
+func (m *Monitor) Close() error {
+	return m.file.Close()
+}
+
+func (m *Monitor) run(events chan<- Event) {
+	defer close(events)
+
+	buf := make([]byte, os.Getpagesize()*4)
+	for {
+		n, err := m.file.Read(buf)
+		if errors.Is(err, syscall.ENOBUFS) {
+			// The kernel dropped events, the socket itself is still usable
+			fmt.Println("Warning: rtnetlink event queue overflowed, some interface events were lost")
+			continue
+		}
+		if err != nil {
+			DebugPrint("Stopped reading rtnetlink events: %v", err)
+			return
+		}
+
+		messages, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			DebugPrint("Failed to parse netlink message: %v", err)
+			continue
+		}
+
+		for _, msg := range messages {
+			if event, ok := m.handle(msg); ok {
+				DebugPrint("Link %s %s", event.Link, event.Kind)
+				events <- event
+			}
+		}
+	}
+}
+
+// handle turns a netlink message into an event, tracking link state
+func (m *Monitor) handle(msg syscall.NetlinkMessage) (Event, bool) {
+	switch msg.Header.Type {
+	case syscall.RTM_NEWLINK:
+		if len(msg.Data) < syscall.SizeofIfInfomsg {
+			return Event{}, false
+		}
+		info := (*syscall.IfInfomsg)(unsafe.Pointer(&msg.Data[0]))
+		name := linkName(msg)
+		if name == "" {
+			return Event{}, false
+		}
+
+		up := info.Flags&syscall.IFF_UP != 0 && info.Flags&syscall.IFF_RUNNING != 0
+		previous, known := m.names[info.Index]
+		wasUp := m.up[info.Index]
+		m.names[info.Index] = name
+		m.up[info.Index] = up
+
+		switch {
+		case !known || previous != name:
+			return Event{Link: name, Kind: EventAppeared}, true
+		case up && !wasUp:
+			return Event{Link: name, Kind: EventUp}, true
+		}
+
+	case syscall.RTM_DELLINK:
+		if len(msg.Data) < syscall.SizeofIfInfomsg {
+			return Event{}, false
+		}
+		info := (*syscall.IfInfomsg)(unsafe.Pointer(&msg.Data[0]))
+		delete(m.names, info.Index)
+		delete(m.up, info.Index)
+
+	case syscall.RTM_NEWADDR, syscall.RTM_DELADDR:
+		if len(msg.Data) < syscall.SizeofIfAddrmsg {
+			return Event{}, false
+		}
+		info := (*syscall.IfAddrmsg)(unsafe.Pointer(&msg.Data[0]))
+		name, ok := m.names[int32(info.Index)]
+		if !ok {
+			iface, err := net.InterfaceByIndex(int(info.Index))
+			if err != nil {
+				return Event{}, false
+			}
+			name = iface.Name
+		}
+		return Event{Link: name, Kind: EventAddress}, true
+	}
+
+	return Event{}, false
+}
+
+// linkName extracts IFLA_IFNAME from a link message
+func linkName(msg syscall.NetlinkMessage) string {
+	attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+	if err != nil {
+		return ""
+	}
+
+	for _, attr := range attrs {
+		if attr.Attr.Type == syscall.IFLA_IFNAME {
+			name := attr.Value
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			return string(name)
+		}
+	}
+
+	return ""
+}
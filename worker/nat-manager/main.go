@@ -3,9 +3,11 @@ package natmanager
 import (
 	"fmt"
 	"os/exec"
+	"slices"
 	"strings"
 
 	"natman/link"
+	iptablesmanager "natman/worker/iptables-manager"
 )
 
 // Global quiet mode flag
@@ -24,20 +26,37 @@ func SetQuietMode(quiet bool) {
 // remove them from iptables
 
 func ApplyNatRules(links map[string]*link.Link) error {
-	// Apply NAT44 rules
-	if err := applyNat44Rules(links); err != nil {
-		return fmt.Errorf("failed to apply NAT44 rules: %v", err)
+	ipv4 := iptablesmanager.NewTransaction("iptables")
+	ipv6 := iptablesmanager.NewTransaction("ip6tables")
+
+	if err := StageNatRules(links, ipv4, ipv6); err != nil {
+		return err
+	}
+
+	return iptablesmanager.Commit(ipv4, ipv6)
+}
+
+// StageNatRules computes the NAT44/NAT66 rule changes and stages them
+// in the given transactions without executing anything
+func StageNatRules(links map[string]*link.Link, ipv4, ipv6 *iptablesmanager.Transaction) error {
+	// Stage NAT44 rules
+	if err := stageNat44Rules(links, ipv4); err != nil {
+		return fmt.Errorf("failed to stage NAT44 rules: %v", err)
 	}
 
-	// Apply NAT66 rules
-	if err := applyNat66Rules(links); err != nil {
-		return fmt.Errorf("failed to apply NAT66 rules: %v", err)
+	// Stage NAT66 rules
+	if err := stageNat66Rules(links, ipv6); err != nil {
+		return fmt.Errorf("failed to stage NAT66 rules: %v", err)
 	}
 
 	return nil
 }
 
-func applyNat44Rules(links map[string]*link.Link) error {
+func stageNat44Rules(links map[string]*link.Link, tx *iptablesmanager.Transaction) error {
+	if err := tx.EnsureChains(); err != nil {
+		return err
+	}
+
 	// Get current NAT44 rules
 	currentRules, err := getCurrentNat44Rules()
 	if err != nil {
@@ -54,11 +73,13 @@ func applyNat44Rules(links map[string]*link.Link) error {
 
 	// Generate new rules
 	var newRules []string
-	for linkName, linkObj := range links {
+	for _, linkName := range link.SortedNames(links) {
+		linkObj := links[linkName]
 		if linkObj.Nat44 != nil && linkObj.Nat44.Enabled {
 			rules := generateNat44Rules(linkName, linkObj.Nat44)
 			newRules = append(newRules, rules...)
 		}
+		newRules = append(newRules, generatePortForwardRules(linkName, linkObj.PortForwards, false)...)
 	}
 
 	// Debug: Print new rules only if not in quiet mode
@@ -69,11 +90,15 @@ func applyNat44Rules(links map[string]*link.Link) error {
 		}
 	}
 
-	// Apply rule changes
-	return applyRuleChanges(currentRules, newRules)
+	// Stage rule changes
+	return stageRuleChanges(tx, currentRules, newRules)
 }
 
-func applyNat66Rules(links map[string]*link.Link) error {
+func stageNat66Rules(links map[string]*link.Link, tx *iptablesmanager.Transaction) error {
+	if err := tx.EnsureChains(); err != nil {
+		return err
+	}
+
 	// Get current NAT66 rules
 	currentRules, err := getCurrentNat66Rules()
 	if err != nil {
@@ -82,15 +107,17 @@ func applyNat66Rules(links map[string]*link.Link) error {
 
 	// Generate new rules
 	var newRules []string
-	for linkName, linkObj := range links {
+	for _, linkName := range link.SortedNames(links) {
+		linkObj := links[linkName]
 		if linkObj.Nat66 != nil && linkObj.Nat66.Enabled {
 			rules := generateNat66Rules(linkName, linkObj.Nat66)
 			newRules = append(newRules, rules...)
 		}
+		newRules = append(newRules, generatePortForwardRules(linkName, linkObj.PortForwards, true)...)
 	}
 
-	// Apply rule changes
-	return applyRuleChanges(currentRules, newRules)
+	// Stage rule changes
+	return stageRuleChanges(tx, currentRules, newRules)
 }
 
 func generateNat44Rules(interfaceName string, nat44 *link.Nat44) []string {
@@ -105,23 +132,49 @@ func generateNat44Rules(interfaceName string, nat44 *link.Nat44) []string {
 		return rules
 	}
 
-	// Basic masquerading rule
-	masqRule := fmt.Sprintf("iptables -t nat -A POSTROUTING -o %s -j MASQUERADE", interfaceName)
-	rules = append(rules, masqRule)
+	// Traffic to excluded destinations leaves the chain before any NAT rule
+	excludeTag := iptablesmanager.NewTag(interfaceName, iptablesmanager.FeatureNat44, "exclude")
+	for _, exclude := range nat44.Exclude {
+		excludeRule := fmt.Sprintf("iptables -t nat -A %s -d %s -o %s %s -j RETURN",
+			iptablesmanager.ChainPostrouting, exclude, interfaceName, excludeTag.Match())
+		rules = append(rules, excludeRule)
+	}
+
+	// Basic masquerading rule, or SNAT to the static addresses. With origins
+	// only the listed sources are translated.
+	if len(nat44.Origins) == 0 {
+		masqTag := iptablesmanager.NewTag(interfaceName, iptablesmanager.FeatureNat44, "masquerade")
+		for _, target := range natTargets(nat44.SnatTo, nat44.Persistent) {
+			masqRule := fmt.Sprintf("iptables -t nat -A %s -o %s %s%s %s",
+				iptablesmanager.ChainPostrouting, interfaceName, target.match, masqTag.Match(), target.jump)
+			rules = append(rules, masqRule)
+		}
+	}
 
 	// MSS clamping if enabled
 	if nat44.MssClamping && nat44.Mss > 0 {
-		mssRule := fmt.Sprintf("iptables -t mangle -A FORWARD -o %s -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss %d",
-			interfaceName, nat44.Mss)
+		mssTag := iptablesmanager.NewTag(interfaceName, iptablesmanager.FeatureNat44, "mss")
+		mssRule := fmt.Sprintf("iptables -t mangle -A %s -o %s -p tcp -m tcp --tcp-flags SYN,RST SYN %s -j TCPMSS --set-mss %d",
+			iptablesmanager.ChainMss, interfaceName, mssTag.Match(), nat44.Mss)
 		rules = append(rules, mssRule)
 	}
 
-	// Policy-based routing for origins
+	// Source NAT for the allowed origins
+	originTag := iptablesmanager.NewTag(interfaceName, iptablesmanager.FeatureNat44, "origin")
+	markTag := iptablesmanager.NewTag(interfaceName, iptablesmanager.FeatureNat44, "mark")
 	for _, origin := range nat44.Origins {
-		if origin != "" {
-			pbrRule := fmt.Sprintf("iptables -t nat -A POSTROUTING -s %s -o %s -j MASQUERADE", origin, interfaceName)
+		for _, target := range natTargets(origin.SnatTo, origin.Persistent) {
+			pbrRule := fmt.Sprintf("iptables -t nat -A %s -s %s -o %s %s%s %s",
+				iptablesmanager.ChainPostrouting, origin.Source, interfaceName, target.match, originTag.Match(), target.jump)
 			rules = append(rules, pbrRule)
 		}
+
+		// Mark the origin's packets for the ip rule of its routing table
+		if origin.Table != 0 && origin.Fwmark != 0 {
+			markRule := fmt.Sprintf("iptables -t mangle -A %s -s %s %s -j MARK --set-xmark 0x%x/0xffffffff",
+				iptablesmanager.ChainMark, origin.Source, markTag.Match(), origin.Fwmark)
+			rules = append(rules, markRule)
+		}
 	}
 
 	return rules
@@ -139,86 +192,154 @@ func generateNat66Rules(interfaceName string, nat66 *link.Nat66) []string {
 		return rules
 	}
 
-	// Basic masquerading rule for IPv6
-	masqRule := fmt.Sprintf("ip6tables -t nat -A POSTROUTING -o %s -j MASQUERADE", interfaceName)
-	rules = append(rules, masqRule)
+	// Traffic to excluded destinations leaves the chain before any NAT rule
+	excludeTag := iptablesmanager.NewTag(interfaceName, iptablesmanager.FeatureNat66, "exclude")
+	for _, exclude := range nat66.Exclude {
+		excludeRule := fmt.Sprintf("ip6tables -t nat -A %s -d %s -o %s %s -j RETURN",
+			iptablesmanager.ChainPostrouting, exclude, interfaceName, excludeTag.Match())
+		rules = append(rules, excludeRule)
+	}
+
+	// Basic masquerading rule for IPv6, or SNAT to the static addresses. With origins
+	// only the listed sources are translated.
+	if len(nat66.Origins) == 0 {
+		masqTag := iptablesmanager.NewTag(interfaceName, iptablesmanager.FeatureNat66, "masquerade")
+		for _, target := range natTargets(nat66.SnatTo, nat66.Persistent) {
+			masqRule := fmt.Sprintf("ip6tables -t nat -A %s -o %s %s%s %s",
+				iptablesmanager.ChainPostrouting, interfaceName, target.match, masqTag.Match(), target.jump)
+			rules = append(rules, masqRule)
+		}
+	}
 
 	// MSS clamping if enabled
 	if nat66.MssClamping && nat66.Mss > 0 {
-		mssRule := fmt.Sprintf("ip6tables -t mangle -A FORWARD -o %s -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss %d",
-			interfaceName, nat66.Mss)
+		mssTag := iptablesmanager.NewTag(interfaceName, iptablesmanager.FeatureNat66, "mss")
+		mssRule := fmt.Sprintf("ip6tables -t mangle -A %s -o %s -p tcp -m tcp --tcp-flags SYN,RST SYN %s -j TCPMSS --set-mss %d",
+			iptablesmanager.ChainMss, interfaceName, mssTag.Match(), nat66.Mss)
 		rules = append(rules, mssRule)
 	}
 
-	// Policy-based routing for origins
+	// Source NAT for the allowed origins
+	originTag := iptablesmanager.NewTag(interfaceName, iptablesmanager.FeatureNat66, "origin")
+	markTag := iptablesmanager.NewTag(interfaceName, iptablesmanager.FeatureNat66, "mark")
 	for _, origin := range nat66.Origins {
-		if origin != "" {
-			pbrRule := fmt.Sprintf("ip6tables -t nat -A POSTROUTING -s %s -o %s -j MASQUERADE", origin, interfaceName)
+		for _, target := range natTargets(origin.SnatTo, origin.Persistent) {
+			pbrRule := fmt.Sprintf("ip6tables -t nat -A %s -s %s -o %s %s%s %s",
+				iptablesmanager.ChainPostrouting, origin.Source, interfaceName, target.match, originTag.Match(), target.jump)
 			rules = append(rules, pbrRule)
 		}
+
+		// Mark the origin's packets for the ip rule of its routing table
+		if origin.Table != 0 && origin.Fwmark != 0 {
+			markRule := fmt.Sprintf("ip6tables -t mangle -A %s -s %s %s -j MARK --set-xmark 0x%x/0xffffffff",
+				iptablesmanager.ChainMark, origin.Source, markTag.Match(), origin.Fwmark)
+			rules = append(rules, markRule)
+		}
+	}
+
+	return rules
+}
+
+// natTarget is the jump of a source NAT rule and the match that selects
+// the connections taking it
+type natTarget struct {
+	match string
+	jump  string
+}
+
+// natTargets returns MASQUERADE without snat-to, otherwise one SNAT target
+// per address or range. Several addresses are used round-robin: each rule
+// takes every n-th new connection of those the rules before it let through.
+func natTargets(snatTo []string, persistent bool) []natTarget {
+	if len(snatTo) == 0 {
+		return []natTarget{{jump: "-j MASQUERADE"}}
+	}
+
+	options := ""
+	if persistent {
+		options = " --persistent"
+	}
+
+	targets := make([]natTarget, len(snatTo))
+	for i, address := range snatTo {
+		targets[i].jump = fmt.Sprintf("-j SNAT --to-source %s%s", address, options)
+		if remaining := len(snatTo) - i; remaining > 1 {
+			targets[i].match = fmt.Sprintf("-m statistic --mode nth --every %d --packet 0 ", remaining)
+		}
+	}
+	return targets
+}
+
+// generatePortForwardRules renders the DNAT rules of the forwards of one
+// address family. Port forwards do not depend on nat44/nat66 being enabled.
+func generatePortForwardRules(interfaceName string, forwards []*link.PortForward, ipv6 bool) []string {
+	var rules []string
+
+	iptablesCmd := "iptables"
+	if ipv6 {
+		iptablesCmd = "ip6tables"
+	}
+
+	for _, forward := range forwards {
+		if forward.IPv6() != ipv6 {
+			continue
+		}
+
+		source := ""
+		if forward.Source.IsValid() {
+			source = "-s " + forward.Source.String() + " "
+		}
+
+		// Same option order as iptables -S so reconciliation compares equal
+		tag := iptablesmanager.NewTag(interfaceName, iptablesmanager.FeaturePortForward, forward.Name())
+		rule := fmt.Sprintf("%s -t nat -A %s %s-i %s -p %s -m %s --dport %s %s -j DNAT --to-destination %s",
+			iptablesCmd, iptablesmanager.ChainPrerouting, source, interfaceName,
+			forward.Proto, forward.Proto, forward.Ports(":"), tag.Match(), forward.Destination())
+		rules = append(rules, rule)
 	}
 
 	return rules
 }
 
 func getCurrentNat44Rules() ([]string, error) {
-	return getCurrentNatRules("iptables")
+	return getCurrentNatRules("iptables", iptablesmanager.FeatureNat44, iptablesmanager.FeaturePortForward)
 }
 
 func getCurrentNat66Rules() ([]string, error) {
-	return getCurrentNatRules("ip6tables")
+	return getCurrentNatRules("ip6tables", iptablesmanager.FeatureNat66, iptablesmanager.FeaturePortForward)
 }
 
-func getCurrentNatRules(iptablesCmd string) ([]string, error) {
+// getCurrentNatRules reads the rules tagged with one of the given features
+// from the natman chains, untagged rules and built-in chains are never touched
+func getCurrentNatRules(iptablesCmd string, features ...string) ([]string, error) {
 	var rules []string
 
-	// Get NAT table rules
-	cmd := exec.Command(iptablesCmd, "-t", "nat", "-S")
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, err
-	}
-
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		// Look for MASQUERADE, SNAT, or DNAT rules
-		if (strings.Contains(line, "MASQUERADE") || strings.Contains(line, "SNAT") || strings.Contains(line, "DNAT")) && strings.HasPrefix(line, "-A ") {
-			// Extract the chain and rule details
-			parts := strings.Fields(line)
-			if len(parts) >= 2 {
-				chain := parts[1]
+	// Get NAT chain rules
+	for _, chain := range []string{iptablesmanager.ChainPostrouting, iptablesmanager.ChainPrerouting} {
+		lines, _, err := iptablesmanager.ListChain(iptablesCmd, "nat", chain)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range lines {
+			if ownedBy(line, features) {
 				// Convert to full command format using the iptablesCmd parameter
-				rule := iptablesCmd + " -t nat -A " + chain
-				for i := 2; i < len(parts); i++ {
-					rule += " " + parts[i]
-				}
-				rules = append(rules, rule)
+				rules = append(rules, iptablesCmd+" -t nat "+line)
 			}
 		}
 	}
 
-	// Get mangle table rules for MSS clamping using the same iptablesCmd
-	cmd = exec.Command(iptablesCmd, "-t", "mangle", "-S")
-	output, err = cmd.Output()
-	if err != nil {
-		return rules, nil // Don't fail if mangle table query fails
-	}
+	// Get MSS clamping and policy routing mark rules using the same iptablesCmd
+	for _, chain := range []string{iptablesmanager.ChainMss, iptablesmanager.ChainMark} {
+		lines, _, err := iptablesmanager.ListChain(iptablesCmd, "mangle", chain)
+		if err != nil {
+			return rules, nil // Don't fail if mangle table query fails
+		}
 
-	lines = strings.Split(string(output), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.Contains(line, "TCPMSS") && strings.HasPrefix(line, "-A ") {
-			// Extract the chain and rule details
-			parts := strings.Fields(line)
-			if len(parts) >= 2 {
-				chain := parts[1]
+		for _, line := range lines {
+			if ownedBy(line, features) {
 				// Convert to full command format using the iptablesCmd parameter
-				rule := iptablesCmd + " -t mangle -A " + chain
-				for i := 2; i < len(parts); i++ {
-					rule += " " + parts[i]
-				}
-				rules = append(rules, rule)
+				rules = append(rules, iptablesCmd+" -t mangle "+line)
 			}
 		}
 	}
@@ -226,7 +347,22 @@ func getCurrentNatRules(iptablesCmd string) ([]string, error) {
 	return rules, nil
 }
 
-func applyRuleChanges(currentRules, newRules []string) error {
+// ownedBy reports whether the rule carries a natman tag for one of the features
+func ownedBy(rule string, features []string) bool {
+	tag, ok := iptablesmanager.ParseTag(rule)
+	if !ok {
+		return false
+	}
+
+	for _, feature := range features {
+		if tag.Feature == feature {
+			return true
+		}
+	}
+	return false
+}
+
+func stageRuleChanges(tx *iptablesmanager.Transaction, currentRules, newRules []string) error {
 	// Normalize rules for comparison
 	normalizedCurrent := make([]string, len(currentRules))
 	normalizedNew := make([]string, len(newRules))
@@ -238,9 +374,12 @@ func applyRuleChanges(currentRules, newRules []string) error {
 		normalizedNew[i] = normalizeRule(rule)
 	}
 
-	// Calculate rules to add and remove using normalized versions
-	rulesToAdd := difference(normalizedNew, normalizedCurrent)
-	rulesToRemove := difference(normalizedCurrent, normalizedNew)
+	// Calculate rules to add and remove using normalized versions. The
+	// round-robin SNAT rules only work as an ordered set, a set with any
+	// changed member is replaced as a whole.
+	replaced := changedSnatSets(normalizedCurrent, normalizedNew)
+	rulesToAdd := differenceOrSet(normalizedNew, normalizedCurrent, replaced)
+	rulesToRemove := differenceOrSet(normalizedCurrent, normalizedNew, replaced)
 
 	// Map back to original rules
 	addMap := make(map[string]string)
@@ -255,20 +394,22 @@ func applyRuleChanges(currentRules, newRules []string) error {
 	// Remove old rules
 	for _, normRule := range rulesToRemove {
 		if origRule, ok := removeMap[normRule]; ok {
-			removeRule := strings.Replace(origRule, "-A ", "-D ", 1)
-			if err := executeIptablesRule(removeRule); err != nil {
-				if !QuietMode {
-					fmt.Printf("Warning: failed to remove rule %s: %v\n", removeRule, err)
-				}
+			if err := tx.DeleteRule(origRule); err != nil {
+				return fmt.Errorf("failed to stage removal of rule %s: %v", origRule, err)
 			}
 		}
 	}
 
-	// Add new rules
+	// Add new rules, excluded destinations go first so they are matched
+	// before the NAT rules already in the chain
 	for _, normRule := range rulesToAdd {
 		if origRule, ok := addMap[normRule]; ok {
-			if err := executeIptablesRule(origRule); err != nil {
-				return fmt.Errorf("failed to add rule %s: %v", origRule, err)
+			stage := tx.AddRule
+			if strings.HasSuffix(origRule, "-j RETURN") {
+				stage = tx.InsertRule
+			}
+			if err := stage(origRule); err != nil {
+				return fmt.Errorf("failed to stage rule %s: %v", origRule, err)
 			}
 		}
 	}
@@ -283,6 +424,10 @@ func normalizeRule(rule string) string {
 
 	// Normalize common variations
 	for i, part := range parts {
+		// Quoting of comments differs between generated and listed rules
+		part = strings.Trim(part, "\"")
+		parts[i] = part
+
 		// Normalize IP address representations
 		if part == "0.0.0.0/0" || part == "anywhere" {
 			parts[i] = "0.0.0.0/0"
@@ -294,22 +439,55 @@ func normalizeRule(rule string) string {
 	return strings.Join(parts, " ")
 }
 
-func executeIptablesRule(rule string) error {
+// snatSetKey identifies the SNAT set a rule belongs to: the masquerade or
+// SNAT rules of a link, or of one origin on it
+func snatSetKey(rule string) (string, bool) {
+	tag, ok := iptablesmanager.ParseTag(rule)
+	if !ok || (tag.Set != "masquerade" && tag.Set != "origin") {
+		return "", false
+	}
+
 	parts := strings.Fields(rule)
-	if len(parts) == 0 {
-		return fmt.Errorf("empty rule")
+	source := ""
+	for i, part := range parts {
+		if part == "-s" && i+1 < len(parts) {
+			source = parts[i+1]
+		}
 	}
+	return parts[0] + " " + tag.String() + " " + source, true
+}
 
-	cmd := exec.Command(parts[0], parts[1:]...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("command failed: %s, output: %s", err, string(output))
+// changedSnatSets returns the SNAT sets whose rules differ in any member
+// or in their order
+func changedSnatSets(currentRules, newRules []string) map[string]bool {
+	sets := func(rules []string) map[string][]string {
+		result := make(map[string][]string)
+		for _, rule := range rules {
+			if key, ok := snatSetKey(rule); ok {
+				result[key] = append(result[key], rule)
+			}
+		}
+		return result
 	}
 
-	return nil
+	current, wanted := sets(currentRules), sets(newRules)
+	changed := make(map[string]bool)
+	for key, rules := range wanted {
+		if !slices.Equal(rules, current[key]) {
+			changed[key] = true
+		}
+	}
+	for key := range current {
+		if _, ok := wanted[key]; !ok {
+			changed[key] = true
+		}
+	}
+	return changed
 }
 
-func difference(slice1, slice2 []string) []string {
+// differenceOrSet returns the rules of slice1 missing from slice2 and
+// every rule of slice1 that belongs to one of the replaced SNAT sets
+func differenceOrSet(slice1, slice2 []string, replaced map[string]bool) []string {
 	set := make(map[string]bool)
 	for _, item := range slice2 {
 		set[item] = true
@@ -317,7 +495,8 @@ func difference(slice1, slice2 []string) []string {
 
 	var result []string
 	for _, item := range slice1 {
-		if !set[item] {
+		key, ok := snatSetKey(item)
+		if !set[item] || (ok && replaced[key]) {
 			result = append(result, item)
 		}
 	}
@@ -325,7 +504,7 @@ func difference(slice1, slice2 []string) []string {
 	return result
 }
 
-func PrintCurrentNatRules() error {
+func PrintCurrentNatRules(links map[string]*link.Link) error {
 	if QuietMode {
 		return nil
 	}
@@ -342,7 +521,7 @@ func PrintCurrentNatRules() error {
 		fmt.Println("No IPv4 NAT rules found")
 	} else {
 		for i, rule := range ipv4Rules {
-			fmt.Printf("  %d. %s\n", i+1, rule)
+			fmt.Printf("  %d. [%s] %s\n", i+1, describeOwner(rule, links), rule)
 		}
 	}
 
@@ -355,13 +534,49 @@ func PrintCurrentNatRules() error {
 		fmt.Println("No IPv6 NAT rules found")
 	} else {
 		for i, rule := range ipv6Rules {
-			fmt.Printf("  %d. %s\n", i+1, rule)
+			fmt.Printf("  %d. [%s] %s\n", i+1, describeOwner(rule, links), rule)
 		}
 	}
 
 	return nil
 }
 
+// describeOwner attributes a tagged rule to the link in the config
+func describeOwner(rule string, links map[string]*link.Link) string {
+	tag, ok := iptablesmanager.ParseTag(rule)
+	if !ok {
+		return "untagged"
+	}
+
+	owner := fmt.Sprintf("%s/%s/%s", tag.Link, tag.Feature, tag.Set)
+	linkObj, ok := links[tag.Link]
+	if !ok {
+		return owner + ", link not in config"
+	}
+
+	switch tag.Feature {
+	case iptablesmanager.FeatureNat44:
+		if linkObj.Nat44 == nil || !linkObj.Nat44.Enabled {
+			return owner + ", nat44 not enabled in config"
+		}
+	case iptablesmanager.FeatureNat66:
+		if linkObj.Nat66 == nil || !linkObj.Nat66.Enabled {
+			return owner + ", nat66 not enabled in config"
+		}
+	case iptablesmanager.FeaturePortForward:
+		for _, forward := range linkObj.PortForwards {
+			if forward.Name() == tag.Set {
+				return owner
+			}
+		}
+		return owner + ", port forward not in config"
+	}
+
+	return owner
+}
+
+// CaptureNatRulesFromSystem returns the natman NAT rules grouped by the
+// link named in their tag
 func CaptureNatRulesFromSystem() (map[string]interface{}, error) {
 	result := make(map[string]interface{})
 
@@ -377,39 +592,23 @@ func CaptureNatRulesFromSystem() (map[string]interface{}, error) {
 		return nil, fmt.Errorf("failed to get IPv6 NAT rules: %v", err)
 	}
 
-	// Group rules by interface and type
-	ipv4ByInterface := groupNatRulesByInterface(ipv4Rules)
-	ipv6ByInterface := groupNatRulesByInterface(ipv6Rules)
-
-	result["ipv4"] = ipv4ByInterface
-	result["ipv6"] = ipv6ByInterface
+	// Group rules by link
+	result["ipv4"] = groupNatRulesByLink(ipv4Rules)
+	result["ipv6"] = groupNatRulesByLink(ipv6Rules)
 
 	return result, nil
 }
 
-func groupNatRulesByInterface(rules []string) map[string][]string {
-	rulesByInterface := make(map[string][]string)
+func groupNatRulesByLink(rules []string) map[string][]string {
+	rulesByLink := make(map[string][]string)
 
 	for _, rule := range rules {
-		var iface string
-
-		// Extract interface name from rule
-		if strings.Contains(rule, "-o ") {
-			parts := strings.Fields(rule)
-			for i, part := range parts {
-				if part == "-o" && i+1 < len(parts) {
-					iface = parts[i+1]
-					break
-				}
-			}
-		}
-
-		if iface != "" {
-			rulesByInterface[iface] = append(rulesByInterface[iface], rule)
+		if tag, ok := iptablesmanager.ParseTag(rule); ok {
+			rulesByLink[tag.Link] = append(rulesByLink[tag.Link], rule)
 		}
 	}
 
-	return rulesByInterface
+	return rulesByLink
 }
 
 func FlushNatRules(ipVersion string) error {
@@ -430,17 +629,25 @@ func FlushNatRules(ipVersion string) error {
 		return fmt.Errorf("invalid IP version: %s (use 'ipv4', 'ipv6', or 'both')", ipVersion)
 	}
 
-	// Flush NAT table
-	cmd := exec.Command(iptablesCmd, "-t", "nat", "-F")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to flush NAT table: %v", err)
+	// Flush the natman NAT chains, other rules in the NAT table are left alone
+	for _, chain := range []string{iptablesmanager.ChainPostrouting, iptablesmanager.ChainPrerouting} {
+		cmd := exec.Command(iptablesCmd, "-t", "nat", "-F", chain)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to flush NAT chain %s: %v", chain, err)
+		}
 	}
 
-	// Flush mangle table FORWARD chain (for MSS clamping)
-	cmd = exec.Command(iptablesCmd, "-t", "mangle", "-F", "FORWARD")
-	if err := cmd.Run(); err != nil {
-		if !QuietMode {
-			fmt.Printf("Warning: failed to flush mangle FORWARD chain: %v\n", err)
+	// Flush the natman MSS clamping, mark and NPTv6 chains
+	chains := []string{iptablesmanager.ChainMss, iptablesmanager.ChainMark}
+	if iptablesCmd == "ip6tables" {
+		chains = append(chains, iptablesmanager.ChainSnpt, iptablesmanager.ChainDnpt)
+	}
+	for _, chain := range chains {
+		cmd := exec.Command(iptablesCmd, "-t", "mangle", "-F", chain)
+		if err := cmd.Run(); err != nil {
+			if !QuietMode {
+				fmt.Printf("Warning: failed to flush mangle %s chain: %v\n", chain, err)
+			}
 		}
 	}
 
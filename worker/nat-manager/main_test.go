@@ -0,0 +1,202 @@
+package natmanager
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"natman/config"
+	"natman/link"
+	iptablesmanager "natman/worker/iptables-manager"
+)
+
+func TestStageRuleChangesReplacesSnatSets(t *testing.T) {
+	nat44 := func(snatTo ...string) *link.Nat44 {
+		return &link.Nat44{
+			Enabled: true,
+			Origins: []link.Origin{
+				{Source: "10.0.1.0/24", SnatTo: snatTo},
+				{Source: "10.0.2.0/24", SnatTo: []string{"203.0.113.9"}},
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		current  []string
+		wanted   []string
+		replaced int // rules of the first origin that are removed and added again
+	}{
+		{"address added", []string{"203.0.113.5", "203.0.113.6"}, []string{"203.0.113.5", "203.0.113.6", "203.0.113.7"}, 2},
+		{"last address changed", []string{"203.0.113.5", "203.0.113.6"}, []string{"203.0.113.5", "203.0.113.7"}, 2},
+		{"order changed", []string{"203.0.113.5", "203.0.113.6"}, []string{"203.0.113.6", "203.0.113.5"}, 2},
+		{"address removed", []string{"203.0.113.5", "203.0.113.6", "203.0.113.7"}, []string{"203.0.113.5", "203.0.113.7"}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			currentRules := generateNat44Rules("eth0", nat44(tt.current...))
+			newRules := generateNat44Rules("eth0", nat44(tt.wanted...))
+
+			tx := iptablesmanager.NewTransaction("iptables")
+			if err := stageRuleChanges(tx, currentRules, newRules); err != nil {
+				t.Fatal(err)
+			}
+
+			// The whole set of the first origin goes, in order, the other origin stays
+			if !slices.Equal(tx.Removed(), currentRules[:tt.replaced]) {
+				t.Errorf("removed rules:\n%q\nwant\n%q", tx.Removed(), currentRules[:tt.replaced])
+			}
+			if want := newRules[:len(tt.wanted)]; !slices.Equal(tx.Added(), want) {
+				t.Errorf("added rules:\n%q\nwant\n%q", tx.Added(), want)
+			}
+		})
+	}
+}
+
+func TestStageRuleChangesKeepsUnchangedSets(t *testing.T) {
+	rules := generateNat44Rules("eth0", &link.Nat44{
+		Enabled: true,
+		SnatTo:  []string{"203.0.113.5", "203.0.113.6"},
+	})
+
+	tx := iptablesmanager.NewTransaction("iptables")
+	if err := stageRuleChanges(tx, rules, rules); err != nil {
+		t.Fatal(err)
+	}
+	if !tx.Empty() {
+		t.Errorf("unchanged rules staged:\n%s", tx.Payload())
+	}
+}
+
+func TestGeneratePortForwardRules(t *testing.T) {
+	linkObj, errs := link.NewLink("eth0", config.LinkConfig{PortForwards: []config.PortForwardConfig{
+		{Proto: "tcp", Port: "443", To: "10.0.0.5:8443"},
+		{Proto: "udp", Port: "5000-5010", To: "10.0.0.6", Source: "198.51.100.0/24"},
+		{Proto: "tcp", Port: "22", To: "[fd00::5]:2222", Source: "2001:db8::1"},
+		{Proto: "tcp", Port: "80", To: "fd00::6"},
+	}})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	want4 := []string{
+		`iptables -t nat -A NATMAN-PREROUTING -i eth0 -p tcp -m tcp --dport 443 -m comment --comment "natman:eth0:portfwd:tcp-443" -j DNAT --to-destination 10.0.0.5:8443`,
+		`iptables -t nat -A NATMAN-PREROUTING -s 198.51.100.0/24 -i eth0 -p udp -m udp --dport 5000:5010 -m comment --comment "natman:eth0:portfwd:udp-5000-5010" -j DNAT --to-destination 10.0.0.6`,
+	}
+	want6 := []string{
+		`ip6tables -t nat -A NATMAN-PREROUTING -s 2001:db8::1/128 -i eth0 -p tcp -m tcp --dport 22 -m comment --comment "natman:eth0:portfwd:tcp-22" -j DNAT --to-destination [fd00::5]:2222`,
+		`ip6tables -t nat -A NATMAN-PREROUTING -i eth0 -p tcp -m tcp --dport 80 -m comment --comment "natman:eth0:portfwd:tcp-80" -j DNAT --to-destination fd00::6`,
+	}
+
+	if got := generatePortForwardRules("eth0", linkObj.PortForwards, false); !slices.Equal(got, want4) {
+		t.Errorf("IPv4 rules:\n%q\nwant\n%q", got, want4)
+	}
+	if got := generatePortForwardRules("eth0", linkObj.PortForwards, true); !slices.Equal(got, want6) {
+		t.Errorf("IPv6 rules:\n%q\nwant\n%q", got, want6)
+	}
+}
+
+func TestPortForwardErrors(t *testing.T) {
+	for _, forward := range []config.PortForwardConfig{
+		{Proto: "sctp", Port: "443", To: "10.0.0.5"},
+		{Proto: "tcp", Port: "8010-8000", To: "10.0.0.5"},
+		{Proto: "tcp", Port: "0", To: "10.0.0.5"},
+		{Proto: "tcp", Port: "443", To: "10.0.0.5:70000"},
+		{Proto: "tcp", Port: "443", To: "[fd00::5"},
+		{Proto: "tcp", Port: "443", To: "10.0.0.5", Source: "2001:db8::/32"},
+	} {
+		linkObj, errs := link.NewLink("eth0", config.LinkConfig{PortForwards: []config.PortForwardConfig{forward}})
+		if len(errs) == 0 || len(linkObj.PortForwards) != 0 {
+			t.Errorf("forward %+v was accepted", forward)
+		}
+	}
+}
+
+func TestExcludeAndOriginRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		nat44 *config.Nat44Config
+		want  []string
+	}{
+		{
+			name:  "exclude before masquerade",
+			nat44: &config.Nat44Config{Enabled: true, Exclude: []string{"10.0.0.0/8", "192.0.2.1"}},
+			want: []string{
+				`iptables -t nat -A NATMAN-POSTROUTING -d 10.0.0.0/8 -o eth0 -m comment --comment "natman:eth0:nat44:exclude" -j RETURN`,
+				`iptables -t nat -A NATMAN-POSTROUTING -d 192.0.2.1/32 -o eth0 -m comment --comment "natman:eth0:nat44:exclude" -j RETURN`,
+				`iptables -t nat -A NATMAN-POSTROUTING -o eth0 -m comment --comment "natman:eth0:nat44:masquerade" -j MASQUERADE`,
+			},
+		},
+		{
+			// Only the listed origins are translated, there is no blanket rule
+			name: "origins allow-list",
+			nat44: &config.Nat44Config{
+				Enabled: true,
+				SnatTo:  config.AddressList{"203.0.113.5"},
+				Exclude: []string{"10.0.0.0/8"},
+				Origins: []config.OriginConfig{{Source: "10.0.1.0/24"}, {Source: "10.0.2.0/24", SnatTo: config.AddressList{"203.0.113.6"}}},
+			},
+			want: []string{
+				`iptables -t nat -A NATMAN-POSTROUTING -d 10.0.0.0/8 -o eth0 -m comment --comment "natman:eth0:nat44:exclude" -j RETURN`,
+				`iptables -t nat -A NATMAN-POSTROUTING -s 10.0.1.0/24 -o eth0 -m comment --comment "natman:eth0:nat44:origin" -j SNAT --to-source 203.0.113.5`,
+				`iptables -t nat -A NATMAN-POSTROUTING -s 10.0.2.0/24 -o eth0 -m comment --comment "natman:eth0:nat44:origin" -j SNAT --to-source 203.0.113.6`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			linkObj, errs := link.NewLink("eth0", config.LinkConfig{Nat44: tt.nat44})
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if got := generateNat44Rules("eth0", linkObj.Nat44); !slices.Equal(got, tt.want) {
+				t.Errorf("rules:\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStageRuleChangesInsertsExcludes(t *testing.T) {
+	nat66 := &link.Nat66{Enabled: true}
+	currentRules := generateNat66Rules("eth0", nat66)
+
+	nat66.Exclude = []string{"fd00::/8"}
+	newRules := generateNat66Rules("eth0", nat66)
+
+	tx := iptablesmanager.NewTransaction("ip6tables")
+	if err := stageRuleChanges(tx, currentRules, newRules); err != nil {
+		t.Fatal(err)
+	}
+
+	// The RETURN rule goes to the top of the chain, ahead of the masquerade
+	// rule that stays in place
+	want := "*nat\n" +
+		`-I NATMAN-POSTROUTING -d fd00::/8 -o eth0 -m comment --comment "natman:eth0:nat66:exclude" -j RETURN` + "\n" +
+		"COMMIT\n"
+	if got := tx.Payload(); got != want {
+		t.Errorf("payload:\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestStageRuleChangesDropsBlanketRuleForOrigins(t *testing.T) {
+	nat44 := &link.Nat44{Enabled: true}
+	currentRules := generateNat44Rules("eth0", nat44)
+
+	nat44.Origins = []link.Origin{{Source: "10.0.1.0/24"}}
+	newRules := generateNat44Rules("eth0", nat44)
+
+	tx := iptablesmanager.NewTransaction("iptables")
+	if err := stageRuleChanges(tx, currentRules, newRules); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sources outside of the origins are no longer masqueraded
+	if !slices.Equal(tx.Removed(), currentRules) {
+		t.Errorf("removed rules:\n%q\nwant\n%q", tx.Removed(), currentRules)
+	}
+	if !slices.Equal(tx.Added(), newRules) || !strings.Contains(newRules[0], "-s 10.0.1.0/24 ") {
+		t.Errorf("added rules:\n%q\nwant\n%q", tx.Added(), newRules)
+	}
+}
@@ -0,0 +1,341 @@
+package nat64manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"natman/config"
+	"natman/link"
+)
+
+// It renders the configuration of the NAT64 translator (Jool or TAYGA)
+// and the optional DNS64 snippets of the nat64 sections, writes the files
+// that changed and reloads the translator. Files natman wrote before and
+// no longer needs are removed, files without the natman marker are never
+// touched. For TAYGA it also creates the tun device and routes the NAT64
+// prefix and the IPv4 pool into it.
+
+// Configuration files written by natman
+const (
+	JoolConfPath     = "/etc/jool/jool.conf"
+	TaygaConfPath    = "/etc/tayga.conf"
+	BindDns64Path    = "/etc/bind/natman-dns64.conf"
+	UnboundDns64Path = "/etc/unbound/unbound.conf.d/natman-dns64.conf"
+)
+
+// JoolInstance is the name of the Jool instance natman manages
+const JoolInstance = "natman"
+
+// TaygaDevice is the tun device TAYGA translates on
+const TaygaDevice = "nat64"
+
+// marker identifies files generated by natman
+const marker = "Generated by natman-go"
+
+// Debug flag
+var Debug bool = false
+
+// SetDebug enables debug logging
+func SetDebug(debug bool) {
+	Debug = debug
+}
+
+// DebugPrint prints a message if debug mode is enabled
+func DebugPrint(format string, args ...interface{}) {
+	if Debug {
+		fmt.Printf("[NAT64-DEBUG] "+format+"\n", args...)
+	}
+}
+
+// FilePlan describes how one generated file differs from the installed one
+type FilePlan struct {
+	Path    string `json:"path"`
+	Changed bool   `json:"changed"`
+	Remove  bool   `json:"remove,omitempty"`
+	Foreign bool   `json:"foreign,omitempty"` // installed without the natman marker, left alone
+
+	content string
+}
+
+// translator returns the nat64 section the translator is configured from.
+// The validator makes sure all enabled sections agree on it.
+func translator(links map[string]*link.Link) *link.Nat64 {
+	var names []string
+	for name, linkObj := range links {
+		if linkObj.Nat64 != nil && linkObj.Nat64.Enabled {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	return links[names[0]].Nat64
+}
+
+// desiredFiles renders the content of every file natman should own, by path
+func desiredFiles(links map[string]*link.Link) map[string]string {
+	files := make(map[string]string)
+
+	nat64 := translator(links)
+	if nat64 == nil {
+		return files
+	}
+
+	switch nat64.Translator {
+	case config.TranslatorJool:
+		files[JoolConfPath] = joolConfig(nat64)
+	case config.TranslatorTayga:
+		files[TaygaConfPath] = taygaConfig(nat64)
+	}
+
+	for _, name := range link.SortedNames(links) {
+		linkObj := links[name]
+		if linkObj.Nat64 == nil || !linkObj.Nat64.Enabled {
+			continue
+		}
+		switch linkObj.Nat64.Dns64 {
+		case config.Dns64Bind:
+			files[BindDns64Path] = bindDns64(nat64.Prefix)
+		case config.Dns64Unbound:
+			files[UnboundDns64Path] = unboundDns64(nat64.Prefix)
+		}
+	}
+
+	return files
+}
+
+type joolFile struct {
+	Comment   string      `json:"comment"`
+	Instance  string      `json:"instance"`
+	Framework string      `json:"framework"`
+	Global    joolGlobal  `json:"global"`
+	Pool4     []joolPool4 `json:"pool4,omitempty"`
+}
+
+type joolGlobal struct {
+	Pool6 string `json:"pool6"`
+}
+
+type joolPool4 struct {
+	Protocol string `json:"protocol"`
+	Prefix   string `json:"prefix"`
+}
+
+// joolConfig renders a Jool atomic configuration file for `jool file handle`
+func joolConfig(nat64 *link.Nat64) string {
+	file := joolFile{
+		Comment:   marker + ", do not edit manually",
+		Instance:  JoolInstance,
+		Framework: "netfilter",
+		Global:    joolGlobal{Pool6: nat64.Prefix.String()},
+	}
+	if nat64.Pool4.IsValid() {
+		for _, protocol := range []string{"TCP", "UDP", "ICMP"} {
+			file.Pool4 = append(file.Pool4, joolPool4{Protocol: protocol, Prefix: nat64.Pool4.String()})
+		}
+	}
+
+	data, _ := json.MarshalIndent(file, "", "\t")
+	return string(data) + "\n"
+}
+
+// taygaConfig renders tayga.conf, TAYGA takes the first pool address for itself
+func taygaConfig(nat64 *link.Nat64) string {
+	var conf strings.Builder
+	conf.WriteString("# " + marker + "\n")
+	conf.WriteString("# Do not edit manually\n\n")
+	conf.WriteString(fmt.Sprintf("tun-device %s\n", TaygaDevice))
+	conf.WriteString(fmt.Sprintf("ipv4-addr %s\n", nat64.Pool4.Addr().Next()))
+	conf.WriteString(fmt.Sprintf("prefix %s\n", nat64.Prefix))
+	conf.WriteString(fmt.Sprintf("dynamic-pool %s\n", nat64.Pool4))
+	conf.WriteString("data-dir /var/spool/tayga\n")
+	return conf.String()
+}
+
+// bindDns64 renders a dns64 statement to include in the options of named.conf
+func bindDns64(prefix netip.Prefix) string {
+	return fmt.Sprintf("// %s\n// Include inside the options block of named.conf\ndns64 %s {\n    clients { any; };\n};\n",
+		marker, prefix)
+}
+
+// unboundDns64 renders a snippet for unbound.conf.d
+func unboundDns64(prefix netip.Prefix) string {
+	return fmt.Sprintf("# %s\nserver:\n    module-config: \"dns64 validator iterator\"\n    dns64-prefix: %s\n",
+		marker, prefix)
+}
+
+// PlanNat64Config compares the generated files with the installed ones
+// without writing anything. Files natman generated earlier that are no
+// longer configured are planned for removal.
+func PlanNat64Config(links map[string]*link.Link) []*FilePlan {
+	files := desiredFiles(links)
+
+	var plans []*FilePlan
+	for _, path := range []string{JoolConfPath, TaygaConfPath, BindDns64Path, UnboundDns64Path} {
+		existing, err := os.ReadFile(path)
+		installed := err == nil
+
+		content, wanted := files[path]
+		switch {
+		case wanted && installed && !strings.Contains(string(existing), marker):
+			plans = append(plans, &FilePlan{Path: path, Foreign: true})
+		case wanted:
+			plans = append(plans, &FilePlan{
+				Path:    path,
+				Changed: !installed || string(existing) != content,
+				content: content,
+			})
+		case installed && strings.Contains(string(existing), marker):
+			plans = append(plans, &FilePlan{Path: path, Changed: true, Remove: true})
+		}
+	}
+
+	return plans
+}
+
+// ApplyNat64Config writes the changed files and reloads the translator
+func ApplyNat64Config(links map[string]*link.Link) error {
+	taygaChanged, taygaForeign := false, false
+	for _, plan := range PlanNat64Config(links) {
+		if plan.Foreign {
+			fmt.Printf("Warning: %s was not generated by natman, leaving it alone (remove it to let natman manage it)\n", plan.Path)
+			taygaForeign = taygaForeign || plan.Path == TaygaConfPath
+			continue
+		}
+		if !plan.Changed {
+			DebugPrint("%s unchanged", plan.Path)
+			continue
+		}
+
+		if plan.Remove {
+			if err := removeFile(plan.Path); err != nil {
+				return err
+			}
+			fmt.Printf("Removed %s\n", plan.Path)
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(plan.Path), 0755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %v", plan.Path, err)
+		}
+		if err := os.WriteFile(plan.Path, []byte(plan.content), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %v", plan.Path, err)
+		}
+		fmt.Printf("Updated %s\n", plan.Path)
+
+		// TAYGA is restarted once its device is set up
+		if plan.Path == TaygaConfPath {
+			taygaChanged = true
+			continue
+		}
+		if err := reload(plan.Path); err != nil {
+			return err
+		}
+	}
+
+	if nat64 := translator(links); nat64 != nil && nat64.Translator == config.TranslatorTayga && !taygaForeign {
+		created, err := setupTayga(nat64, taygaChanged)
+		if err != nil {
+			return err
+		}
+		if created || taygaChanged {
+			if err := run("systemctl", "restart", "tayga"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// setupTayga creates TAYGA's tun device when it is missing and routes the
+// NAT64 prefix and the IPv4 pool into it. The device and routes do not
+// survive a reboot while tayga.conf does, so this runs on every apply.
+// Routes of a previous configuration are flushed when it changed. It
+// reports whether the device was created, TAYGA has to be restarted to
+// attach to it then.
+func setupTayga(nat64 *link.Nat64, changed bool) (bool, error) {
+	created := false
+	if _, err := net.InterfaceByName(TaygaDevice); err != nil {
+		if err := run("tayga", "--config", TaygaConfPath, "--mktun"); err != nil {
+			return false, err
+		}
+		created = true
+	}
+
+	commands := [][]string{{"ip", "link", "set", "dev", TaygaDevice, "up"}}
+	if changed && !created {
+		// Kernel routes of the device have proto kernel and stay
+		commands = append(commands,
+			[]string{"ip", "-4", "route", "flush", "dev", TaygaDevice, "proto", "boot"},
+			[]string{"ip", "-6", "route", "flush", "dev", TaygaDevice, "proto", "boot"})
+	}
+	commands = append(commands,
+		[]string{"ip", "-4", "route", "replace", nat64.Pool4.String(), "dev", TaygaDevice},
+		[]string{"ip", "-6", "route", "replace", nat64.Prefix.String(), "dev", TaygaDevice})
+
+	for _, command := range commands {
+		if err := run(command...); err != nil {
+			return false, err
+		}
+	}
+	return created, nil
+}
+
+// removeFile stops the translator before its configuration goes away
+func removeFile(path string) error {
+	var stop []string
+	switch path {
+	case JoolConfPath:
+		stop = []string{"jool", "-i", JoolInstance, "instance", "remove"}
+	case TaygaConfPath:
+		stop = []string{"systemctl", "stop", "tayga"}
+	}
+	if stop != nil {
+		if err := run(stop...); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
+	if path == TaygaConfPath {
+		if _, err := net.InterfaceByName(TaygaDevice); err == nil {
+			if err := run("tayga", "--config", path, "--rmtun"); err != nil {
+				fmt.Printf("Warning: %v\n", err)
+			}
+		}
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %v", path, err)
+	}
+	return nil
+}
+
+// reload makes Jool pick up its new configuration. DNS64 snippets are
+// only picked up once included in the resolver config, the resolver is
+// left to the administrator.
+func reload(path string) error {
+	if path != JoolConfPath {
+		return nil
+	}
+	// Jool replaces the instance configuration atomically
+	return run("jool", "file", "handle", path)
+}
+
+// run executes a command, its output is part of the error
+func run(command ...string) error {
+	DebugPrint("Running: %s", strings.Join(command, " "))
+	output, err := exec.Command(command[0], command[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to run %s: %v, output: %s",
+			strings.Join(command, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
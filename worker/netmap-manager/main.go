@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"natman/link"
+	iptablesmanager "natman/worker/iptables-manager"
 )
 
 // It needs to be able to generate the mappings
@@ -33,6 +34,22 @@ func DebugPrint(format string, args ...interface{}) {
 }
 
 func ApplyNetmapRules(links map[string]*link.Link) error {
+	tx := iptablesmanager.NewTransaction("ip6tables")
+
+	if err := StageNetmapRules(links, tx); err != nil {
+		return err
+	}
+
+	return iptablesmanager.Commit(tx)
+}
+
+// StageNetmapRules computes the NETMAP rule changes and stages them
+// in the given ip6tables transaction without executing anything
+func StageNetmapRules(links map[string]*link.Link, tx *iptablesmanager.Transaction) error {
+	if err := tx.EnsureChains(); err != nil {
+		return err
+	}
+
 	// Get current rules
 	DebugPrint("Getting current netmap rules")
 	currentRules, err := getCurrentNetmapRules()
@@ -43,8 +60,10 @@ func ApplyNetmapRules(links map[string]*link.Link) error {
 
 	// Generate new rules from config
 	var newRules []string
-	for linkName, linkObj := range links {
-		for netmapName, netmap := range linkObj.Netmap6 {
+	for _, linkName := range link.SortedNames(links) {
+		linkObj := links[linkName]
+		for _, netmapName := range linkObj.Netmap6Names() {
+			netmap := linkObj.Netmap6[netmapName]
 			DebugPrint("Generating rules for link %s, netmap %s (enabled: %t)",
 				linkName, netmapName, netmap.Enabled)
 
@@ -52,56 +71,14 @@ func ApplyNetmapRules(links map[string]*link.Link) error {
 			DebugPrint("Generated %d rules for link %s, netmap %s",
 				len(rules), linkName, netmapName)
 
-			// Dump mappings if debug is enabled
-			if Debug && len(rules) == 0 && netmap.Enabled {
-				DebugPrint("Detailed mapping dump for %s.%s:", linkName, netmapName)
-				for i, mapping := range netmap.Maps {
-					DebugPrint("  Map[%d]: Public=%s, Private=%s", i, mapping.Public, mapping.Private)
-					pubExp := netmap.SimpleConcatAddress(mapping.Public, netmap.PfxPub)
-					privExp := netmap.SimpleConcatAddress(mapping.Private, netmap.PfxPriv)
-					DebugPrint("    Expanded: Public=%s, Private=%s", pubExp, privExp)
-				}
-			}
-
-			if len(rules) == 0 && netmap.Enabled && len(netmap.Maps) > 0 {
-				fmt.Printf("Warning: No valid netmap rules generated for enabled netmap %s on interface %s\n",
-					netmapName, linkName)
-
-				// Try a direct rule creation as a fallback
-				for _, mapping := range netmap.Maps {
-					publicAddr := netmap.SimpleConcatAddress(mapping.Public, netmap.PfxPub)
-					privateAddr := netmap.SimpleConcatAddress(mapping.Private, netmap.PfxPriv)
-
-					// Create direct rules as a fallback
-					postrouting := fmt.Sprintf("ip6tables -t nat -A POSTROUTING -o %s -s %s -j NETMAP --to %s",
-						linkName, privateAddr, publicAddr)
-					prerouting := fmt.Sprintf("ip6tables -t nat -A PREROUTING -i %s -d %s -j NETMAP --to %s",
-						linkName, publicAddr, privateAddr)
-
-					fmt.Printf("Trying fallback direct rule: %s\n", postrouting)
-					if err := executeIp6tablesRule(postrouting); err != nil {
-						fmt.Printf("Error: Failed to add direct rule: %v\n", err)
-					} else {
-						fmt.Printf("Successfully added direct rule\n")
-					}
-
-					fmt.Printf("Trying fallback direct rule: %s\n", prerouting)
-					if err := executeIp6tablesRule(prerouting); err != nil {
-						fmt.Printf("Error: Failed to add direct rule: %v\n", err)
-					} else {
-						fmt.Printf("Successfully added direct rule\n")
-					}
-				}
-			}
-
 			newRules = append(newRules, rules...)
 		}
 	}
 	DebugPrint("Generated %d total new rules", len(newRules))
 
-	// Check if we have any rules to apply
-	if len(newRules) == 0 {
-		fmt.Println("No valid netmap rules to apply - check your configuration and debug logs")
+	// Check if we have any rules to apply or stale rules to remove
+	if len(newRules) == 0 && len(currentRules) == 0 {
+		DebugPrint("No valid netmap rules to apply - check your configuration")
 		return nil
 	}
 
@@ -135,30 +112,20 @@ func ApplyNetmapRules(links map[string]*link.Link) error {
 
 	// Remove old rules
 	for i, rule := range rulesToRemove {
-		removeRule := strings.Replace(rule, "-A ", "-D ", 1)
-		DebugPrint("Removing rule %d: %s", i, removeRule)
-		if err := executeIp6tablesRule(removeRule); err != nil {
-			fmt.Printf("Warning: failed to remove rule %s: %v\n", removeRule, err)
-			DebugPrint("Failed to remove rule: %v", err)
+		DebugPrint("Removing rule %d: %s", i, rule)
+		if err := tx.DeleteRule(rule); err != nil {
+			return fmt.Errorf("failed to stage removal of netmap rule %s: %v", rule, err)
 		}
 	}
 
 	// Add new rules
-	var failedRules []string
 	for i, rule := range rulesToAdd {
 		DebugPrint("Adding rule %d: %s", i, rule)
-		if err := executeIp6tablesRule(rule); err != nil {
-			fmt.Printf("Error: Failed to add netmap rule: %s\n", rule)
-			fmt.Printf("  Error details: %v\n", err)
-			failedRules = append(failedRules, rule)
+		if err := tx.AddRule(rule); err != nil {
+			return fmt.Errorf("failed to stage netmap rule %s: %v", rule, err)
 		}
 	}
 
-	if len(failedRules) > 0 {
-		return fmt.Errorf("failed to add %d netmap rules out of %d total rules",
-			len(failedRules), len(rulesToAdd))
-	}
-
 	return nil
 }
 
@@ -179,7 +146,7 @@ func normalizeRule(rule string) string {
 		return rule
 	}
 
-	var chain, iface, direction, source, dest, target, toAddr string
+	var chain, iface, direction, source, dest, target, toAddr, srcPfx, dstPfx, comment string
 
 	// Extract basic components
 	for i, part := range parts {
@@ -214,19 +181,34 @@ func normalizeRule(rule string) string {
 			if i+1 < len(parts) {
 				toAddr = parts[i+1]
 			}
+		case "--src-pfx":
+			if i+1 < len(parts) {
+				srcPfx = parts[i+1]
+			}
+		case "--dst-pfx":
+			if i+1 < len(parts) {
+				dstPfx = parts[i+1]
+			}
+		case "--comment":
+			if i+1 < len(parts) {
+				comment = strings.Trim(parts[i+1], "\"")
+			}
 		}
 	}
 
 	// Build normalized string with consistent ordering
-	// Format: chain|direction|iface|source|dest|target|toAddr
-	return fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s",
+	// Format: chain|direction|iface|source|dest|target|toAddr|srcPfx|dstPfx|comment
+	return fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s|%s|%s|%s",
 		strings.ToLower(chain),
 		direction,
 		iface,
 		source,
 		dest,
 		strings.ToLower(target),
-		toAddr)
+		toAddr,
+		srcPfx,
+		dstPfx,
+		comment)
 }
 
 // smartDifference compares rules using both original and normalized forms
@@ -254,25 +236,74 @@ func smartDifference(originalSlice1, _, normalizedSlice1, normalizedSlice2 []str
 	return result
 }
 
+// getCurrentNetmapRules reads the NETMAP and NPTv6 rules from the natman chains only
 func getCurrentNetmapRules() ([]string, error) {
+	rules, err := getCurrentNetmapNatRules()
+	if err != nil {
+		return nil, err
+	}
+
+	nptRules, err := getCurrentNptRules()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(rules, nptRules...), nil
+}
+
+// getCurrentNptRules reads the SNPT and DNPT rules of nptv6 sets from the
+// mangle table, ip6tables -S prints them in the order they are generated
+func getCurrentNptRules() ([]string, error) {
+	var rules []string
+	for _, chain := range []string{iptablesmanager.ChainSnpt, iptablesmanager.ChainDnpt} {
+		lines, _, err := iptablesmanager.ListChain("ip6tables", "mangle", chain)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			if strings.HasPrefix(line, "-A ") && ownedByNetmap(line) {
+				rules = append(rules, "ip6tables -t mangle "+line)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// getCurrentNetmapNatRules reads the NETMAP rules from the natman nat chains
+func getCurrentNetmapNatRules() ([]string, error) {
+	chains := []string{iptablesmanager.ChainPostrouting, iptablesmanager.ChainPrerouting}
+
 	// Try using -S first (saves format)
-	cmd := exec.Command("ip6tables", "-t", "nat", "-S")
-	output, err := cmd.Output()
-	if err == nil {
-		rules := parseNetmapRulesFromSaves(string(output))
+	var saves []string
+	var listErr error
+	for _, chain := range chains {
+		lines, _, err := iptablesmanager.ListChain("ip6tables", "nat", chain)
+		if err != nil {
+			listErr = err
+			break
+		}
+		saves = append(saves, lines...)
+	}
+	if listErr == nil {
+		rules := parseNetmapRulesFromSaves(strings.Join(saves, "\n"))
 		if len(rules) > 0 {
 			return rules, nil
 		}
 	}
 
-	// Fallback to -L -n format if -S doesn't work or returns no rules
-	cmd = exec.Command("ip6tables", "-t", "nat", "-L", "-n")
-	output, err = cmd.Output()
-	if err != nil {
-		return nil, err
+	// Fallback to -L -n -v format if -S doesn't work or returns no rules
+	var rules []string
+	for _, chain := range chains {
+		cmd := exec.Command("ip6tables", "-t", "nat", "-L", chain, "-n", "-v")
+		output, err := cmd.Output()
+		if err != nil {
+			// The chain does not exist yet
+			continue
+		}
+		rules = append(rules, parseNetmapRulesFromList(string(output))...)
 	}
 
-	return parseNetmapRulesFromList(string(output)), nil
+	return rules, nil
 }
 
 // parseNetmapRulesFromSaves - update to normalize the output format
@@ -282,7 +313,7 @@ func parseNetmapRulesFromSaves(output string) []string {
 
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
-		if strings.Contains(line, "NETMAP") && strings.HasPrefix(line, "-A ") {
+		if strings.Contains(line, "NETMAP") && strings.HasPrefix(line, "-A ") && ownedByNetmap(line) {
 			// Normalize the rule format to match our generated rules
 			rule := normalizeRuleFormat(line)
 			if rule != "" {
@@ -302,7 +333,7 @@ func normalizeRuleFormat(line string) string {
 	}
 
 	chain := parts[1]
-	var iface, direction, source, dest, toAddr string
+	var iface, direction, source, dest, toAddr, comment string
 	var isInput bool
 
 	// Parse all parameters
@@ -337,6 +368,11 @@ func normalizeRuleFormat(line string) string {
 				toAddr = parts[i+1]
 				i++
 			}
+		case "--comment":
+			if i+1 < len(parts) {
+				comment = strings.Trim(parts[i+1], "\"")
+				i++
+			}
 		}
 	}
 
@@ -362,6 +398,11 @@ func normalizeRuleFormat(line string) string {
 		rule.WriteString(source)
 	}
 
+	// Add the ownership tag
+	if comment != "" {
+		rule.WriteString(fmt.Sprintf(" -m comment --comment \"%s\"", comment))
+	}
+
 	// Add NETMAP target
 	rule.WriteString(" -j NETMAP")
 
@@ -428,15 +469,21 @@ func parseNetmapRuleFromListLine(line, chain string) string {
 	source := fields[7]
 	destination := fields[8]
 
-	// Find "to:" address
-	var toAddress string
+	// Find "to:" address and the ownership tag shown as /* comment */
+	var toAddress, comment string
 	for i := 9; i < len(fields); i++ {
 		if strings.HasPrefix(fields[i], "to:") {
 			toAddress = strings.TrimPrefix(fields[i], "to:")
-			break
+		} else if fields[i] == "/*" && i+1 < len(fields) {
+			comment = fields[i+1]
 		}
 	}
 
+	// Only natman-owned rules are reported
+	if _, ok := iptablesmanager.ParseTag("--comment " + comment); !ok {
+		return ""
+	}
+
 	// Build the ip6tables command
 	var rule strings.Builder
 	rule.WriteString("ip6tables -t nat -A ")
@@ -449,13 +496,13 @@ func parseNetmapRuleFromListLine(line, chain string) string {
 	}
 
 	// Add input interface for PREROUTING
-	if chain == "PREROUTING" && inInterface != "" && inInterface != "any" && inInterface != "*" && inInterface != "--" {
+	if (chain == "PREROUTING" || chain == iptablesmanager.ChainPrerouting) && inInterface != "" && inInterface != "any" && inInterface != "*" && inInterface != "--" {
 		rule.WriteString(" -i ")
 		rule.WriteString(inInterface)
 	}
 
 	// Add output interface for POSTROUTING
-	if chain == "POSTROUTING" && outInterface != "" && outInterface != "any" && outInterface != "*" && outInterface != "--" {
+	if (chain == "POSTROUTING" || chain == iptablesmanager.ChainPostrouting) && outInterface != "" && outInterface != "any" && outInterface != "*" && outInterface != "--" {
 		rule.WriteString(" -o ")
 		rule.WriteString(outInterface)
 	}
@@ -472,6 +519,9 @@ func parseNetmapRuleFromListLine(line, chain string) string {
 		rule.WriteString(destination)
 	}
 
+	// Add the ownership tag
+	rule.WriteString(fmt.Sprintf(" -m comment --comment \"%s\"", comment))
+
 	// Add target and to address
 	rule.WriteString(" -j NETMAP")
 	if toAddress != "" {
@@ -482,38 +532,22 @@ func parseNetmapRuleFromListLine(line, chain string) string {
 	return rule.String()
 }
 
-func executeIp6tablesRule(rule string) error {
-	parts := strings.Fields(rule)
-	if len(parts) == 0 {
-		return fmt.Errorf("empty rule")
-	}
-
-	DebugPrint("Executing command: %s", rule)
-	cmd := exec.Command(parts[0], parts[1:]...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		DebugPrint("Command failed: %v, output: %s", err, string(output))
-		return fmt.Errorf("command failed: %v, output: %s", err, string(output))
-	}
-	DebugPrint("Command executed successfully")
-
-	return nil
-}
-
 // PrintNetmapRules prints the current netmap configuration from the links
 func PrintNetmapRules(links map[string]*link.Link) error {
 	fmt.Println("Current Netmap6 Configuration:")
 	fmt.Println("==============================")
 
-	for linkName, linkObj := range links {
+	for _, linkName := range link.SortedNames(links) {
+		linkObj := links[linkName]
 		fmt.Printf("\nInterface: %s\n", linkName)
 
-		for setName, netmap := range linkObj.Netmap6 {
+		for _, setName := range linkObj.Netmap6Names() {
+			netmap := linkObj.Netmap6[setName]
 			if !netmap.Enabled {
 				continue
 			}
 
-			fmt.Printf("  Set: %s\n", setName)
+			fmt.Printf("  Set: %s (%s)\n", setName, netmap.Mode)
 			fmt.Printf("    Public Prefix: %s\n", netmap.PfxPub)
 			fmt.Printf("    Private Prefix: %s\n", netmap.PfxPriv)
 			fmt.Printf("    Mappings:\n")
@@ -527,9 +561,9 @@ func PrintNetmapRules(links map[string]*link.Link) error {
 	return nil
 }
 
-func PrintCurrentNetmapRules() error {
-	fmt.Println("Current ip6tables NETMAP Rules:")
-	fmt.Println("===============================")
+func PrintCurrentNetmapRules(links map[string]*link.Link) error {
+	fmt.Println("Current ip6tables NETMAP and NPTv6 Rules:")
+	fmt.Println("=========================================")
 
 	rules, err := getCurrentNetmapRules()
 	if err != nil {
@@ -537,62 +571,79 @@ func PrintCurrentNetmapRules() error {
 	}
 
 	if len(rules) == 0 {
-		fmt.Println("No NETMAP rules found")
+		fmt.Println("No NETMAP or NPTv6 rules found")
 		return nil
 	}
 
 	for i, rule := range rules {
-		fmt.Printf("%d. %s\n", i+1, rule)
+		fmt.Printf("%d. [%s] %s\n", i+1, describeOwner(rule, links), rule)
 	}
 
 	return nil
 }
 
-func CaptureNetmapRulesFromSystem() (map[string][]string, error) {
+// ownedByNetmap reports whether the rule carries a natman netmap6 tag
+func ownedByNetmap(rule string) bool {
+	tag, ok := iptablesmanager.ParseTag(rule)
+	return ok && tag.Feature == iptablesmanager.FeatureNetmap6
+}
+
+// describeOwner attributes a tagged rule to the link and netmap set in the config
+func describeOwner(rule string, links map[string]*link.Link) string {
+	tag, ok := iptablesmanager.ParseTag(rule)
+	if !ok {
+		return "untagged"
+	}
+
+	owner := fmt.Sprintf("%s/%s", tag.Link, tag.Set)
+	linkObj, ok := links[tag.Link]
+	if !ok {
+		return owner + ", link not in config"
+	}
+
+	netmap, ok := linkObj.Netmap6[tag.Set]
+	if !ok {
+		return owner + ", set not in config"
+	}
+	if !netmap.Enabled {
+		return owner + ", set disabled in config"
+	}
+
+	return owner
+}
+
+// CaptureNetmapRulesFromSystem returns the natman NETMAP rules grouped by
+// the link and netmap set named in their tag
+func CaptureNetmapRulesFromSystem() (map[string]map[string][]string, error) {
 	rules, err := getCurrentNetmapRules()
 	if err != nil {
 		return nil, err
 	}
 
-	// Group rules by interface
-	rulesByInterface := make(map[string][]string)
+	// Group rules by link and set
+	rulesByLink := make(map[string]map[string][]string)
 
 	for _, rule := range rules {
-		// Extract interface name from rule
-		var iface string
-		if strings.Contains(rule, "-o ") {
-			// POSTROUTING rule
-			parts := strings.Fields(rule)
-			for i, part := range parts {
-				if part == "-o" && i+1 < len(parts) {
-					iface = parts[i+1]
-					break
-				}
-			}
-		} else if strings.Contains(rule, "-i ") {
-			// PREROUTING rule
-			parts := strings.Fields(rule)
-			for i, part := range parts {
-				if part == "-i" && i+1 < len(parts) {
-					iface = parts[i+1]
-					break
-				}
-			}
+		tag, ok := iptablesmanager.ParseTag(rule)
+		if !ok {
+			continue
 		}
 
-		if iface != "" {
-			rulesByInterface[iface] = append(rulesByInterface[iface], rule)
+		if _, ok := rulesByLink[tag.Link]; !ok {
+			rulesByLink[tag.Link] = make(map[string][]string)
 		}
+		rulesByLink[tag.Link][tag.Set] = append(rulesByLink[tag.Link][tag.Set], rule)
 	}
 
-	return rulesByInterface, nil
+	return rulesByLink, nil
 }
 
 func GetNetmapHash(links map[string]*link.Link) string {
 	var rules []string
-	for linkName, linkObj := range links {
-		for _, netmap := range linkObj.Netmap6 {
-			netmapRules := netmap.GenerateIp6tablesRules(linkName)
+	for _, linkName := range link.SortedNames(links) {
+		linkObj := links[linkName]
+		for _, setName := range linkObj.Netmap6Names() {
+			netmapRules := linkObj.Netmap6[setName].GenerateIp6tablesRules(linkName)
 			rules = append(rules, netmapRules...)
 		}
 	}
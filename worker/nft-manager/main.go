@@ -0,0 +1,484 @@
+package nftmanager
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"natman/link"
+	iptablesmanager "natman/worker/iptables-manager"
+)
+
+// It renders the link model into a native nftables ruleset
+// (masquerade, prefix snat/dnat for netmap6 and MSS clamping)
+// and loads it atomically with a single `nft -f` transaction.
+// natman owns the "natman" tables completely, every apply replaces them.
+
+// TableName is the name of the ip and ip6 tables owned by natman
+const TableName = "natman"
+
+// RulesetStatePath keeps a copy of the last loaded ruleset and
+// ListingStatePath the tables as the kernel listed them right after the
+// load. Drift is always detected against the live tables, the copies only
+// let a plan show unchanged tables in natman's own notation.
+var (
+	RulesetStatePath = "/var/lib/natman/ruleset.nft"
+	ListingStatePath = "/var/lib/natman/ruleset.listed"
+)
+
+// Base chain priorities (srcnat, dstnat and mangle)
+const (
+	prioritySrcNat = 100
+	priorityDstNat = -100
+	priorityMangle = -150
+)
+
+// Global quiet mode flag
+var QuietMode bool = false
+
+// SetQuietMode sets the quiet mode for suppressing non-essential output
+func SetQuietMode(quiet bool) {
+	QuietMode = quiet
+}
+
+// family collects the rules of one nftables table (ip or ip6)
+type family struct {
+	name        string
+	postrouting []string
+	prerouting  []string
+	forward     []string
+	mark        []string
+}
+
+func (f *family) empty() bool {
+	return len(f.postrouting) == 0 && len(f.prerouting) == 0 && len(f.forward) == 0 && len(f.mark) == 0
+}
+
+// Available reports whether the nft binary can be found
+func Available() bool {
+	_, err := exec.LookPath("nft")
+	return err == nil
+}
+
+func ApplyNftRules(links map[string]*link.Link) error {
+	if err := CheckSupported(links); err != nil {
+		return err
+	}
+
+	ruleset := GenerateRuleset(links)
+
+	if !QuietMode {
+		fmt.Println("nftables ruleset to load:")
+		fmt.Print(ruleset)
+	}
+
+	if err := loadRuleset(ruleset); err != nil {
+		return err
+	}
+
+	// Remember what was loaded for the next plan
+	if err := saveRuleset(ruleset); err != nil && !QuietMode {
+		fmt.Printf("Warning: failed to save ruleset state: %v\n", err)
+	}
+
+	return nil
+}
+
+// CheckSupported rejects netmap6 sets in nptv6 mode, nftables has no
+// checksum-neutral prefix translation like the SNPT and DNPT targets
+func CheckSupported(links map[string]*link.Link) error {
+	var linkNames []string
+	for linkName := range links {
+		linkNames = append(linkNames, linkName)
+	}
+	sort.Strings(linkNames)
+
+	for _, linkName := range linkNames {
+		for _, setName := range links[linkName].Netmap6Names() {
+			if netmap := links[linkName].Netmap6[setName]; netmap.Enabled && netmap.NPTv6() {
+				return fmt.Errorf("link %s, netmap6 set %s: nptv6 mode needs the iptables backend", linkName, setName)
+			}
+		}
+	}
+	return nil
+}
+
+// saveRuleset keeps the loaded ruleset and the kernel's listing of it
+func saveRuleset(ruleset string) error {
+	listing, err := listTables()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(RulesetStatePath), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(RulesetStatePath, []byte(ruleset), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(ListingStatePath, []byte(listing), 0644)
+}
+
+// PlanNftRules compares the rendered ruleset with the natman tables live
+// in the kernel and returns the rule lines that would be added and removed
+func PlanNftRules(links map[string]*link.Link) ([]string, []string, error) {
+	if err := CheckSupported(links); err != nil {
+		return nil, nil, err
+	}
+
+	newRules := rulesetRules(GenerateRuleset(links))
+
+	listing, err := listTables()
+	if err != nil {
+		return nil, nil, err
+	}
+	oldRules := rulesetRules(listing)
+
+	// The kernel lists rules in its own notation. While it still holds
+	// exactly what natman loaded last, compare with the loaded copy instead.
+	if listed, ok := savedRules(ListingStatePath); ok && slices.Equal(oldRules, listed) {
+		if loaded, ok := savedRules(RulesetStatePath); ok {
+			oldRules = loaded
+		}
+	}
+
+	// The round-robin snat rules only work as an ordered set, like the
+	// loaded ruleset the plan replaces a set with any changed member whole
+	replaced := changedSnatSets(oldRules, newRules)
+	add := differenceOrSet(newRules, oldRules, replaced)
+	remove := differenceOrSet(oldRules, newRules, replaced)
+
+	// Other rules such as the excluded destinations also work in their order
+	if len(add) == 0 && len(remove) == 0 && len(newRules) == len(oldRules) && !slices.Equal(newRules, oldRules) {
+		for i := range newRules {
+			if newRules[i] != oldRules[i] {
+				add = append(add, newRules[i])
+				remove = append(remove, oldRules[i])
+			}
+		}
+	}
+
+	return add, remove, nil
+}
+
+// listTables returns the kernel's listing of the ip and ip6 natman tables,
+// a missing table lists as empty
+func listTables() (string, error) {
+	var listing strings.Builder
+	for _, familyName := range []string{"ip", "ip6"} {
+		output, err := exec.Command("nft", "list", "table", familyName, TableName).CombinedOutput()
+		if err != nil {
+			if strings.Contains(string(output), "No such file or directory") {
+				continue
+			}
+			return "", fmt.Errorf("failed to list table %s %s: %v, output: %s",
+				familyName, TableName, err, strings.TrimSpace(string(output)))
+		}
+		listing.Write(output)
+	}
+	return listing.String(), nil
+}
+
+// savedRules reads the rule lines of a state file
+func savedRules(path string) ([]string, bool) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	return rulesetRules(string(content)), true
+}
+
+// rulesetRules extracts the rule lines of a rendered ruleset, prefixed
+// with their family and chain
+func rulesetRules(ruleset string) []string {
+	var rules []string
+	var familyName, chain string
+
+	for _, line := range strings.Split(ruleset, "\n") {
+		line = strings.TrimSpace(line)
+		fields := strings.Fields(line)
+
+		switch {
+		case len(fields) >= 3 && fields[0] == "table" && strings.HasSuffix(line, "{"):
+			familyName = fields[1]
+		case len(fields) >= 2 && fields[0] == "chain":
+			chain = fields[1]
+		case line == "}" || line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "type "):
+			continue
+		case familyName != "" && chain != "":
+			rules = append(rules, fmt.Sprintf("%s %s %s: %s", familyName, TableName, chain, line))
+		}
+	}
+
+	return rules
+}
+
+// snatSetKey identifies the snat set a rule line belongs to: the
+// masquerade or snat rules of a link, or of one origin on it
+func snatSetKey(rule string) (string, bool) {
+	header, body, ok := strings.Cut(rule, ": ")
+	if !ok {
+		return "", false
+	}
+
+	var outInterface, source, comment string
+	parts := strings.Fields(body)
+	for i := 0; i+1 < len(parts); i++ {
+		switch parts[i] {
+		case "oifname":
+			outInterface = parts[i+1]
+		case "saddr":
+			source = parts[i+1]
+		case "comment":
+			comment = strings.Trim(parts[i+1], "\"")
+		}
+	}
+
+	tag := strings.Split(comment, ":")
+	if len(tag) != 4 || tag[0] != iptablesmanager.TagPrefix || (tag[3] != "masquerade" && tag[3] != "origin") {
+		return "", false
+	}
+	return strings.Join([]string{header, outInterface, source, comment}, " "), true
+}
+
+// changedSnatSets returns the snat sets whose rules differ in any member
+// or in their order
+func changedSnatSets(oldRules, newRules []string) map[string]bool {
+	sets := func(rules []string) map[string][]string {
+		result := make(map[string][]string)
+		for _, rule := range rules {
+			if key, ok := snatSetKey(rule); ok {
+				result[key] = append(result[key], rule)
+			}
+		}
+		return result
+	}
+
+	old, wanted := sets(oldRules), sets(newRules)
+	changed := make(map[string]bool)
+	for key, rules := range wanted {
+		if !slices.Equal(rules, old[key]) {
+			changed[key] = true
+		}
+	}
+	for key := range old {
+		if _, ok := wanted[key]; !ok {
+			changed[key] = true
+		}
+	}
+	return changed
+}
+
+// differenceOrSet returns the rules of slice1 missing from slice2 and
+// every rule of slice1 that belongs to one of the replaced snat sets
+func differenceOrSet(slice1, slice2 []string, replaced map[string]bool) []string {
+	set := make(map[string]bool)
+	for _, item := range slice2 {
+		set[item] = true
+	}
+
+	var result []string
+	for _, item := range slice1 {
+		key, ok := snatSetKey(item)
+		if !set[item] || (ok && replaced[key]) {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
+
+// GenerateRuleset renders all links into an nft script that atomically
+// replaces the natman tables
+func GenerateRuleset(links map[string]*link.Link) string {
+	ipv4 := &family{name: "ip"}
+	ipv6 := &family{name: "ip6"}
+
+	var linkNames []string
+	for linkName := range links {
+		linkNames = append(linkNames, linkName)
+	}
+	sort.Strings(linkNames)
+
+	for _, linkName := range linkNames {
+		linkObj := links[linkName]
+
+		if linkObj.Nat44 != nil && linkObj.Nat44.Enabled {
+			generateNatRules(ipv4, linkName, iptablesmanager.FeatureNat44, linkObj.Nat44.MssClamping, linkObj.Nat44.Mss,
+				linkObj.Nat44.SnatTo, linkObj.Nat44.Persistent, linkObj.Nat44.Origins, linkObj.Nat44.Exclude)
+		}
+
+		if linkObj.Nat66 != nil && linkObj.Nat66.Enabled {
+			generateNatRules(ipv6, linkName, iptablesmanager.FeatureNat66, linkObj.Nat66.MssClamping, linkObj.Nat66.Mss,
+				linkObj.Nat66.SnatTo, linkObj.Nat66.Persistent, linkObj.Nat66.Origins, linkObj.Nat66.Exclude)
+		}
+
+		for _, forward := range linkObj.PortForwards {
+			if forward.IPv6() {
+				generatePortForwardRule(ipv6, linkName, forward)
+			} else {
+				generatePortForwardRule(ipv4, linkName, forward)
+			}
+		}
+
+		var setNames []string
+		for setName := range linkObj.Netmap6 {
+			setNames = append(setNames, setName)
+		}
+		sort.Strings(setNames)
+
+		for _, setName := range setNames {
+			postrouting, prerouting := linkObj.Netmap6[setName].GenerateNftRules(linkName)
+			ipv6.postrouting = append(ipv6.postrouting, postrouting...)
+			ipv6.prerouting = append(ipv6.prerouting, prerouting...)
+		}
+	}
+
+	var ruleset strings.Builder
+	ruleset.WriteString("# Generated by natman-go\n")
+	for _, f := range []*family{ipv4, ipv6} {
+		// Declare and delete first so the load works whether or not the table exists
+		ruleset.WriteString(fmt.Sprintf("table %s %s\n", f.name, TableName))
+		ruleset.WriteString(fmt.Sprintf("delete table %s %s\n", f.name, TableName))
+	}
+	for _, f := range []*family{ipv4, ipv6} {
+		if f.empty() {
+			continue
+		}
+		ruleset.WriteString(fmt.Sprintf("\ntable %s %s {\n", f.name, TableName))
+		writeChain(&ruleset, "postrouting", "nat", "postrouting", prioritySrcNat, f.postrouting)
+		writeChain(&ruleset, "prerouting", "nat", "prerouting", priorityDstNat, f.prerouting)
+		writeChain(&ruleset, "forward", "filter", "forward", priorityMangle, f.forward)
+		writeChain(&ruleset, "mark", "filter", "prerouting", priorityMangle, f.mark)
+		ruleset.WriteString("}\n")
+	}
+
+	return ruleset.String()
+}
+
+func generateNatRules(f *family, interfaceName, feature string, mssClamping bool, mss int,
+	snatTo []string, persistent bool, origins []link.Origin, exclude []string) {
+	// Validate interface name
+	if interfaceName == "" {
+		return
+	}
+
+	// Traffic to excluded destinations leaves the chain before any NAT rule
+	if len(exclude) > 0 {
+		excludeTag := iptablesmanager.NewTag(interfaceName, feature, "exclude")
+		f.postrouting = append(f.postrouting, fmt.Sprintf(
+			"oifname \"%s\" %s daddr { %s } return comment \"%s\"",
+			interfaceName, f.name, strings.Join(exclude, ", "), excludeTag))
+	}
+
+	// Basic masquerading rule, or SNAT to the static addresses. With
+	// origins only the listed sources are translated.
+	if len(origins) == 0 {
+		masqTag := iptablesmanager.NewTag(interfaceName, feature, "masquerade")
+		for _, statement := range natStatements(snatTo, persistent) {
+			f.postrouting = append(f.postrouting, fmt.Sprintf(
+				"oifname \"%s\" %s comment \"%s\"", interfaceName, statement, masqTag))
+		}
+	}
+
+	// MSS clamping if enabled
+	if mssClamping && mss > 0 {
+		mssTag := iptablesmanager.NewTag(interfaceName, feature, "mss")
+		f.forward = append(f.forward, fmt.Sprintf(
+			"oifname \"%s\" tcp flags & (syn | rst) == syn tcp option maxseg size set %d comment \"%s\"",
+			interfaceName, mss, mssTag))
+	}
+
+	// Source NAT for the allowed origins
+	originTag := iptablesmanager.NewTag(interfaceName, feature, "origin")
+	markTag := iptablesmanager.NewTag(interfaceName, feature, "mark")
+	for _, origin := range origins {
+		for _, statement := range natStatements(origin.SnatTo, origin.Persistent) {
+			f.postrouting = append(f.postrouting, fmt.Sprintf(
+				"oifname \"%s\" %s saddr %s %s comment \"%s\"", interfaceName, f.name, origin.Source, statement, originTag))
+		}
+
+		// Mark the origin's packets for the ip rule of its routing table
+		if origin.Table != 0 && origin.Fwmark != 0 {
+			f.mark = append(f.mark, fmt.Sprintf(
+				"%s saddr %s meta mark set 0x%x comment \"%s\"", f.name, origin.Source, origin.Fwmark, markTag))
+		}
+	}
+}
+
+// natStatements returns masquerade without snat-to, otherwise one snat
+// statement per address or range. Like the iptables backend several
+// addresses are used round-robin with a per-rule connection counter.
+func natStatements(snatTo []string, persistent bool) []string {
+	if len(snatTo) == 0 {
+		return []string{"masquerade"}
+	}
+
+	flags := ""
+	if persistent {
+		flags = " persistent"
+	}
+
+	statements := make([]string, len(snatTo))
+	for i, address := range snatTo {
+		statements[i] = fmt.Sprintf("snat to %s%s", address, flags)
+		if remaining := len(snatTo) - i; remaining > 1 {
+			statements[i] = fmt.Sprintf("numgen inc mod %d == 0 %s", remaining, statements[i])
+		}
+	}
+	return statements
+}
+
+func generatePortForwardRule(f *family, interfaceName string, forward *link.PortForward) {
+	source := ""
+	if forward.Source.IsValid() {
+		source = fmt.Sprintf("%s saddr %s ", f.name, forward.Source)
+	}
+
+	tag := iptablesmanager.NewTag(interfaceName, iptablesmanager.FeaturePortForward, forward.Name())
+	f.prerouting = append(f.prerouting, fmt.Sprintf(
+		"iifname \"%s\" %s%s dport %s dnat to %s comment \"%s\"",
+		interfaceName, source, forward.Proto, forward.Ports("-"), forward.Destination(), tag))
+}
+
+func writeChain(ruleset *strings.Builder, name, chainType, hook string, priority int, rules []string) {
+	if len(rules) == 0 {
+		return
+	}
+
+	ruleset.WriteString(fmt.Sprintf("    chain %s {\n", name))
+	ruleset.WriteString(fmt.Sprintf("        type %s hook %s priority %d; policy accept;\n", chainType, hook, priority))
+	for _, rule := range rules {
+		ruleset.WriteString(fmt.Sprintf("        %s\n", rule))
+	}
+	ruleset.WriteString("    }\n")
+}
+
+func loadRuleset(ruleset string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(ruleset)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nft transaction failed: %v, output: %s", err, string(output))
+	}
+
+	return nil
+}
+
+// PrintCurrentNftRules prints the natman tables as currently loaded in the kernel
+func PrintCurrentNftRules() error {
+	for _, familyName := range []string{"ip", "ip6"} {
+		cmd := exec.Command("nft", "list", "table", familyName, TableName)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			fmt.Printf("No %s %s table loaded\n", familyName, TableName)
+			continue
+		}
+		fmt.Print(string(output))
+	}
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package nftmanager
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"natman/config"
+	"natman/link"
+	"natman/link/netmap6"
+)
+
+func TestSnatSetsReplacedWhole(t *testing.T) {
+	ruleset := func(snatTo ...string) []string {
+		return rulesetRules(GenerateRuleset(map[string]*link.Link{
+			"eth0": {Name: "eth0", Nat44: &link.Nat44{
+				Enabled: true,
+				Origins: []link.Origin{
+					{Source: "10.0.1.0/24", SnatTo: snatTo},
+					{Source: "10.0.2.0/24", SnatTo: []string{"203.0.113.9"}},
+				},
+			}},
+		}))
+	}
+
+	oldRules := ruleset("203.0.113.5", "203.0.113.6", "203.0.113.7")
+	newRules := ruleset("203.0.113.5", "203.0.113.7")
+
+	replaced := changedSnatSets(oldRules, newRules)
+	add := differenceOrSet(newRules, oldRules, replaced)
+	remove := differenceOrSet(oldRules, newRules, replaced)
+
+	snatRules := func(rules []string, source string) []string {
+		var result []string
+		for _, rule := range rules {
+			if strings.Contains(rule, "saddr "+source) {
+				result = append(result, rule)
+			}
+		}
+		return result
+	}
+
+	if want := snatRules(newRules, "10.0.1.0/24"); len(want) != 2 || !slices.Equal(add, want) {
+		t.Errorf("added rules:\n%q\nwant\n%q", add, want)
+	}
+	if want := snatRules(oldRules, "10.0.1.0/24"); len(want) != 3 || !slices.Equal(remove, want) {
+		t.Errorf("removed rules:\n%q\nwant\n%q", remove, want)
+	}
+
+	// An unchanged set is left alone
+	if replaced := changedSnatSets(newRules, newRules); len(replaced) != 0 {
+		t.Errorf("unchanged sets replaced: %v", replaced)
+	}
+}
+
+func TestCheckSupported(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		enabled bool
+		wantErr string
+	}{
+		{"netmap", config.Netmap6ModeNetmap, true, ""},
+		{"nptv6", config.Netmap6ModeNPTv6, true, "link eth0, netmap6 set c1: nptv6 mode needs the iptables backend"},
+		{"disabled nptv6", config.Netmap6ModeNPTv6, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			links := map[string]*link.Link{
+				"eth0": {Name: "eth0", Netmap6: map[string]*netmap6.Netmap6{
+					"c1": {Name: "c1", Enabled: tt.enabled, Mode: tt.mode},
+				}},
+				"eth1": {Name: "eth1"},
+			}
+
+			err := CheckSupported(links)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("CheckSupported() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("CheckSupported() error = %v, want %q", err, tt.wantErr)
+			}
+
+			// The plan fails before the live tables are listed
+			t.Setenv("PATH", t.TempDir())
+			if _, _, err := PlanNftRules(links); tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("PlanNftRules() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// fakeNft puts an nft on PATH that lists the given ruleset as the natman
+// tables, without saved copies of a previous load
+func fakeNft(t *testing.T, ruleset string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	listing := filepath.Join(dir, "listing")
+	if err := os.WriteFile(listing, []byte(ruleset), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := "#!/bin/sh\nif [ \"$3\" = ip ]; then cat " + listing + "; exit 0; fi\n" +
+		"echo 'Error: No such file or directory' >&2\nexit 1\n"
+	if err := os.WriteFile(filepath.Join(dir, "nft"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	savedRuleset, savedListing := RulesetStatePath, ListingStatePath
+	t.Cleanup(func() { RulesetStatePath, ListingStatePath = savedRuleset, savedListing })
+	RulesetStatePath = filepath.Join(dir, "ruleset.nft")
+	ListingStatePath = filepath.Join(dir, "ruleset.listed")
+}
+
+func TestPlanNftRulesOrder(t *testing.T) {
+	links := func(exclude ...string) map[string]*link.Link {
+		return map[string]*link.Link{
+			"eth0": {Name: "eth0", Nat44: &link.Nat44{Enabled: true, Exclude: exclude}},
+		}
+	}
+	exclude := func(prefixes string) string {
+		return "oifname \"eth0\" ip daddr { " + prefixes + " } return comment \"natman:eth0:nat44:exclude\""
+	}
+	masquerade := "oifname \"eth0\" masquerade comment \"natman:eth0:nat44:masquerade\""
+	rule := func(body string) string {
+		return "ip natman postrouting: " + body
+	}
+
+	tests := []struct {
+		name       string
+		old, new   []string
+		swapped    bool // the live exclusion comes after the masquerade rule
+		wantAdd    []string
+		wantRemove []string
+	}{
+		{
+			name: "unchanged",
+			old:  []string{"10.0.0.0/8"},
+			new:  []string{"10.0.0.0/8"},
+		},
+		{
+			name:       "changed exclusions",
+			old:        []string{"10.0.0.0/8"},
+			new:        []string{"10.0.0.0/8", "192.168.0.0/16"},
+			wantAdd:    []string{rule(exclude("10.0.0.0/8, 192.168.0.0/16"))},
+			wantRemove: []string{rule(exclude("10.0.0.0/8"))},
+		},
+		{
+			// The same rules in another order only differ by position
+			name:       "reordered",
+			old:        []string{"10.0.0.0/8"},
+			new:        []string{"10.0.0.0/8"},
+			swapped:    true,
+			wantAdd:    []string{rule(exclude("10.0.0.0/8")), rule(masquerade)},
+			wantRemove: []string{rule(masquerade), rule(exclude("10.0.0.0/8"))},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listing := GenerateRuleset(links(tt.old...))
+			if tt.swapped {
+				first := exclude(strings.Join(tt.old, ", "))
+				listing = strings.Replace(listing, first+"\n        "+masquerade, masquerade+"\n        "+first, 1)
+			}
+			fakeNft(t, listing)
+
+			add, remove, err := PlanNftRules(links(tt.new...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(add, tt.wantAdd) {
+				t.Errorf("added rules:\n%q\nwant\n%q", add, tt.wantAdd)
+			}
+			if !slices.Equal(remove, tt.wantRemove) {
+				t.Errorf("removed rules:\n%q\nwant\n%q", remove, tt.wantRemove)
+			}
+		})
+	}
+}
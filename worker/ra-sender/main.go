@@ -0,0 +1,751 @@
+package rasender
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"natman/config"
+	"natman/link"
+	"natman/link/radv"
+)
+
+// It sends the router advertisements of the links with radv enabled
+// without radvd: periodically to all nodes and in answer to router
+// solicitations, over a raw ICMPv6 socket bound to the link. The
+// advertisements are built from the same radv.RadvConfig model that
+// renders radvd.conf, so a configuration change goes out with the next
+// advertisement instead of through a daemon restart.
+
+// Debug flag
+var Debug bool = false
+
+// SetDebug enables debug logging
+func SetDebug(debug bool) {
+	Debug = debug
+}
+
+// DebugPrint prints a message if debug mode is enabled
+func DebugPrint(format string, args ...interface{}) {
+	if Debug {
+		fmt.Printf("[RA-DEBUG] "+format+"\n", args...)
+	}
+}
+
+// ICMPv6 message types and router constants of RFC 4861
+const (
+	typeRouterSolicitation  = 133
+	typeRouterAdvertisement = 134
+
+	maxInitialAdvertisements = 3
+	maxInitialInterval       = 16 * time.Second
+	minDelayBetweenRAs       = 3 * time.Second
+	maxRADelay               = 500 * time.Millisecond
+)
+
+// Neighbor discovery options
+const (
+	optSourceLLAddr = 1
+	optPrefixInfo   = 3
+	optMTU          = 5
+	optRouteInfo    = 24 // RFC 4191
+	optRDNSS        = 25 // RFC 8106
+	optDNSSL        = 31 // RFC 8106
+	optPREF64       = 38 // RFC 8781
+)
+
+// radvd's default AdvCurHopLimit
+const defaultHopLimit = 64
+
+var (
+	allNodes   = netip.MustParseAddr("ff02::1")
+	allRouters = netip.MustParseAddr("ff02::2")
+)
+
+// BuildAdvertisement renders the router advertisement of cfg. The
+// interface's link-layer address goes into the source link-layer address
+// option, its addresses replace prefixes advertised with the router
+// address flag and expand ::/64 style prefixes like radvd does. The
+// checksum is left to the kernel.
+func BuildAdvertisement(cfg *radv.RadvConfig, hardwareAddr net.HardwareAddr, addrs []netip.Prefix) []byte {
+	hopLimit := defaultHopLimit
+	if cfg.CurHopLimit != nil {
+		hopLimit = *cfg.CurHopLimit
+	}
+
+	var flags byte
+	switch cfg.DHCPv6 {
+	case config.DHCPv6Stateful:
+		flags |= 0x80 | 0x40
+	case config.DHCPv6Stateless:
+		flags |= 0x40
+	}
+	if cfg.HomeAgent {
+		flags |= 0x20
+	}
+	// A router that is no default router must announce medium preference
+	if cfg.DefaultLifetime > 0 {
+		flags |= preferenceBits(cfg.DefaultPreference)
+	}
+
+	msg := []byte{typeRouterAdvertisement, 0, 0, 0, byte(hopLimit), flags}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(cfg.DefaultLifetime))
+	msg = binary.BigEndian.AppendUint32(msg, uint32(cfg.ReachableTime))
+	msg = binary.BigEndian.AppendUint32(msg, uint32(cfg.RetransTimer))
+
+	if (cfg.SourceLLAddress == nil || *cfg.SourceLLAddress) && len(hardwareAddr) > 0 {
+		msg = appendOption(msg, optSourceLLAddr, hardwareAddr)
+	}
+
+	if cfg.LinkMTU != 0 {
+		msg = appendOption(msg, optMTU, binary.BigEndian.AppendUint32([]byte{0, 0}, uint32(cfg.LinkMTU)))
+	}
+
+	// Withdrawn prefixes and routes carry zero lifetimes
+	for _, prefix := range append(append([]radv.PrefixConfig{}, cfg.Prefixes...), cfg.WithdrawnPrefixes...) {
+		for _, advertised := range expandPrefix(prefix, addrs) {
+			var prefixFlags byte
+			if prefix.OnLink {
+				prefixFlags |= 0x80
+			}
+			if prefix.Autonomous {
+				prefixFlags |= 0x40
+			}
+			if prefix.RouterAddr {
+				prefixFlags |= 0x20
+			}
+
+			data := []byte{byte(advertised.Bits()), prefixFlags}
+			data = binary.BigEndian.AppendUint32(data, uint32(prefix.ValidLifetime))
+			data = binary.BigEndian.AppendUint32(data, uint32(prefix.PreferredLifetime))
+			data = append(data, 0, 0, 0, 0)
+			address := advertised.Addr().As16()
+			msg = appendOption(msg, optPrefixInfo, append(data, address[:]...))
+		}
+	}
+
+	routes := append(append([]radv.RouteConfig{}, cfg.Routes...), cfg.AutoRoutes...)
+	for _, route := range append(routes, cfg.WithdrawnRoutes...) {
+		prefix, err := netip.ParsePrefix(route.Prefix)
+		if err != nil || !prefix.Addr().Is6() {
+			DebugPrint("Skipping route %s: not an IPv6 prefix", route.Prefix)
+			continue
+		}
+		prefix = prefix.Masked()
+
+		// Only the bytes covering the prefix length are sent
+		size := 0
+		if prefix.Bits() > 64 {
+			size = 16
+		} else if prefix.Bits() > 0 {
+			size = 8
+		}
+		data := []byte{byte(prefix.Bits()), preferenceBits(route.Preference)}
+		data = binary.BigEndian.AppendUint32(data, uint32(route.Lifetime))
+		address := prefix.Addr().As16()
+		msg = appendOption(msg, optRouteInfo, append(data, address[:size]...))
+	}
+
+	for _, rdnss := range cfg.RDNSS {
+		data := binary.BigEndian.AppendUint32([]byte{0, 0}, uint32(rdnss.Lifetime))
+		count := 0
+		for _, server := range rdnss.Servers {
+			addr, err := netip.ParseAddr(server)
+			if err != nil || !addr.Is6() {
+				DebugPrint("Skipping RDNSS server %s: not an IPv6 address", server)
+				continue
+			}
+			address := addr.As16()
+			data = append(data, address[:]...)
+			count++
+		}
+		if count > 0 {
+			msg = appendOption(msg, optRDNSS, data)
+		}
+	}
+
+	for _, dnssl := range cfg.DNSSL {
+		if len(dnssl.Domains) == 0 {
+			continue
+		}
+		data := binary.BigEndian.AppendUint32([]byte{0, 0}, uint32(dnssl.Lifetime))
+		for _, domain := range dnssl.Domains {
+			for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+				data = append(data, byte(len(label)))
+				data = append(data, label...)
+			}
+			data = append(data, 0)
+		}
+		msg = appendOption(msg, optDNSSL, data)
+	}
+
+	if cfg.Nat64Prefix != nil {
+		if data, ok := pref64Option(cfg.Nat64Prefix); ok {
+			msg = appendOption(msg, optPREF64, data)
+		} else {
+			DebugPrint("Skipping PREF64 %s: unsupported prefix", cfg.Nat64Prefix.Prefix)
+		}
+	}
+
+	return msg
+}
+
+// appendOption adds an option, padded with zeros to a multiple of 8 bytes
+func appendOption(msg []byte, optionType byte, data []byte) []byte {
+	length := (2 + len(data) + 7) / 8
+	msg = append(msg, optionType, byte(length))
+	msg = append(msg, data...)
+	return append(msg, make([]byte, length*8-2-len(data))...)
+}
+
+// preferenceBits encodes a router or route preference (RFC 4191)
+func preferenceBits(preference string) byte {
+	switch preference {
+	case "high":
+		return 0x08
+	case "low":
+		return 0x18
+	}
+	return 0
+}
+
+// expandPrefix returns the prefixes to advertise for a configured one:
+// the interface's global prefixes of that length for ::/len and the
+// interface address within the prefix when the router address is sent
+func expandPrefix(prefix radv.PrefixConfig, addrs []netip.Prefix) []netip.Prefix {
+	configured, err := netip.ParsePrefix(prefix.Prefix)
+	if err != nil || !configured.Addr().Is6() {
+		DebugPrint("Skipping prefix %s: not an IPv6 prefix", prefix.Prefix)
+		return nil
+	}
+
+	if configured.Addr().IsUnspecified() {
+		var expanded []netip.Prefix
+		for _, addr := range addrs {
+			if addr.Addr().Is6() && !addr.Addr().IsLinkLocalUnicast() && addr.Bits() == configured.Bits() {
+				if prefix.RouterAddr {
+					expanded = append(expanded, addr)
+				} else {
+					expanded = append(expanded, addr.Masked())
+				}
+			}
+		}
+		return expanded
+	}
+
+	configured = configured.Masked()
+	if prefix.RouterAddr {
+		for _, addr := range addrs {
+			if configured.Contains(addr.Addr()) {
+				return []netip.Prefix{netip.PrefixFrom(addr.Addr(), configured.Bits())}
+			}
+		}
+	}
+	return []netip.Prefix{configured}
+}
+
+// pref64Option encodes the NAT64 prefix with its lifetime in units of
+// 8 seconds and the prefix length code of RFC 8781
+func pref64Option(pref64 *radv.Nat64PrefixConfig) ([]byte, bool) {
+	prefix, err := netip.ParsePrefix(pref64.Prefix)
+	if err != nil || !prefix.Addr().Is6() {
+		return nil, false
+	}
+
+	codes := map[int]uint16{96: 0, 64: 1, 56: 2, 48: 3, 40: 4, 32: 5}
+	code, ok := codes[prefix.Bits()]
+	if !ok {
+		return nil, false
+	}
+
+	scaled := (pref64.Lifetime + 7) / 8
+	if scaled > 0x1fff {
+		scaled = 0x1fff
+	}
+
+	data := binary.BigEndian.AppendUint16(nil, uint16(scaled)<<3|code)
+	address := prefix.Masked().Addr().As16()
+	return append(data, address[:12]...), true
+}
+
+// Engine runs a sender for every link with radv enabled
+type Engine struct {
+	mu      sync.Mutex
+	senders map[string]*sender
+	state   *radv.State // what the senders advertise, nil until loaded
+}
+
+func NewEngine() *Engine {
+	return &Engine{senders: make(map[string]*sender)}
+}
+
+// Update starts senders for new links, hands changed configurations to
+// the running ones and stops the senders of links that no longer
+// advertise. Prefixes and routes removed from the configuration are
+// withdrawn first. Without links every sender stops and the state of
+// what was advertised is kept for the next start.
+func (e *Engine) Update(links map[string]*link.Link) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if links != nil {
+		links = e.withdraw(links)
+	}
+
+	var names []string
+	for name, linkObj := range links {
+		if linkObj.Radv != nil && linkObj.Radv.Enabled {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+		cfg := links[name].Radv
+
+		s, ok := e.senders[name]
+		if !ok {
+			fmt.Printf("Sending router advertisements on %s\n", name)
+			s = newSender(name, cfg)
+			e.senders[name] = s
+			continue
+		}
+		if !reflect.DeepEqual(s.cfg, cfg) {
+			fmt.Printf("Router advertisement configuration of %s changed\n", name)
+			s.update(cfg)
+		}
+	}
+
+	for name, s := range e.senders {
+		if !wanted[name] {
+			s.stop()
+			delete(e.senders, name)
+			fmt.Printf("Stopped router advertisements on %s\n", name)
+		}
+	}
+}
+
+// withdraw adds what was advertised before and is no longer configured
+// to the links, the state file is written when that changes
+func (e *Engine) withdraw(links map[string]*link.Link) map[string]*link.Link {
+	if e.state == nil {
+		state, err := radv.LoadState(radv.StatePath)
+		if err != nil {
+			fmt.Printf("Warning: %v, removed prefixes and routes are not withdrawn\n", err)
+		}
+		e.state = state
+	}
+
+	links, state := link.WithdrawRadv(links, e.state, time.Now().Truncate(time.Second))
+	if !reflect.DeepEqual(state, e.state) {
+		if err := state.Save(radv.StatePath); err != nil {
+			fmt.Printf("Warning: failed to save radv state: %v\n", err)
+		}
+		e.state = state
+	}
+	return links
+}
+
+// Advertise sends an advertisement right away on the given links, for
+// instance after their interface came up
+func (e *Engine) Advertise(names []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, name := range names {
+		if s, ok := e.senders[name]; ok {
+			s.update(s.cfg)
+		}
+	}
+}
+
+// Close stops every sender, each announces that it is no default router
+// any more before it stops
+func (e *Engine) Close() {
+	e.Update(nil)
+}
+
+// sender advertises a single link. Its socket is opened lazily and
+// reopened when the interface is recreated.
+type sender struct {
+	name    string
+	cfg     *radv.RadvConfig // last configuration handed to the sender
+	configs chan *radv.RadvConfig
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newSender(name string, cfg *radv.RadvConfig) *sender {
+	s := &sender{
+		name:    name,
+		cfg:     cfg,
+		configs: make(chan *radv.RadvConfig, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go s.run(cfg)
+	return s
+}
+
+// update replaces the pending configuration, only the latest one matters
+func (s *sender) update(cfg *radv.RadvConfig) {
+	s.cfg = cfg
+	select {
+	case <-s.configs:
+	default:
+	}
+	s.configs <- cfg
+}
+
+func (s *sender) stop() {
+	close(s.done)
+	<-s.stopped
+}
+
+func (s *sender) run(cfg *radv.RadvConfig) {
+	defer close(s.stopped)
+
+	var sock *socket
+	defer func() {
+		if sock != nil {
+			// Hosts drop the router from their default router list
+			sock.advertise(cfg, true)
+			sock.close()
+		}
+	}()
+
+	solicitations := make(chan netip.Addr, 16)
+	initial := 0
+	var lastMulticast time.Time
+
+	next := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	// schedule moves the next multicast advertisement forward to at
+	schedule := func(at time.Time) {
+		if at.Before(next) {
+			next = at
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(time.Until(at))
+		}
+	}
+
+	var lastError string
+	for {
+		select {
+		case <-s.done:
+			return
+
+		case cfg = <-s.configs:
+			// Advertise the change right away and speed up like after a start
+			initial = 0
+			schedule(time.Now())
+
+		case <-timer.C:
+			var err error
+			sock, err = s.open(sock, solicitations)
+			if err == nil {
+				err = sock.advertise(cfg, false)
+			}
+			if err != nil {
+				// Reported once, the interface may simply not be there yet
+				if err.Error() != lastError {
+					fmt.Printf("Error sending router advertisement on %s: %v\n", s.name, err)
+					lastError = err.Error()
+				}
+			} else {
+				lastError = ""
+				lastMulticast = time.Now()
+			}
+
+			interval := time.Duration(cfg.MinAdvInterval)*time.Second +
+				time.Duration(rand.Int63n(int64(cfg.MaxAdvInterval-cfg.MinAdvInterval)*int64(time.Second)+1))
+			if initial < maxInitialAdvertisements {
+				initial++
+				if interval > maxInitialInterval {
+					interval = maxInitialInterval
+				}
+			}
+			next = time.Now().Add(interval)
+			timer.Reset(interval)
+
+		case source := <-solicitations:
+			if sock == nil {
+				continue
+			}
+			if len(cfg.Clients) > 0 && !isClient(cfg, source) {
+				DebugPrint("Ignoring router solicitation from %s on %s", source, s.name)
+				continue
+			}
+			if source.IsUnspecified() {
+				// Multicast answers are delayed and rate limited (RFC 4861 6.2.6)
+				at := time.Now().Add(time.Duration(rand.Int63n(int64(maxRADelay))))
+				if earliest := lastMulticast.Add(minDelayBetweenRAs); at.Before(earliest) {
+					at = earliest
+				}
+				schedule(at)
+				continue
+			}
+			DebugPrint("Answering router solicitation from %s on %s", source, s.name)
+			if err := sock.send(cfg, false, source); err != nil {
+				DebugPrint("Failed to answer %s on %s: %v", source, s.name, err)
+			}
+		}
+	}
+}
+
+// open returns a socket on the current interface of the link, replacing
+// sock when the interface was recreated under the same name
+func (s *sender) open(sock *socket, solicitations chan<- netip.Addr) (*socket, error) {
+	iface, err := net.InterfaceByName(s.name)
+	if err != nil {
+		if sock != nil {
+			sock.close()
+		}
+		return nil, err
+	}
+	if sock != nil {
+		if sock.iface.Index == iface.Index {
+			sock.iface = iface
+			return sock, nil
+		}
+		sock.close()
+	}
+
+	sock, err = listen(iface)
+	if err != nil {
+		return nil, err
+	}
+	DebugPrint("Opened router advertisement socket on %s (index %d)", iface.Name, iface.Index)
+	go sock.receive(solicitations)
+	return sock, nil
+}
+
+// socket is a raw ICMPv6 socket bound to one interface, it receives the
+// router solicitations of the link
+type socket struct {
+	conn  *net.IPConn
+	iface *net.Interface
+}
+
+func listen(iface *net.Interface) (*socket, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var setupErr error
+			if err := c.Control(func(fd uintptr) {
+				setupErr = setup(int(fd), iface)
+			}); err != nil {
+				return err
+			}
+			return setupErr
+		},
+	}
+
+	conn, err := lc.ListenPacket(context.Background(), "ip6:ipv6-icmp", "::")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ICMPv6 socket: %v", err)
+	}
+	return &socket{conn: conn.(*net.IPConn), iface: iface}, nil
+}
+
+// setup binds the socket to the interface, sends with the hop limit of 255
+// neighbor discovery requires and only lets router solicitations in
+func setup(fd int, iface *net.Interface) error {
+	if err := syscall.BindToDevice(fd, iface.Name); err != nil {
+		return fmt.Errorf("failed to bind to %s: %v", iface.Name, err)
+	}
+
+	for _, option := range []struct {
+		name  int
+		value int
+	}{
+		{syscall.IPV6_MULTICAST_HOPS, 255},
+		{syscall.IPV6_UNICAST_HOPS, 255},
+		{syscall.IPV6_MULTICAST_IF, iface.Index},
+		{syscall.IPV6_MULTICAST_LOOP, 0},
+		{syscall.IPV6_RECVHOPLIMIT, 1},
+	} {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, option.name, option.value); err != nil {
+			return fmt.Errorf("failed to set socket option %d: %v", option.name, err)
+		}
+	}
+
+	// A set bit blocks the message type
+	var filter syscall.ICMPv6Filter
+	for i := range filter.Data {
+		filter.Data[i] = 0xffffffff
+	}
+	filter.Data[typeRouterSolicitation>>5] &^= 1 << (typeRouterSolicitation & 31)
+	if err := syscall.SetsockoptICMPv6Filter(fd, syscall.IPPROTO_ICMPV6, syscall.ICMPV6_FILTER, &filter); err != nil {
+		return fmt.Errorf("failed to set ICMPv6 filter: %v", err)
+	}
+
+	// Forwarding hosts are in the all-routers group already
+	mreq := &syscall.IPv6Mreq{Multiaddr: allRouters.As16(), Interface: uint32(iface.Index)}
+	if err := syscall.SetsockoptIPv6Mreq(fd, syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq); err != nil && err != syscall.EADDRINUSE {
+		return fmt.Errorf("failed to join %s on %s: %v", allRouters, iface.Name, err)
+	}
+
+	return nil
+}
+
+func (sock *socket) close() {
+	sock.conn.Close()
+}
+
+// receive passes the source of every valid router solicitation on until
+// the socket is closed
+func (sock *socket) receive(solicitations chan<- netip.Addr) {
+	buf := make([]byte, 1500)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	for {
+		n, oobn, _, from, err := sock.conn.ReadMsgIP(buf, oob)
+		if err != nil {
+			return
+		}
+
+		// Solicitations that crossed a router are forged (RFC 4861 6.1.1)
+		if n < 8 || buf[0] != typeRouterSolicitation || buf[1] != 0 || hopLimit(oob[:oobn]) != 255 {
+			continue
+		}
+
+		source, ok := netip.AddrFromSlice(from.IP)
+		if !ok {
+			continue
+		}
+		select {
+		case solicitations <- source.WithZone(""):
+		default:
+		}
+	}
+}
+
+// hopLimit returns the hop limit of a received packet from its control
+// messages, 0 when it is missing
+func hopLimit(oob []byte) int {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, m := range messages {
+		if m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_HOPLIMIT && len(m.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&m.Data[0])))
+		}
+	}
+	return 0
+}
+
+// advertise sends the periodic advertisement to all nodes, or to each of
+// the clients when the advertisements are limited to them
+func (sock *socket) advertise(cfg *radv.RadvConfig, final bool) error {
+	if len(cfg.Clients) == 0 {
+		return sock.send(cfg, final, allNodes)
+	}
+
+	var errs []string
+	for _, client := range cfg.Clients {
+		addr, err := netip.ParseAddr(client)
+		if err != nil {
+			continue
+		}
+		if err := sock.send(cfg, final, addr); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// send builds the advertisement from the current interface state and
+// sends it to destination. The final advertisement of a stopping sender
+// carries a router lifetime of 0.
+func (sock *socket) send(cfg *radv.RadvConfig, final bool, destination netip.Addr) error {
+	var addrs []netip.Prefix
+	if ifaceAddrs, err := sock.iface.Addrs(); err == nil {
+		for _, ifaceAddr := range ifaceAddrs {
+			if ipNet, ok := ifaceAddr.(*net.IPNet); ok {
+				addr, _ := netip.AddrFromSlice(ipNet.IP)
+				bits, _ := ipNet.Mask.Size()
+				addrs = append(addrs, netip.PrefixFrom(addr.Unmap(), bits))
+			}
+		}
+	}
+
+	msg := BuildAdvertisement(cfg, sock.iface.HardwareAddr, addrs)
+	if final {
+		msg[6], msg[7] = 0, 0
+	}
+
+	var oob []byte
+	if source, ok := sourceAddress(cfg, addrs); ok {
+		oob = pktinfo(source, sock.iface.Index)
+	}
+
+	to := &net.IPAddr{IP: net.IP(destination.AsSlice()), Zone: sock.iface.Name}
+	if _, _, err := sock.conn.WriteMsgIP(msg, oob, to); err != nil {
+		return fmt.Errorf("failed to send to %s: %v", destination, err)
+	}
+	DebugPrint("Sent %d byte router advertisement to %s on %s", len(msg), destination, sock.iface.Name)
+	return nil
+}
+
+// isClient tells whether advertisements are limited to address
+func isClient(cfg *radv.RadvConfig, address netip.Addr) bool {
+	for _, client := range cfg.Clients {
+		if addr, err := netip.ParseAddr(client); err == nil && addr == address {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceAddress picks the first configured source address present on
+// the interface, the kernel chooses a link-local address otherwise
+func sourceAddress(cfg *radv.RadvConfig, addrs []netip.Prefix) (netip.Addr, bool) {
+	for _, candidate := range cfg.RASrcAddress {
+		source, err := netip.ParseAddr(candidate)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.Addr() == source {
+				return source, true
+			}
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// pktinfo renders an IPV6_PKTINFO control message selecting the source
+// address and interface of a packet
+func pktinfo(source netip.Addr, index int) []byte {
+	info := syscall.Inet6Pktinfo{Addr: source.As16(), Ifindex: uint32(index)}
+
+	oob := make([]byte, syscall.CmsgSpace(syscall.SizeofInet6Pktinfo))
+	header := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	header.Level = syscall.IPPROTO_IPV6
+	header.Type = syscall.IPV6_PKTINFO
+	header.SetLen(syscall.CmsgLen(syscall.SizeofInet6Pktinfo))
+	*(*syscall.Inet6Pktinfo)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = info
+	return oob
+}
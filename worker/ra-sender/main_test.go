@@ -0,0 +1,367 @@
+package rasender
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"natman/config"
+	"natman/link/radv"
+)
+
+// noDefaultRouter is the header of an advertisement with default values
+// and a router lifetime of 0
+var noDefaultRouter = []byte{134, 0, 0, 0, 64, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+func TestBuildAdvertisementHeader(t *testing.T) {
+	hopLimit := 255
+	noSourceLLAddress := false
+	hardwareAddr := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+
+	tests := []struct {
+		name string
+		cfg  *radv.RadvConfig
+		want []byte
+	}{
+		{
+			name: "default router",
+			cfg: &radv.RadvConfig{
+				DefaultLifetime:   1800,
+				DefaultPreference: "high",
+				DHCPv6:            config.DHCPv6Stateless,
+				LinkMTU:           1500,
+				ReachableTime:     30000,
+				RetransTimer:      1000,
+			},
+			want: []byte{
+				134, 0, 0, 0, 64, 0x48, 0x07, 0x08, 0, 0, 0x75, 0x30, 0, 0, 0x03, 0xe8,
+				optSourceLLAddr, 1, 0x02, 0, 0, 0, 0, 0x01,
+				optMTU, 1, 0, 0, 0, 0, 0x05, 0xdc,
+			},
+		},
+		{
+			name: "no default router",
+			cfg: &radv.RadvConfig{
+				DefaultPreference: "low",
+				DHCPv6:            config.DHCPv6Stateful,
+				HomeAgent:         true,
+				CurHopLimit:       &hopLimit,
+				SourceLLAddress:   &noSourceLLAddress,
+			},
+			// The preference is left out without a router lifetime
+			want: []byte{134, 0, 0, 0, 255, 0xe0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := BuildAdvertisement(tt.cfg, hardwareAddr, nil)
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("advertisement:\n% x\nwant\n% x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildAdvertisementOptions(t *testing.T) {
+	addrs := []netip.Prefix{
+		netip.MustParsePrefix("fe80::1/64"),
+		netip.MustParsePrefix("2001:db8:2::1/64"),
+		netip.MustParsePrefix("192.0.2.1/24"),
+	}
+
+	tests := []struct {
+		name string
+		cfg  *radv.RadvConfig
+		want []byte // options after the header
+	}{
+		{
+			name: "prefix information",
+			cfg: &radv.RadvConfig{Prefixes: []radv.PrefixConfig{
+				{Prefix: "2001:db8:1::/64", OnLink: true, Autonomous: true, ValidLifetime: 86400, PreferredLifetime: 14400},
+			}},
+			want: []byte{
+				optPrefixInfo, 4, 64, 0xc0, 0, 0x01, 0x51, 0x80, 0, 0, 0x38, 0x40, 0, 0, 0, 0,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			},
+		},
+		{
+			name: "prefix expanded from the interface with the router address",
+			cfg: &radv.RadvConfig{
+				Prefixes: []radv.PrefixConfig{
+					{Prefix: "::/64", OnLink: true, RouterAddr: true, ValidLifetime: 600, PreferredLifetime: 300},
+				},
+				WithdrawnPrefixes: []radv.PrefixConfig{
+					{Prefix: "2001:db8:3::/64", Autonomous: true, ValidLifetime: 7200},
+				},
+			},
+			want: []byte{
+				optPrefixInfo, 4, 64, 0xa0, 0, 0, 0x02, 0x58, 0, 0, 0x01, 0x2c, 0, 0, 0, 0,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01,
+				optPrefixInfo, 4, 64, 0x40, 0, 0, 0x1c, 0x20, 0, 0, 0, 0, 0, 0, 0, 0,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0x03, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			},
+		},
+		{
+			name: "route information lengths",
+			cfg: &radv.RadvConfig{
+				Routes: []radv.RouteConfig{
+					{Prefix: "::/0", Preference: "low", Lifetime: 1800},
+					{Prefix: "2001:db8:ffff::1/48", Preference: "high", Lifetime: 3600},
+					{Prefix: "10.0.0.0/8", Lifetime: 3600},
+				},
+				AutoRoutes: []radv.RouteConfig{
+					{Prefix: "2001:db8:1:2:3::/80", Preference: "medium", Lifetime: 600},
+				},
+				WithdrawnRoutes: []radv.RouteConfig{
+					{Prefix: "2001:db8:4::/64"},
+				},
+			},
+			want: []byte{
+				optRouteInfo, 1, 0, 0x18, 0, 0, 0x07, 0x08,
+				optRouteInfo, 2, 48, 0x08, 0, 0, 0x0e, 0x10,
+				0x20, 0x01, 0x0d, 0xb8, 0xff, 0xff, 0, 0,
+				optRouteInfo, 3, 80, 0, 0, 0, 0x02, 0x58,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0x01, 0, 0x02, 0, 0x03, 0, 0, 0, 0, 0, 0,
+				optRouteInfo, 2, 64, 0, 0, 0, 0, 0,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0x04, 0, 0,
+			},
+		},
+		{
+			name: "recursive DNS servers",
+			cfg: &radv.RadvConfig{RDNSS: []radv.RDNSSConfig{
+				{Servers: []string{"2001:db8::53", "192.0.2.53", "2001:db8::54"}, Lifetime: 600},
+				{Servers: []string{"192.0.2.53"}, Lifetime: 600},
+			}},
+			want: []byte{
+				optRDNSS, 5, 0, 0, 0, 0, 0x02, 0x58,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x53,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x54,
+			},
+		},
+		{
+			name: "DNS search list padding",
+			cfg: &radv.RadvConfig{DNSSL: []radv.DNSSLConfig{
+				{Domains: []string{"example.com."}, Lifetime: 600},
+				{Domains: []string{"lan", "example.org"}, Lifetime: 1200},
+				{Lifetime: 600},
+			}},
+			want: []byte{
+				optDNSSL, 3, 0, 0, 0, 0, 0x02, 0x58,
+				7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 0, 0,
+				optDNSSL, 4, 0, 0, 0, 0, 0x04, 0xb0,
+				3, 'l', 'a', 'n', 0, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'o', 'r',
+				'g', 0, 0, 0, 0, 0, 0, 0,
+			},
+		},
+		{
+			name: "PREF64 /64",
+			cfg:  &radv.RadvConfig{Nat64Prefix: &radv.Nat64PrefixConfig{Prefix: "64:ff9b:1::/64", Lifetime: 601}},
+			// 601 seconds round up to 76 units of 8 seconds, code 1 is /64
+			want: []byte{
+				optPREF64, 2, 0x02, 0x61,
+				0, 0x64, 0xff, 0x9b, 0, 0x01, 0, 0, 0, 0, 0, 0,
+			},
+		},
+		{
+			name: "PREF64 lifetime capped",
+			cfg:  &radv.RadvConfig{Nat64Prefix: &radv.Nat64PrefixConfig{Prefix: "64:ff9b::/96", Lifetime: 70000}},
+			want: []byte{
+				optPREF64, 2, 0xff, 0xf8,
+				0, 0x64, 0xff, 0x9b, 0, 0, 0, 0, 0, 0, 0, 0,
+			},
+		},
+		{
+			name: "PREF64 unsupported length",
+			cfg:  &radv.RadvConfig{Nat64Prefix: &radv.Nat64PrefixConfig{Prefix: "64:ff9b::/80", Lifetime: 600}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := BuildAdvertisement(tt.cfg, nil, addrs)
+			want := append(append([]byte{}, noDefaultRouter...), tt.want...)
+			if !bytes.Equal(got, want) {
+				t.Errorf("advertisement:\n% x\nwant\n% x", got, want)
+			}
+		})
+	}
+}
+
+// TestSolicitedAdvertisement runs a sender on one end of a veth pair and
+// solicits an advertisement from the other end, which lives in its own
+// network namespace
+func TestSolicitedAdvertisement(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating a network namespace needs root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("ip is not installed")
+	}
+
+	namespace := fmt.Sprintf("natman-ra-%d", os.Getpid())
+	ip := func(args ...string) error {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("ip %v: %v: %s", args, err, out)
+		}
+		return nil
+	}
+	if err := ip("netns", "add", namespace); err != nil {
+		t.Skip(err)
+	}
+	defer ip("netns", "del", namespace)
+
+	// Fixed link-local addresses without duplicate address detection can
+	// be used right away
+	for _, args := range [][]string{
+		{"link", "add", "natman-ra0", "type", "veth", "peer", "name", "natman-ra1", "netns", namespace},
+		{"link", "set", "natman-ra0", "addrgenmode", "none"},
+		{"addr", "add", "fe80::1/64", "dev", "natman-ra0", "nodad"},
+		{"link", "set", "natman-ra0", "up"},
+		{"-n", namespace, "link", "set", "natman-ra1", "addrgenmode", "none"},
+		{"-n", namespace, "addr", "add", "fe80::2/64", "dev", "natman-ra1", "nodad"},
+		{"-n", namespace, "link", "set", "natman-ra1", "up"},
+	} {
+		if err := ip(args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer ip("link", "del", "natman-ra0")
+
+	cfg := &radv.RadvConfig{
+		Enabled:         true,
+		MinAdvInterval:  200,
+		MaxAdvInterval:  600,
+		DefaultLifetime: 1800,
+		Prefixes: []radv.PrefixConfig{
+			{Prefix: "2001:db8:1::/64", OnLink: true, Autonomous: true, ValidLifetime: 86400, PreferredLifetime: 14400},
+		},
+		RDNSS: []radv.RDNSSConfig{{Servers: []string{"2001:db8:1::53"}, Lifetime: 600}},
+	}
+	s := newSender("natman-ra0", cfg)
+	defer s.stop()
+
+	iface, err := net.InterfaceByName("natman-ra0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BuildAdvertisement(cfg, iface.HardwareAddr, []netip.Prefix{netip.MustParsePrefix("fe80::1/64")})
+
+	// The host side runs as this test binary inside the namespace
+	cmd := exec.Command("ip", "netns", "exec", namespace, os.Args[0], "-test.run=^TestSolicitHost$")
+	cmd.Env = append(os.Environ(), "NATMAN_SOLICIT_ON=natman-ra1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("soliciting host failed: %v\n%s", err, out)
+	}
+
+	var got []byte
+	for _, line := range strings.Split(string(out), "\n") {
+		if encoded, ok := strings.CutPrefix(line, "advertisement "); ok {
+			if got, err = hex.DecodeString(encoded); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if got == nil {
+		t.Fatalf("soliciting host received no advertisement:\n%s", out)
+	}
+
+	// The kernel fills in the checksum
+	got[2], got[3] = 0, 0
+	if !bytes.Equal(got, want) {
+		t.Errorf("advertisement:\n% x\nwant\n% x", got, want)
+	}
+}
+
+// TestSolicitHost is the host side of TestSolicitedAdvertisement. It
+// sends router solicitations until it receives an advertisement sent to
+// its own address, unsolicited ones go to all nodes.
+func TestSolicitHost(t *testing.T) {
+	name := os.Getenv("NATMAN_SOLICIT_ON")
+	if name == "" {
+		t.Skip("only run by TestSolicitedAdvertisement")
+	}
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var setupErr error
+			if err := c.Control(func(fd uintptr) {
+				setupErr = syscall.BindToDevice(int(fd), name)
+				for _, option := range []struct {
+					name  int
+					value int
+				}{
+					{syscall.IPV6_MULTICAST_HOPS, 255},
+					{syscall.IPV6_UNICAST_HOPS, 255},
+					{syscall.IPV6_RECVPKTINFO, 1},
+				} {
+					if setupErr == nil {
+						setupErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, option.name, option.value)
+					}
+				}
+			}); err != nil {
+				return err
+			}
+			return setupErr
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), "ip6:ipv6-icmp", "::")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	host := conn.(*net.IPConn)
+
+	solicitation := []byte{typeRouterSolicitation, 0, 0, 0, 0, 0, 0, 0}
+	buf := make([]byte, 1500)
+	oob := make([]byte, syscall.CmsgSpace(syscall.SizeofInet6Pktinfo))
+	deadline := time.Now().Add(10 * time.Second)
+
+	// The sender may not listen yet, so the solicitation is repeated
+	for time.Now().Before(deadline) {
+		if _, err := host.WriteToIP(solicitation, &net.IPAddr{IP: net.IP(allRouters.AsSlice()), Zone: name}); err != nil {
+			t.Fatal(err)
+		}
+
+		host.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			n, oobn, _, _, err := host.ReadMsgIP(buf, oob)
+			if err != nil {
+				break
+			}
+			if n == 0 || buf[0] != typeRouterAdvertisement {
+				continue
+			}
+			if destination, ok := packetDestination(oob[:oobn]); ok && !destination.IsMulticast() {
+				fmt.Printf("advertisement %s\n", hex.EncodeToString(buf[:n]))
+				return
+			}
+		}
+	}
+	t.Fatal("no answer to the router solicitations")
+}
+
+// packetDestination returns the destination address of a received packet
+// from its IPV6_PKTINFO control message
+func packetDestination(oob []byte) (netip.Addr, bool) {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	for _, m := range messages {
+		if m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_PKTINFO && len(m.Data) >= 16 {
+			return netip.AddrFrom16([16]byte(m.Data[:16])), true
+		}
+	}
+	return netip.Addr{}, false
+}
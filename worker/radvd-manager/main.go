@@ -5,51 +5,95 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"natman/link"
 	rad "natman/link/radv"
 )
 
+// Locations of the radvd pidfile, depending on the distribution
+var radvdPidFiles = []string{"/run/radvd.pid", "/var/run/radvd.pid", "/run/radvd/radvd.pid"}
+
 // It creates a radvd configuration file based on the provided configuration.
 // compares the hash of existing file /etc/radvd.conf with the hash of the new file
-// if they are different, it writes the new file to /etc/radvd.conf
-// and restarts the radvd service
+// if they are different, it writes the new file next to /etc/radvd.conf,
+// checks it with radvd -c, renames it into place and has the running
+// radvd reload it. A rejected file leaves the live one untouched.
 func CreateRadvdConfig(links map[string]*link.Link) error {
 	fmt.Println("Creating radvd configuration file...", rad.RadvdConfPath)
 
-	// Generate new configuration
-	newConfig := generateRadvdConfig(links)
+	plan := PlanRadvdConfig(links)
+	if !plan.Changed {
+		fmt.Println("Radvd configuration unchanged, skipping update")
+		saveState(plan.state)
+		return nil
+	}
 
-	// Calculate hash of new config
-	newHash := calculateHash(newConfig)
+	if err := installRadvdConfig(rad.RadvdConfPath, plan.content); err != nil {
+		return err
+	}
 
-	// Read existing config and calculate its hash
-	existingConfig, err := os.ReadFile(rad.RadvdConfPath)
-	var existingHash string
-	if err == nil {
-		existingHash = calculateHash(string(existingConfig))
+	action, err := reloadRadvdService()
+	if err != nil {
+		return fmt.Errorf("failed to reload radvd service: %v", err)
 	}
 
-	// Compare hashes
-	if newHash == existingHash {
-		fmt.Println("Radvd configuration unchanged, skipping update")
-		return nil
+	fmt.Printf("Radvd configuration updated and service %s\n", action)
+	saveState(plan.state)
+	return nil
+}
+
+// saveState remembers what radvd advertises now, for withdrawing what is
+// removed from the configuration later
+func saveState(state *rad.State) {
+	if err := state.Save(rad.StatePath); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to save radv state: %v\n", err)
 	}
+}
 
-	// Write new configuration
-	err = os.WriteFile(rad.RadvdConfPath, []byte(newConfig), 0644)
+// RadvdPlan describes how the generated radvd configuration differs from
+// the file currently installed at rad.RadvdConfPath
+type RadvdPlan struct {
+	Path    string `json:"path"`
+	Changed bool   `json:"changed"`
+	Diff    string `json:"diff,omitempty"`
+
+	content string
+	state   *rad.State
+}
+
+// PlanRadvdConfig generates the radvd configuration and compares it with
+// the installed file without writing anything. Prefixes and routes that
+// were advertised before and are no longer configured are withdrawn.
+func PlanRadvdConfig(links map[string]*link.Link) *RadvdPlan {
+	previous, err := rad.LoadState(rad.StatePath)
 	if err != nil {
-		return fmt.Errorf("failed to write radvd config: %v", err)
+		fmt.Fprintf(os.Stderr, "Warning: %v, removed prefixes and routes are not withdrawn\n", err)
 	}
+	links, state := link.WithdrawRadv(links, previous, time.Now().Truncate(time.Second))
 
-	// Restart radvd service
-	if err := restartRadvdService(); err != nil {
-		return fmt.Errorf("failed to restart radvd service: %v", err)
+	// Generate new configuration
+	newConfig := generateRadvdConfig(links)
+
+	// Read existing config, a missing file compares as empty
+	var existingConfig string
+	if data, err := os.ReadFile(rad.RadvdConfPath); err == nil {
+		existingConfig = string(data)
 	}
 
-	fmt.Println("Radvd configuration updated and service restarted")
-	return nil
+	plan := &RadvdPlan{Path: rad.RadvdConfPath, content: newConfig, state: state}
+
+	// Compare hashes
+	if calculateHash(newConfig) != calculateHash(existingConfig) {
+		plan.Changed = true
+		plan.Diff = unifiedDiff(rad.RadvdConfPath, existingConfig, newConfig)
+	}
+
+	return plan
 }
 
 func generateRadvdConfig(links map[string]*link.Link) string {
@@ -58,7 +102,8 @@ func generateRadvdConfig(links map[string]*link.Link) string {
 	config.WriteString("# Generated by natman-go\n")
 	config.WriteString("# Do not edit manually\n\n")
 
-	for linkName, linkObj := range links {
+	for _, linkName := range link.SortedNames(links) {
+		linkObj := links[linkName]
 		if linkObj.Radv != nil && linkObj.Radv.Enabled {
 			interfaceConfig := linkObj.Radv.GenerateConfig(linkName)
 			config.WriteString(interfaceConfig)
@@ -85,6 +130,212 @@ func calculateHash(content string) string {
 	return fmt.Sprintf("%x", hash)
 }
 
+// unifiedDiff renders the difference between two texts in unified diff
+// format with three lines of context around each change
+func unifiedDiff(path, oldText, newText string) string {
+	const context = 3
+
+	a := splitLines(oldText)
+	b := splitLines(newText)
+
+	// Longest common subsequence table, lcs[i][j] covers a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// Walk the table into a flat edit script
+	type edit struct {
+		op   byte
+		line string
+		a, b int // line numbers before the edit, 0-based
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i], i, j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', a[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s (generated)\n", path, path)
+
+	// Group changes into hunks, merging those closer than 2*context lines
+	for start := 0; start < len(edits); {
+		if edits[start].op == ' ' {
+			start++
+			continue
+		}
+
+		first := start - context
+		if first < 0 {
+			first = 0
+		}
+		last := start
+		for k := start; k < len(edits); k++ {
+			if edits[k].op != ' ' {
+				last = k
+			} else if k-last > 2*context {
+				break
+			}
+		}
+		end := last + context + 1
+		if end > len(edits) {
+			end = len(edits)
+		}
+
+		hunk := edits[first:end]
+		var oldCount, newCount int
+		for _, e := range hunk {
+			if e.op != '+' {
+				oldCount++
+			}
+			if e.op != '-' {
+				newCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n",
+			hunkRange(hunk[0].a, oldCount), hunkRange(hunk[0].b, newCount))
+		for _, e := range hunk {
+			fmt.Fprintf(&out, "%c%s\n", e.op, e.line)
+		}
+
+		start = end
+	}
+
+	return out.String()
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// installRadvdConfig stages content in a temporary file in the directory
+// of path, so that the rename replacing the live file is atomic, and only
+// installs it when radvd accepts it. The shipped units make /etc writable
+// for the rename.
+func installRadvdConfig(path, content string) error {
+	tmpPath, err := writeTempConfig(filepath.Dir(path), content)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	if err := validateRadvdFile(tmpPath); err != nil {
+		return fmt.Errorf("generated radvd config rejected, keeping %s: %v", path, err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to install radvd config %s: %v", path, err)
+	}
+	return nil
+}
+
+// writeTempConfig writes content to a new file in dir with the mode of
+// radvd.conf and returns its path
+func writeTempConfig(dir, content string) (string, error) {
+	tmp, err := os.CreateTemp(dir, ".radvd.conf.natman-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary radvd config: %v", err)
+	}
+
+	_, err = tmp.WriteString(content)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write temporary radvd config %s: %v", tmp.Name(), err)
+	}
+	return tmp.Name(), nil
+}
+
+// reloadRadvdService makes radvd re-read its configuration without
+// stopping the advertisements, through systemd or SIGHUP to the PID of its
+// pidfile. radvd is only restarted when it is not running or cannot be
+// reloaded. It returns what was done.
+func reloadRadvdService() (string, error) {
+	if active, err := GetRadvdStatus(); err == nil && active {
+		if err := exec.Command("systemctl", "reload", "radvd").Run(); err == nil {
+			return "reloaded", nil
+		}
+	}
+
+	if pid, ok := radvdPid(); ok {
+		err := syscall.Kill(pid, syscall.SIGHUP)
+		if err == nil {
+			return "reloaded", nil
+		}
+		// radvd usually runs as its own user, signalling it needs CAP_KILL
+		fmt.Printf("Warning: failed to send SIGHUP to radvd (PID %d): %v\n", pid, err)
+	}
+
+	if err := restartRadvdService(); err != nil {
+		return "", err
+	}
+	return "restarted", nil
+}
+
+// radvdPid returns the PID of the running radvd from its pidfile. A stale
+// pidfile whose PID now belongs to another process is ignored.
+func radvdPid() (int, bool) {
+	for _, path := range radvdPidFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || pid <= 0 {
+			continue
+		}
+		comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+		if err == nil && strings.TrimSpace(string(comm)) == "radvd" {
+			return pid, true
+		}
+	}
+	return 0, false
+}
+
 func restartRadvdService() error {
 	// Try systemctl first
 	cmd := exec.Command("systemctl", "restart", "radvd")
@@ -104,10 +355,31 @@ func restartRadvdService() error {
 }
 
 func ValidateRadvdConfig() error {
-	cmd := exec.Command("radvd", "-c", "-C", rad.RadvdConfPath)
+	return validateRadvdFile(rad.RadvdConfPath)
+}
+
+// ValidateGeneratedConfig checks the configuration natman would install
+// with radvd -c, without touching the live file
+func ValidateGeneratedConfig(links map[string]*link.Link) error {
+	tmpPath, err := writeTempConfig(os.TempDir(), PlanRadvdConfig(links).content)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	return validateRadvdFile(tmpPath)
+}
+
+// validateRadvdFile checks a configuration file with radvd -c
+func validateRadvdFile(path string) error {
+	cmd := exec.Command("radvd", "-c", "-C", path)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("radvd config validation failed: %s", string(output))
+		// Without output radvd did not run at all, e.g. it is not installed
+		if len(strings.TrimSpace(string(output))) == 0 {
+			return fmt.Errorf("radvd config validation failed: %v", err)
+		}
+		return fmt.Errorf("radvd config validation failed: %s", strings.TrimSpace(string(output)))
 	}
 	return nil
 }
@@ -0,0 +1,183 @@
+package radvdmanager
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"natman/config"
+	"natman/link"
+	rad "natman/link/radv"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// golden compares got with the golden file, or rewrites it with -update
+func golden(t *testing.T, path, got string) {
+	t.Helper()
+
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("output differs from %s:\n%s", path, unifiedDiff(path, string(want), got))
+	}
+}
+
+func TestGenerateRadvdConfig(t *testing.T) {
+	for _, name := range []string{"basic", "full"} {
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", name+".yaml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := config.Validate(data)
+			if err != nil {
+				t.Fatalf("invalid test config: %v", err)
+			}
+			links, err := link.BuildLinks(cfg)
+			if err != nil {
+				t.Fatalf("invalid test links: %v", err)
+			}
+
+			got := generateRadvdConfig(links)
+
+			// Links live in a map, every rendering must come out the same
+			for i := 0; i < 20; i++ {
+				if again := generateRadvdConfig(links); again != got {
+					t.Fatalf("rendering is not deterministic:\n%s", unifiedDiff("first", got, again))
+				}
+			}
+
+			golden(t, filepath.Join("testdata", name+".radvd.conf"), got)
+		})
+	}
+}
+
+func TestWithdrawRemoved(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "basic.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Validate(data)
+	if err != nil {
+		t.Fatalf("invalid test config: %v", err)
+	}
+	links, err := link.BuildLinks(cfg)
+	if err != nil {
+		t.Fatalf("invalid test links: %v", err)
+	}
+	previous, err := rad.LoadState(filepath.Join("testdata", "withdraw.state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The default withdraw period of an hour is over for 2001:db8:300::/48 only
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	withdrawn, state := link.WithdrawRadv(links, previous, now)
+
+	golden(t, filepath.Join("testdata", "withdraw.radvd.conf"), generateRadvdConfig(withdrawn))
+
+	if links["eth0"].Radv.WithdrawnPrefixes != nil {
+		t.Errorf("the configured links were modified")
+	}
+
+	var got []string
+	for _, prefix := range state.Interface("eth0").Prefixes {
+		got = append(got, fmt.Sprintf("%s %v", prefix.Prefix, prefix.Withdrawn))
+	}
+	for _, route := range state.Interface("eth0").Routes {
+		got = append(got, fmt.Sprintf("%s %v", route.Prefix, route.Withdrawn))
+	}
+	want := []string{
+		"2001:db8:0::/64 <nil>",
+		"2001:db8:9::/64 2026-01-01 12:00:00 +0000 UTC",
+		"2001:db8:8::/64 2026-01-01 11:30:00 +0000 UTC",
+		"::/0 <nil>",
+		"2001:db8:200::/48 2026-01-01 11:15:00 +0000 UTC",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("state of eth0:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// The removed link withdraws everything it advertised, the one removed
+	// longer than its withdraw period ago is gone
+	gone := state.Interface("gone0")
+	if gone == nil || len(gone.Prefixes) != 1 || gone.Prefixes[0].Withdrawn == nil || !gone.Prefixes[0].Withdrawn.Equal(now) {
+		t.Errorf("state of the removed link gone0 is %+v, want its prefix withdrawn now", gone)
+	}
+	if withdrawn["gone0"] == nil || withdrawn["gone0"].Radv.DefaultLifetime != 0 {
+		t.Errorf("removed link gone0 is not advertised with a zero router lifetime")
+	}
+	if state.Interface("gone1") != nil || withdrawn["gone1"] != nil {
+		t.Errorf("gone1 is still withdrawn after its withdraw period")
+	}
+}
+
+// fakeRadvd puts a radvd on PATH whose check rejects files containing BROKEN
+func fakeRadvd(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	script := "#!/bin/sh\n[ \"$1\" = -c ] && ! grep -q BROKEN \"$3\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "radvd"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestInstallRadvdConfigAtomically(t *testing.T) {
+	fakeRadvd(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "radvd.conf")
+	if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := installRadvdConfig(path, "BROKEN\n"); err == nil {
+		t.Errorf("rejected config was installed")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "old\n" {
+		t.Errorf("rejected config changed the live file to %q", data)
+	}
+
+	if err := installRadvdConfig(path, "new\n"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new\n" {
+		t.Errorf("live file is %q, want the new config", data)
+	}
+
+	// The new file is renamed over the live one, never truncated
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(before, after) {
+		t.Errorf("live file was written in place instead of replaced")
+	}
+	if after.Mode().Perm() != 0644 {
+		t.Errorf("live file has mode %v, want 0644", after.Mode().Perm())
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("staging files left behind: %v", entries)
+	}
+}
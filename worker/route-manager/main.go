@@ -0,0 +1,358 @@
+package routemanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"natman/link"
+)
+
+// It keeps the policy routing of NAT origins in place: an ip rule per
+// origin selecting its routing table and the default route of that table
+// out of the origin's link. For failover groups it also owns the main
+// default route of the active member and the health check tables.
+// Rules and routes are created with the natman protocol number and only
+// entries carrying it are ever changed, so routes of other daemons and
+// manual rules are left alone.
+
+// Protocol marks the ip rules and routes owned by natman (unassigned in
+// iproute2's rt_protos)
+const Protocol = 250
+
+// ip rule priorities. Health checks of failover members leave through
+// their member's table. The suppress rule lets the main table answer for
+// everything but its default route, so origins still reach local networks.
+const (
+	ProbePriority    = 9000
+	SuppressPriority = 9999
+	RulePriority     = 10000
+)
+
+// Debug flag
+var Debug bool = false
+
+// SetDebug enables debug logging
+func SetDebug(debug bool) {
+	Debug = debug
+}
+
+// DebugPrint prints a message if debug mode is enabled
+func DebugPrint(format string, args ...interface{}) {
+	if Debug {
+		fmt.Printf("[ROUTE-DEBUG] "+format+"\n", args...)
+	}
+}
+
+// entry is an ip rule or route in the argument form ip prints and accepts
+type entry struct {
+	family string // -4 or -6
+	object string // rule or route
+	spec   string
+}
+
+func (e entry) command(action string) string {
+	protocol := "proto"
+	if e.object == "rule" {
+		protocol = "protocol"
+	}
+	return fmt.Sprintf("ip %s %s %s %s %s %d", e.family, e.object, action, e.spec, protocol, Protocol)
+}
+
+func ruleSpec(priority int, from, oif string, fwmark uint32, table string, suppress int) string {
+	parts := []string{"priority", strconv.Itoa(priority)}
+	if from != "" {
+		parts = append(parts, "from", from)
+	}
+	if oif != "" {
+		parts = append(parts, "oif", oif)
+	}
+	if fwmark != 0 {
+		parts = append(parts, "fwmark", fmt.Sprintf("0x%x", fwmark))
+	}
+	parts = append(parts, "lookup", table)
+	if suppress >= 0 {
+		parts = append(parts, "suppress_prefixlength", strconv.Itoa(suppress))
+	}
+	return strings.Join(parts, " ")
+}
+
+func routeSpec(destination, gateway, dev, table string) string {
+	parts := []string{destination}
+	if gateway != "" {
+		parts = append(parts, "via", gateway)
+	}
+	parts = append(parts, "dev", dev, "table", table)
+	return strings.Join(parts, " ")
+}
+
+// desiredEntries renders the rules and routes of every enabled origin with
+// a table and of the failover uplinks
+func desiredEntries(links map[string]*link.Link) []entry {
+	var names []string
+	for name := range links {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var entries []entry
+	seen := make(map[entry]bool)
+	add := func(e entry) {
+		if !seen[e] {
+			seen[e] = true
+			entries = append(entries, e)
+		}
+	}
+
+	for _, family := range []string{"-4", "-6"} {
+		var routed []entry
+		for _, name := range names {
+			for _, origin := range origins(links[name], family) {
+				if origin.Table == 0 {
+					continue
+				}
+
+				table := strconv.Itoa(origin.Table)
+				from := origin.Source
+				if origin.Fwmark != 0 {
+					from = ""
+				}
+				routed = append(routed,
+					entry{family, "route", routeSpec("default", origin.Gateway, name, table)},
+					entry{family, "rule", ruleSpec(RulePriority, from, "", origin.Fwmark, table, -1)})
+			}
+		}
+
+		if len(routed) > 0 {
+			add(entry{family, "rule", ruleSpec(SuppressPriority, "", "", 0, "main", 0)})
+		}
+		for _, e := range routed {
+			add(e)
+		}
+
+		for _, name := range names {
+			uplink := links[name].Uplink
+			if uplink == nil {
+				continue
+			}
+			gateway := uplink.Gateway
+			if family == "-6" {
+				gateway = uplink.Gateway6
+			}
+			if gateway == "" {
+				continue
+			}
+
+			if uplink.Active {
+				add(entry{family, "route", routeSpec("default", gateway, name, "main")})
+			}
+			if uplink.ProbeTable != 0 {
+				table := strconv.Itoa(uplink.ProbeTable)
+				add(entry{family, "route", routeSpec("default", gateway, name, table)})
+				add(entry{family, "rule", ruleSpec(ProbePriority, "", name, 0, table, -1)})
+			}
+		}
+	}
+
+	return entries
+}
+
+// origins returns the origins of the enabled NAT section of the family
+func origins(linkObj *link.Link, family string) []link.Origin {
+	if family == "-4" && linkObj.Nat44 != nil && linkObj.Nat44.Enabled {
+		return linkObj.Nat44.Origins
+	}
+	if family == "-6" && linkObj.Nat66 != nil && linkObj.Nat66.Enabled {
+		return linkObj.Nat66.Origins
+	}
+	return nil
+}
+
+// currentEntries reads the natman rules and routes of both families
+func currentEntries() ([]entry, error) {
+	var entries []entry
+
+	for _, family := range []string{"-4", "-6"} {
+		var rules []map[string]interface{}
+		if err := ipJSON(&rules, family, "rule", "show"); err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			if field(rule, "protocol") != strconv.Itoa(Protocol) {
+				continue
+			}
+			entries = append(entries, entry{family, "rule", parseRule(rule)})
+		}
+
+		var routes []map[string]interface{}
+		if err := ipJSON(&routes, family, "route", "show", "table", "all", "proto", strconv.Itoa(Protocol)); err != nil {
+			return nil, err
+		}
+		for _, route := range routes {
+			table := field(route, "table")
+			if table == "" {
+				table = "main"
+			}
+			entries = append(entries, entry{family, "route",
+				routeSpec(field(route, "dst"), field(route, "gateway"), field(route, "dev"), table)})
+		}
+	}
+
+	return entries, nil
+}
+
+func ipJSON(result interface{}, args ...string) error {
+	cmd := exec.Command("ip", append([]string{"-j"}, args...)...)
+	output, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed to run ip %s: %v", strings.Join(args, " "), err)
+	}
+	if len(strings.TrimSpace(string(output))) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(output, result); err != nil {
+		return fmt.Errorf("failed to parse output of ip %s: %v", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// field returns a JSON value as text, numbers decode as float64
+func field(object map[string]interface{}, key string) string {
+	value, ok := object[key]
+	if !ok {
+		return ""
+	}
+	if number, ok := value.(float64); ok {
+		return strconv.FormatFloat(number, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// parseRule turns an entry of ip -j rule show back into its spec
+func parseRule(rule map[string]interface{}) string {
+	priority, _ := strconv.Atoi(field(rule, "priority"))
+
+	from := ""
+	if src := field(rule, "src"); src != "" && src != "all" {
+		from = src
+		if addr, err := netip.ParseAddr(src); err == nil {
+			bits := addr.BitLen()
+			if srclen := field(rule, "srclen"); srclen != "" {
+				bits, _ = strconv.Atoi(srclen)
+			}
+			from = netip.PrefixFrom(addr, bits).String()
+		}
+	}
+
+	var fwmark uint64
+	if mark := field(rule, "fwmark"); mark != "" {
+		fwmark, _ = strconv.ParseUint(mark, 0, 32)
+	}
+
+	suppress := -1
+	if value := field(rule, "suppress_prefixlen"); value != "" {
+		suppress, _ = strconv.Atoi(value)
+	}
+
+	return ruleSpec(priority, from, field(rule, "oif"), uint32(fwmark), field(rule, "table"), suppress)
+}
+
+// PlanRoutes returns the ip commands an apply would run, without running them
+func PlanRoutes(links map[string]*link.Link) ([]string, []string, error) {
+	toAdd, toRemove, err := diff(links)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var add, remove []string
+	for _, e := range toAdd {
+		add = append(add, e.command(addAction(e)))
+	}
+	for _, e := range toRemove {
+		remove = append(remove, e.command("del"))
+	}
+	return add, remove, nil
+}
+
+// ApplyRoutes adds the missing rules and routes and removes stale ones.
+// Routes go in before the rules pointing at their tables.
+func ApplyRoutes(links map[string]*link.Link) error {
+	toAdd, toRemove, err := diff(links)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, object := range []string{"rule", "route"} {
+		for _, e := range toRemove {
+			if e.object == object {
+				errs = append(errs, run(e, "del"))
+			}
+		}
+	}
+	for _, object := range []string{"route", "rule"} {
+		for _, e := range toAdd {
+			if e.object == object {
+				errs = append(errs, run(e, addAction(e)))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func addAction(e entry) string {
+	if e.object == "route" {
+		return "replace"
+	}
+	return "add"
+}
+
+func run(e entry, action string) error {
+	command := e.command(action)
+	DebugPrint("Running: %s", command)
+
+	parts := strings.Fields(command)
+	output, err := exec.Command(parts[0], parts[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to run %s: %v, output: %s", command, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func diff(links map[string]*link.Link) ([]entry, []entry, error) {
+	current, err := currentEntries()
+	if err != nil {
+		return nil, nil, err
+	}
+	desired := desiredEntries(links)
+
+	present := make(map[entry]bool)
+	for _, e := range current {
+		present[e] = true
+	}
+	wanted := make(map[entry]bool)
+	for _, e := range desired {
+		wanted[e] = true
+	}
+
+	var toAdd, toRemove []entry
+	for _, e := range desired {
+		if !present[e] {
+			toAdd = append(toAdd, e)
+		}
+	}
+	for _, e := range current {
+		if !wanted[e] {
+			toRemove = append(toRemove, e)
+		}
+	}
+
+	DebugPrint("%d rules and routes to add, %d to remove", len(toAdd), len(toRemove))
+	return toAdd, toRemove, nil
+}
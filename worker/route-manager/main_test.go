@@ -0,0 +1,216 @@
+package routemanager
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"natman/link"
+)
+
+func testLinks() map[string]*link.Link {
+	return map[string]*link.Link{
+		"eth0": {Name: "eth0",
+			Nat44: &link.Nat44{Enabled: true, Origins: []link.Origin{
+				{Source: "10.1.0.0/24", Table: 100, Gateway: "192.0.2.1"},
+				{Source: "10.2.0.0/24"}, // no table, no policy routing
+				{Source: "10.3.0.0/24", Table: 101, Fwmark: 0x10},
+			}},
+			Nat66: &link.Nat66{Enabled: false, Origins: []link.Origin{
+				{Source: "fd00:1::/64", Table: 102},
+			}},
+		},
+		"eth1": {Name: "eth1",
+			Uplink: &link.Uplink{Group: "wan", Gateway: "198.51.100.1", Gateway6: "2001:db8::1", ProbeTable: 200, Active: true},
+		},
+		"eth2": {Name: "eth2",
+			Uplink: &link.Uplink{Group: "wan", Gateway: "203.0.113.1", ProbeTable: 201},
+		},
+	}
+}
+
+func TestDesiredEntries(t *testing.T) {
+	var got []string
+	for _, e := range desiredEntries(testLinks()) {
+		got = append(got, e.command("add"))
+	}
+
+	want := []string{
+		"ip -4 rule add priority 9999 lookup main suppress_prefixlength 0 protocol 250",
+		"ip -4 route add default via 192.0.2.1 dev eth0 table 100 proto 250",
+		"ip -4 rule add priority 10000 from 10.1.0.0/24 lookup 100 protocol 250",
+		"ip -4 route add default dev eth0 table 101 proto 250",
+		"ip -4 rule add priority 10000 fwmark 0x10 lookup 101 protocol 250",
+		"ip -4 route add default via 198.51.100.1 dev eth1 table main proto 250",
+		"ip -4 route add default via 198.51.100.1 dev eth1 table 200 proto 250",
+		"ip -4 rule add priority 9000 oif eth1 lookup 200 protocol 250",
+		"ip -4 route add default via 203.0.113.1 dev eth2 table 201 proto 250",
+		"ip -4 rule add priority 9000 oif eth2 lookup 201 protocol 250",
+		"ip -6 route add default via 2001:db8::1 dev eth1 table main proto 250",
+		"ip -6 route add default via 2001:db8::1 dev eth1 table 200 proto 250",
+		"ip -6 rule add priority 9000 oif eth1 lookup 200 protocol 250",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("desiredEntries() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want string
+	}{
+		{"source", `{"priority":10000,"src":"10.1.0.0","srclen":24,"table":"100","protocol":"250"}`,
+			"priority 10000 from 10.1.0.0/24 lookup 100"},
+		{"host source", `{"priority":10000,"src":"2001:db8::5","table":"100","protocol":"250"}`,
+			"priority 10000 from 2001:db8::5/128 lookup 100"},
+		{"fwmark", `{"priority":10000,"src":"all","fwmark":"0x10","table":"101","protocol":"250"}`,
+			"priority 10000 fwmark 0x10 lookup 101"},
+		{"suppress", `{"priority":9999,"src":"all","table":"main","suppress_prefixlen":0,"protocol":"250"}`,
+			"priority 9999 lookup main suppress_prefixlength 0"},
+		{"oif", `{"priority":9000,"src":"all","oif":"eth1","table":"200","protocol":"250"}`,
+			"priority 9000 oif eth1 lookup 200"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rule map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.json), &rule); err != nil {
+				t.Fatal(err)
+			}
+			if got := parseRule(rule); got != tt.want {
+				t.Errorf("parseRule() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeIP puts an ip on PATH that prints the canned JSON of ip -j and logs
+// every other call
+func fakeIP(t *testing.T, output map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range output {
+		if err := os.WriteFile(filepath.Join(dir, name+".json"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log := filepath.Join(dir, "log")
+	script := "#!/bin/sh\nif [ \"$1\" = -j ]; then cat " + dir + "/$3${2#-}.json 2>/dev/null; exit 0; fi\n" +
+		"echo \"ip $*\" >> " + log + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "ip"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return log
+}
+
+// driftOutput has part of the entries of testLinks, a stale origin, an
+// entry of another daemon and a route of a removed probe table
+var driftOutput = map[string]string{
+	"rule4": `[{"priority":0,"src":"all","table":"local"},
+		{"priority":9999,"src":"all","table":"main","suppress_prefixlen":0,"protocol":"250"},
+		{"priority":10000,"src":"10.1.0.0","srclen":24,"table":"100","protocol":"250"},
+		{"priority":10000,"src":"10.9.0.0","srclen":24,"table":"109","protocol":"250"},
+		{"priority":10000,"src":"10.3.0.0","srclen":24,"table":"101","protocol":"250"},
+		{"priority":20000,"src":"10.4.0.0","srclen":24,"table":"300"},
+		{"priority":9000,"src":"all","oif":"eth1","table":"200","protocol":"250"},
+		{"priority":9000,"src":"all","oif":"eth2","table":"201","protocol":"250"},
+		{"priority":32766,"src":"all","table":"main"}]`,
+	"route4": `[{"type":"unicast","dst":"default","gateway":"192.0.2.1","dev":"eth0","table":"100","protocol":"250","flags":[]},
+		{"type":"unicast","dst":"default","dev":"eth0","table":"101","protocol":"250","flags":[]},
+		{"type":"unicast","dst":"default","gateway":"192.0.2.9","dev":"eth0","table":"109","protocol":"250","flags":[]},
+		{"dst":"default","gateway":"198.51.100.1","dev":"eth1","protocol":"250","flags":[]},
+		{"dst":"default","gateway":"198.51.100.1","dev":"eth1","table":"200","protocol":"250","flags":[]},
+		{"dst":"default","gateway":"203.0.113.1","dev":"eth2","table":"201","protocol":"250","flags":[]}]`,
+	"rule6": `[{"priority":0,"src":"all","table":"local"},
+		{"priority":9000,"src":"all","oif":"eth1","table":"200","protocol":"250"},
+		{"priority":32766,"src":"all","table":"main"}]`,
+	"route6": `[{"dst":"default","gateway":"2001:db8::1","dev":"eth2","protocol":"250","flags":[]},
+		{"dst":"default","gateway":"2001:db8::1","dev":"eth1","table":"200","protocol":"250","flags":[]}]`,
+}
+
+func TestPlanRoutes(t *testing.T) {
+	fakeIP(t, driftOutput)
+
+	add, remove, err := PlanRoutes(testLinks())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantAdd := []string{
+		"ip -4 rule add priority 10000 fwmark 0x10 lookup 101 protocol 250",
+		"ip -6 route replace default via 2001:db8::1 dev eth1 table main proto 250",
+	}
+	wantRemove := []string{
+		"ip -4 rule del priority 10000 from 10.9.0.0/24 lookup 109 protocol 250",
+		"ip -4 rule del priority 10000 from 10.3.0.0/24 lookup 101 protocol 250",
+		"ip -4 route del default via 192.0.2.9 dev eth0 table 109 proto 250",
+		"ip -6 route del default via 2001:db8::1 dev eth2 table main proto 250",
+	}
+	if !reflect.DeepEqual(add, wantAdd) {
+		t.Errorf("add =\n%s\nwant\n%s", strings.Join(add, "\n"), strings.Join(wantAdd, "\n"))
+	}
+	if !reflect.DeepEqual(remove, wantRemove) {
+		t.Errorf("remove =\n%s\nwant\n%s", strings.Join(remove, "\n"), strings.Join(wantRemove, "\n"))
+	}
+}
+
+func TestPlanRoutesInSync(t *testing.T) {
+	links := testLinks()
+	links["eth0"].Nat44.Origins = nil
+	links["eth2"].Uplink = nil
+	links["eth1"].Uplink.Gateway6 = ""
+	fakeIP(t, map[string]string{
+		"rule4": `[{"priority":9000,"src":"all","oif":"eth1","table":"200","protocol":"250"}]`,
+		"route4": `[{"dst":"default","gateway":"198.51.100.1","dev":"eth1","protocol":"250","flags":[]},
+			{"dst":"default","gateway":"198.51.100.1","dev":"eth1","table":"200","protocol":"250","flags":[]}]`,
+	})
+
+	add, remove, err := PlanRoutes(links)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(add) != 0 || len(remove) != 0 {
+		t.Errorf("PlanRoutes() = %v, %v, want no changes", add, remove)
+	}
+}
+
+func TestApplyRoutesOrder(t *testing.T) {
+	log := fakeIP(t, driftOutput)
+
+	if err := ApplyRoutes(testLinks()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stale rules go before the routes of their tables, new routes before
+	// the rules pointing at them
+	want := []string{
+		"ip -4 rule del priority 10000 from 10.9.0.0/24 lookup 109 protocol 250",
+		"ip -4 rule del priority 10000 from 10.3.0.0/24 lookup 101 protocol 250",
+		"ip -4 route del default via 192.0.2.9 dev eth0 table 109 proto 250",
+		"ip -6 route del default via 2001:db8::1 dev eth2 table main proto 250",
+		"ip -6 route replace default via 2001:db8::1 dev eth1 table main proto 250",
+		"ip -4 rule add priority 10000 fwmark 0x10 lookup 101 protocol 250",
+	}
+	if got := strings.Split(strings.TrimSpace(string(data)), "\n"); !reflect.DeepEqual(got, want) {
+		t.Errorf("ip calls =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestPlanRoutesBadOutput(t *testing.T) {
+	fakeIP(t, map[string]string{"rule4": "not json"})
+
+	if _, _, err := PlanRoutes(testLinks()); err == nil || !strings.Contains(err.Error(), "failed to parse output of ip -4 rule show") {
+		t.Errorf("PlanRoutes() error = %v, want a parse error", err)
+	}
+}